@@ -6,6 +6,8 @@ package browser
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -29,8 +31,14 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 512
+
+	// Time allowed to the HTTP server to close its connections when the context is done.
+	shutdownWait = 1 * time.Second
 )
 
+// peersPrefix starts the messages which replace the peers list of the webpage (a JSON array of lines)
+const peersPrefix = "\x1b]peers "
+
 var (
 	newline = []byte{'\n'}
 	space   = []byte{' '}
@@ -44,9 +52,12 @@ var upgrader = websocket.Upgrader{
 var connectedWebpage *Webpage
 
 // Webpage is a middleman between the websocket connection and Go.
+// It is closed when the context given to Connect is done.
 type Webpage struct {
 	Disconnected chan bool
 
+	ctx context.Context
+
 	receiveCallback func(string)
 
 	// The websocket connection.
@@ -63,7 +74,7 @@ type Webpage struct {
 func (wpage *Webpage) receiveLoop() {
 	defer func() {
 		wpage.conn.Close()
-		wpage.Disconnected <- true
+		wpage.disconnected()
 	}()
 	wpage.conn.SetReadLimit(maxMessageSize)
 	wpage.conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -78,7 +89,11 @@ func (wpage *Webpage) receiveLoop() {
 		}
 		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
 
-		wpage.receive <- string(message)
+		select {
+		case wpage.receive <- string(message):
+		case <-wpage.ctx.Done():
+			return
+		}
 		if wpage.receiveCallback != nil {
 			wpage.receiveCallback(string(message))
 		}
@@ -91,10 +106,14 @@ func (wpage *Webpage) sendLoop() {
 	defer func() {
 		ticker.Stop()
 		wpage.conn.Close()
-		wpage.Disconnected <- true
+		wpage.disconnected()
 	}()
 	for {
 		select {
+		case <-wpage.ctx.Done():
+			wpage.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			wpage.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+			return
 		case message, ok := <-wpage.send:
 			byteMessage := []byte(message)
 			wpage.conn.SetWriteDeadline(time.Now().Add(writeWait))
@@ -129,12 +148,29 @@ func (wpage *Webpage) sendLoop() {
 	}
 }
 
+// disconnected tells Disconnected that a loop of the webpage stopped, unless nobody listens anymore
+func (wpage *Webpage) disconnected() {
+	select {
+	case wpage.Disconnected <- true:
+	case <-wpage.ctx.Done():
+	}
+}
+
 // SendMessage sends a message to the browser
 func (wpage *Webpage) SendMessage(message string) {
 	// TODO : explore b.conn.WriteJSON;
 	wpage.send <- message
 }
 
+// SendPeers replaces the peers list shown next to the messages
+func (wpage *Webpage) SendPeers(peers []string) {
+	raw, err := json.Marshal(peers)
+	if err != nil {
+		return
+	}
+	wpage.send <- peersPrefix + string(raw)
+}
+
 // OnReceiveMessage registers a callback for messages received from the browser
 func (wpage *Webpage) OnReceiveMessage(callback func(string)) {
 	wpage.receiveCallback = callback
@@ -168,7 +204,7 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 }
 
 // serveWs handles websocket requests from the peer.
-func serveWs(w http.ResponseWriter, r *http.Request, connected chan *Webpage) {
+func serveWs(ctx context.Context, w http.ResponseWriter, r *http.Request, connected chan *Webpage) {
 
 	if connectedWebpage != nil {
 		http.Error(w, "Browser already opened and connected", http.StatusTeapot)
@@ -182,7 +218,7 @@ func serveWs(w http.ResponseWriter, r *http.Request, connected chan *Webpage) {
 		return
 	}
 
-	wpage := &Webpage{conn: conn, send: make(chan string, 256), receive: make(chan string, 256), Disconnected: make(chan bool)}
+	wpage := &Webpage{ctx: ctx, conn: conn, send: make(chan string, 256), receive: make(chan string, 256), Disconnected: make(chan bool)}
 	go wpage.sendLoop()
 	go wpage.receiveLoop()
 
@@ -190,7 +226,8 @@ func serveWs(w http.ResponseWriter, r *http.Request, connected chan *Webpage) {
 }
 
 // Connect : connect to browser
-func Connect(host string, port int) (*Webpage, error) {
+// the HTTP server and the webpage are closed when ctx is done
+func Connect(ctx context.Context, host string, port int) (*Webpage, error) {
 
 	addr := host + ":" + strconv.Itoa(port)
 
@@ -199,9 +236,13 @@ func Connect(host string, port int) (*Webpage, error) {
 	}
 
 	connected := make(chan *Webpage)
-	go startServer(addr, connected)
+	go startServer(ctx, addr, connected)
 
-	connectedWebpage = <-connected
+	select {
+	case connectedWebpage = <-connected:
+	case <-ctx.Done():
+		return nil, errors.New("Interrupted while waiting for the browser")
+	}
 	if connectedWebpage == nil {
 		return nil, errors.New("Couldn't connect to browser")
 	}
@@ -209,11 +250,20 @@ func Connect(host string, port int) (*Webpage, error) {
 	return connectedWebpage, nil
 }
 
-func startServer(addr string, connected chan *Webpage) {
-	http.HandleFunc("/", serveHome)
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		serveWs(w, r, connected)
+func startServer(ctx context.Context, addr string, connected chan *Webpage) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", serveHome)
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		serveWs(ctx, w, r, connected)
 	})
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownWait)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
 
 	go func() {
 		time.Sleep(200 * time.Millisecond)
@@ -222,8 +272,8 @@ func startServer(addr string, connected chan *Webpage) {
 		fmt.Println("HTTP server listening on " + fullAddr)
 	}()
 
-	err := http.ListenAndServe(addr, nil)
-	if err != nil {
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatal("ListenAndServe: ", err)
 		connected <- nil
 	}
@@ -0,0 +1,239 @@
+package chat
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/teanan/GOssip-TP/network"
+)
+
+const (
+	// ClearScreen is written on the output to clear the terminal (and the webui log)
+	ClearScreen = "\x1b[H\x1b[2J"
+
+	actionPrefix = "/me " // SAY messages starting with actionPrefix are displayed as actions
+)
+
+// registerBuiltinCommands registers the commands available by default
+func (processor *CommandProcessor) registerBuiltinCommands() {
+	processor.Register(Command{
+		Name:        "help",
+		Aliases:     []string{"h", "?"},
+		Usage:       "/help",
+		Description: "show this list of commands",
+		Handler:     processor.help,
+	})
+	processor.Register(Command{
+		Name:        "msg",
+		Aliases:     []string{"m", "tell"},
+		Usage:       "/msg <username> <text>",
+		Description: "send an encrypted private message",
+		Handler:     processor.sayTo,
+	})
+	processor.Register(Command{
+		Name:        "me",
+		Usage:       "/me <action>",
+		Description: "describe what you are doing in the current room",
+		Handler:     processor.me,
+	})
+	processor.Register(Command{
+		Name:        "nick",
+		Usage:       "/nick <username> [password]",
+		Description: "change your username (the password is needed if it is protected by one)",
+		Handler:     processor.nick,
+	})
+	processor.Register(Command{
+		Name:        "register",
+		Usage:       "/register [password]",
+		Description: "reserve your username in the next sessions, to your identity key or to whoever knows the password",
+		Handler:     processor.register,
+	})
+	processor.Register(Command{
+		Name:        "who",
+		Aliases:     []string{"w"},
+		Usage:       "/who",
+		Description: "list the known peers",
+		Handler:     processor.who,
+	})
+	processor.Register(Command{
+		Name:        "join",
+		Aliases:     []string{"j"},
+		Usage:       "/join #room",
+		Description: "join a room and make it the current room",
+		Handler:     processor.join,
+	})
+	processor.Register(Command{
+		Name:        "part",
+		Aliases:     []string{"leave"},
+		Usage:       "/part [#room]",
+		Description: "leave a room (the current room by default)",
+		Handler:     processor.part,
+	})
+	processor.Register(Command{
+		Name:        "rooms",
+		Usage:       "/rooms",
+		Description: "list the rooms you joined and their members",
+		Handler:     processor.rooms,
+	})
+	processor.Register(Command{
+		Name:        "history",
+		Usage:       "/history [#room|@username] [n|since]",
+		Description: "show the last n messages, or the messages since a duration (2h) or a date (2006-01-02, 15:04)",
+		Handler:     processor.showHistory,
+	})
+	processor.Register(Command{
+		Name:        "ignore",
+		Usage:       "/ignore [username]",
+		Description: "hide (or show again) the messages of a peer, list ignored peers without username",
+		Handler:     processor.ignore,
+	})
+	processor.Register(Command{
+		Name:        "clear",
+		Aliases:     []string{"cls"},
+		Usage:       "/clear",
+		Description: "clear the screen",
+		Handler:     processor.clear,
+	})
+	processor.Register(Command{
+		Name:        "quit",
+		Aliases:     []string{"q", "exit"},
+		Usage:       "/quit",
+		Description: "leave the chat",
+		Handler:     processor.quitChat,
+	})
+}
+
+// usage prints the usage of a command
+func (processor *CommandProcessor) usage(name string) {
+	if found, command := processor.commands.Find(name); found {
+		processor.messageOutput <- "Usage : " + command.Usage
+	}
+}
+
+func (processor *CommandProcessor) help(params string) {
+	processor.messageOutput <- "Available commands :"
+	for _, line := range processor.commands.Help() {
+		processor.messageOutput <- "  " + line
+	}
+}
+
+// me sends an action to the current room, it is displayed as "* username action"
+func (processor *CommandProcessor) me(params string) {
+	if params == "" {
+		processor.usage("me")
+		return
+	}
+	if processor.currentRoom == "" {
+		processor.messageOutput <- "You are not in any room, use /join #room"
+		return
+	}
+
+	processor.messageOutput <- processor.currentRoom + " * " + processor.peers.GetLocalUsername() + " " + params
+	message := processor.gossip.Broadcast("SAY", processor.currentRoom, actionPrefix+params)
+	recordMessage(processor.history, message)
+}
+
+// nick asks the directory for a new username, it checks that nobody else uses it and tells every peer
+// without directory, the username is only checked against the known peers and sent to them
+func (processor *CommandProcessor) nick(params string) {
+	fields := strings.Fields(params)
+	if len(fields) < 1 || len(fields) > 2 {
+		processor.usage("nick")
+		return
+	}
+
+	password := ""
+	if len(fields) == 2 {
+		password = fields[1]
+	}
+	if processor.stack.RequestName(fields[0], password) {
+		return
+	}
+
+	processor.messageOutput <- "Not connected to a directory, the username is only checked against the known peers"
+	if found, _ := processor.peers.FindByName(fields[0]); found {
+		processor.messageOutput <- "Username " + fields[0] + " is already taken"
+		return
+	}
+	processor.stack.SetLocalName(fields[0])
+	processor.SetUsername(fields[0])
+	processor.peers.SendToAll(network.Message{
+		Kind: "NAME",
+		Data: fields[0],
+	})
+}
+
+// register asks the directory to reserve our username in the next sessions
+func (processor *CommandProcessor) register(params string) {
+	if strings.ContainsAny(params, " \t") {
+		processor.usage("register")
+		return
+	}
+
+	if !processor.stack.ProtectName(params) {
+		processor.messageOutput <- "Not connected to a directory"
+	}
+}
+
+// who lists the known peers, with their address and rooms
+func (processor *CommandProcessor) who(params string) {
+	peers := processor.peers.List()
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].String() < peers[j].String()
+	})
+
+	processor.messageOutput <- processor.peers.GetLocalUsername() + " (you) " + strings.Join(processor.peers.GetLocalRooms(), " ")
+	for _, peer := range peers {
+		line := peer.String() + " (" + peer.FullAddress() + ") " + strings.Join(peer.Rooms(), " ") + peerStatus(peer)
+		if processor.peers.IsIgnored(peer.PublicKey()) {
+			line += " [ignored]"
+		}
+		processor.messageOutput <- line
+	}
+}
+
+// peerStatus returns the liveness of a peer, and the state of its connection if it isn't connected, as " [suspect]"
+func peerStatus(peer network.Peer) string {
+	status := []string{peer.Liveness().String()}
+	if peer.ConnectionState() != network.Connected {
+		status = append(status, peer.ConnectionState().String())
+	}
+	return " [" + strings.Join(status, ", ") + "]"
+}
+
+// ignore hides the messages of a peer, or shows them again if it was already ignored
+// peers are ignored by identity key, so they stay ignored if they change their username
+func (processor *CommandProcessor) ignore(params string) {
+	if params == "" {
+		for _, peer := range processor.peers.List() {
+			if processor.peers.IsIgnored(peer.PublicKey()) {
+				processor.messageOutput <- "Ignoring " + peer.String()
+			}
+		}
+		return
+	}
+
+	found, peer := processor.peers.FindByName(params)
+	if !found {
+		processor.messageOutput <- "Unknown user " + params
+		return
+	}
+
+	if processor.peers.ToggleIgnore(peer.PublicKey()) {
+		processor.messageOutput <- "Ignoring " + peer.String()
+	} else {
+		processor.messageOutput <- "No longer ignoring " + peer.String()
+	}
+}
+
+func (processor *CommandProcessor) clear(params string) {
+	processor.messageOutput <- ClearScreen
+}
+
+func (processor *CommandProcessor) quitChat(params string) {
+	select {
+	case <-processor.quit:
+	default:
+		close(processor.quit)
+	}
+}
@@ -1,54 +1,255 @@
 package chat
 
 import (
+	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/teanan/GOssip-TP/history"
 	"github.com/teanan/GOssip-TP/network"
 )
 
-// commandProcessor handles outgoing messages to other peers
-// it contains a pointer to the common peersMap and a channel to output to the screen
-type commandProcessor struct {
-	peers         *peersMap
+const (
+	privatePrefix = "(private) " // marks private messages on the screen and in the browser
+	defaultRoom   = "#general"   // room joined at startup
+
+	resolveTimeout = 10 * time.Second // time allowed to connect to a user found by the name service
+)
+
+// NameService finds the identity key and chat address ("a.b.c.d:0000") of a user who is not in the peers map,
+// and publishes our own username
+type NameService interface {
+	Resolve(username string) (ed25519.PublicKey, string, error)
+	Publish(username string) error
+}
+
+// CommandProcessor handles outgoing messages to other peers
+// it contains the network stack, a pointer to the common PeersMap, the gossip used to broadcast messages and a channel to output to the screen
+// history is where sent messages are saved
+// currentRoom is the room of the messages typed without a command
+// commands is the registry of slash commands, quit is closed by /quit
+// names finds the users we don't know, it can be nil
+// historyLines are the lines shown by /history, see HistoryLines
+type CommandProcessor struct {
+	stack         *network.Stack
+	peers         *PeersMap
+	gossip        *gossip
+	history       *history.Store
 	messageOutput chan<- string
+	currentRoom   string
+	commands      *commandRegistry
+	quit          chan bool
+	names         NameService
+	historyLines  []string
 }
 
 // Process handles raw text messages from the command line or webui
-func (processor *commandProcessor) Process(command string) {
+func (processor *CommandProcessor) Process(command string) {
 
 	if strings.HasPrefix(command, "/") {
-		commandName := ""
+		fields := strings.SplitN(strings.TrimPrefix(command, "/"), " ", 2)
+		commandName, commandParams := fields[0], ""
+		if len(fields) == 2 {
+			commandParams = strings.TrimSpace(fields[1])
+		}
+
+		found, cmd := processor.commands.Find(commandName)
+		if !found {
+			processor.messageOutput <- "Unknown command /" + commandName + ", type /help for the list of commands"
+			return
+		}
 
-		// question 5
+		cmd.Handler(commandParams)
+	} else if err := processor.Say(processor.currentRoom, command); err != nil {
+		processor.messageOutput <- err.Error()
+	}
+}
+
+// Register adds a slash command to the commands available on the command line and in the webui
+func (processor *CommandProcessor) Register(command Command) {
+	processor.commands.Register(command)
+}
 
-		switch commandName {
-		default:
-			fmt.Print("Unknown command", commandName)
+// Quit returns a channel which is closed when the user typed /quit
+func (processor *CommandProcessor) Quit() <-chan bool {
+	return processor.quit
+}
+
+// Say sends an outgoing message of kind SAY to the members of room, which must be joined
+func (processor *CommandProcessor) Say(room string, text string) error {
+	if room == "" {
+		return errors.New("You are not in any room, use /join #room")
+	}
+	if !processor.peers.InLocalRoom(room) {
+		return errors.New("You are not in " + room + ", use /join " + room)
+	}
+
+	processor.messageOutput <- room + " [" + processor.peers.GetLocalUsername() + "] " + text
+	message := processor.gossip.Broadcast("SAY", room, text)
+	recordMessage(processor.history, message)
+	return nil
+}
+
+// join joins a room (announced to the other peers through the directory) and makes it the current room
+func (processor *CommandProcessor) join(room string) {
+	if !network.ValidRoomName(room) {
+		processor.usage("join")
+		return
+	}
+
+	processor.peers.JoinRoom(room)
+	processor.stack.JoinRoom(room)
+	processor.currentRoom = room
+	processor.messageOutput <- "Now talking in " + room
+}
+
+// part leaves a room, the current room is left if no room is given
+func (processor *CommandProcessor) part(room string) {
+	if room == "" {
+		room = processor.currentRoom
+	}
+
+	if !processor.peers.InLocalRoom(room) {
+		processor.messageOutput <- "You are not in " + room
+		return
+	}
+
+	processor.peers.PartRoom(room)
+	processor.stack.PartRoom(room)
+	processor.messageOutput <- "Left " + room
+
+	if room == processor.currentRoom {
+		processor.currentRoom = ""
+		if rooms := processor.peers.GetLocalRooms(); len(rooms) > 0 {
+			processor.currentRoom = rooms[0]
+			processor.messageOutput <- "Now talking in " + processor.currentRoom
 		}
-	} else {
-		processor.say(command)
 	}
 }
 
-// say sends outgoing messages of kind SAY
-func (processor *commandProcessor) say(command string) {
-	processor.messageOutput <- "[" + processor.peers.GetLocalUsername() + "] " + command
-	processor.peers.SendToAll(network.Message{
-		Kind: "SAY",
-		Data: command,
-	})
+// rooms prints the rooms we joined and their known members
+func (processor *CommandProcessor) rooms(params string) {
+	for _, room := range processor.peers.GetLocalRooms() {
+		members := []string{processor.peers.GetLocalUsername()}
+		for _, peer := range processor.peers.RoomMembers(room) {
+			members = append(members, peer.String())
+		}
+
+		current := ""
+		if room == processor.currentRoom {
+			current = " (current)"
+		}
+		processor.messageOutput <- room + current + " : " + strings.Join(members, ", ")
+	}
+}
+
+// sayTo sends outgoing messages of kind SAYTO (private messages)
+// commandParams is "username text", text is encrypted so only username can read it, even if other peers relay it
+// a username we don't know is looked up with the name service, in the background
+func (processor *CommandProcessor) sayTo(commandParams string) {
+	params := strings.SplitN(commandParams, " ", 2)
+	if len(params) != 2 || params[1] == "" {
+		processor.usage("msg")
+		return
+	}
+
+	found, peer := processor.peers.FindByName(params[0])
+	if found {
+		processor.sendPrivate(peer, params[1])
+		return
+	}
+
+	if processor.names == nil {
+		processor.messageOutput <- "Unknown user " + params[0]
+		return
+	}
+
+	processor.messageOutput <- "Looking up " + params[0] + "..."
+	go processor.resolveAndSayTo(params[0], params[1])
+}
+
+// resolveAndSayTo finds the address of username with the name service, connects to it and sends it a private message
+func (processor *CommandProcessor) resolveAndSayTo(username string, text string) {
+	publicKey, address, err := processor.names.Resolve(username)
+	if err != nil {
+		processor.messageOutput <- fmt.Sprint("Unknown user ", username, " (", err, ")")
+		return
+	}
+
+	processor.stack.AddPeer(address, publicKey)
+
+	// the peer is added to the peers map by the main loop, once the membership sent the new list
+	deadline := time.Now().Add(resolveTimeout)
+	for time.Now().Before(deadline) {
+		if found, peer := processor.peers.FindByKey(publicKey); found {
+			processor.sendPrivate(peer, text)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	processor.messageOutput <- "Failed to connect to " + username + " at " + address
+}
+
+// sendPrivate encrypts text for peer, and sends it through the gossip (and directly to peer)
+func (processor *CommandProcessor) sendPrivate(peer network.Peer, text string) {
+	sealed, err := processor.stack.Seal(peer.PublicKey(), text)
+	if err != nil {
+		processor.messageOutput <- fmt.Sprint("Failed to encrypt message for ", peer, " : ", err)
+		return
+	}
+
+	processor.messageOutput <- privatePrefix + "[" + processor.peers.GetLocalUsername() + " -> " + peer.String() + "] " + text
+	message := processor.gossip.Broadcast("SAYTO", anyRoom, network.EncodePublicKey(peer.PublicKey())+" "+sealed, peer)
+	record(processor.history, message.ID, message.Time, historyPrivate+peer.String(), message.Origin, text)
 }
 
-// say sends outgoing messages of kind SAYTO (private messages)
-func (processor *commandProcessor) sayTo(commandParams string) {
+// UseNameService sets the name service used to find the users who are not in the peers map, and to publish our username
+func (processor *CommandProcessor) UseNameService(names NameService) {
+	processor.names = names
+}
 
+// SetUsername sets the username of the local client, given by the directory or by /nick, and publishes it
+func (processor *CommandProcessor) SetUsername(username string) {
+	processor.peers.SetLocalUsername(username)
+	processor.PublishUsername(username)
+	processor.messageOutput <- "You are now known as " + username
 }
 
-// NewCommandProcessor builds a new CommandProcessor with pointer to the common peersMap and channel to output to the screen
-func NewCommandProcessor(peers *peersMap, messageOutput chan<- string) *commandProcessor {
-	return &commandProcessor{
+// PublishUsername publishes our username with the name service, in the background
+func (processor *CommandProcessor) PublishUsername(username string) {
+	if processor.names == nil {
+		return
+	}
+
+	go func() {
+		if err := processor.names.Publish(username); err != nil {
+			fmt.Println("Username not published :", err)
+		}
+	}()
+}
+
+// NewCommandProcessor builds a new CommandProcessor with the network stack, pointer to the common PeersMap, the gossip, the history
+// and channel to output to the screen
+// the local client joins the default room
+func NewCommandProcessor(stack *network.Stack, peers *PeersMap, gossip *gossip, store *history.Store, messageOutput chan<- string) *CommandProcessor {
+	processor := &CommandProcessor{
+		stack:         stack,
 		peers:         peers,
+		gossip:        gossip,
+		history:       store,
 		messageOutput: messageOutput,
+		commands:      newCommandRegistry(),
+		quit:          make(chan bool),
 	}
+
+	processor.registerBuiltinCommands()
+
+	processor.peers.JoinRoom(defaultRoom)
+	processor.stack.JoinRoom(defaultRoom)
+	processor.currentRoom = defaultRoom
+
+	return processor
 }
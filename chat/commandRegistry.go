@@ -0,0 +1,65 @@
+package chat
+
+import (
+	"sort"
+	"strings"
+)
+
+// Command is a slash command ("/name params") typed on the command line or in the webui
+// Usage is shown by /help, with Description, Handler is called with the text following the command name
+type Command struct {
+	Name        string
+	Aliases     []string
+	Usage       string
+	Description string
+	Handler     func(params string)
+}
+
+// commandRegistry stores the commands by name and by alias
+type commandRegistry struct {
+	commands map[string]*Command // by name and alias
+	names    []string            // sorted names, used to build the help
+}
+
+// Register adds a command, it replaces a previously registered command with the same name or alias
+func (registry *commandRegistry) Register(command Command) {
+	for _, name := range append([]string{command.Name}, command.Aliases...) {
+		registry.commands[strings.ToLower(name)] = &command
+	}
+
+	for _, name := range registry.names {
+		if name == command.Name {
+			return
+		}
+	}
+	registry.names = append(registry.names, command.Name)
+	sort.Strings(registry.names)
+}
+
+// Find looks for a command by name or alias
+// first return parameter is true if we found it, false otherwise
+func (registry *commandRegistry) Find(name string) (bool, *Command) {
+	command, found := registry.commands[strings.ToLower(name)]
+	return found, command
+}
+
+// Help returns one line per command, with its usage, aliases and description
+func (registry *commandRegistry) Help() []string {
+	lines := make([]string, 0, len(registry.names))
+	for _, name := range registry.names {
+		command := registry.commands[strings.ToLower(name)]
+
+		line := command.Usage
+		if len(command.Aliases) > 0 {
+			line += " (/" + strings.Join(command.Aliases, ", /") + ")"
+		}
+		lines = append(lines, line+" : "+command.Description)
+	}
+	return lines
+}
+
+func newCommandRegistry() *commandRegistry {
+	return &commandRegistry{
+		commands: make(map[string]*Command),
+	}
+}
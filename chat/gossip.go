@@ -0,0 +1,192 @@
+package chat
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teanan/GOssip-TP/network"
+)
+
+const (
+	gossipFanout   = 3    // number of random peers a message is forwarded to
+	gossipTTL      = 6    // number of hops a message can travel
+	seenCacheSize  = 4096 // number of message IDs remembered to drop duplicates
+	messageIDBytes = 8
+
+	anyRoom = "*" // room of the messages relayed by every peer (private messages)
+)
+
+// gossipMessage is the content of a SAY message relayed between peers
+// the message is encoded as "<id> <origin key> <ttl> <time> <room> <signature> <text>", time is when it was sent in unix milliseconds
+// the origin signs everything but the ttl, so the peers which relay the message can't change who wrote it
+// Origin is the name shown for the author : ours when we send it, the one of the peer owning Key when we receive it
+type gossipMessage struct {
+	ID        string
+	Key       ed25519.PublicKey
+	Origin    string
+	TTL       int
+	Time      time.Time
+	Room      string
+	Signature string
+	Text      string
+}
+
+// gossip disseminates messages to the members of a room :
+// each peer forwards a new message to a few random members, and drops the messages it has already seen
+type gossip struct {
+	stack *network.Stack
+	peers *PeersMap
+	seen  *seenCache
+}
+
+// seenCache remembers the last seen message IDs
+// when it is full, the oldest ID is forgotten
+type seenCache struct {
+	mutex sync.Mutex
+	ids   map[string]bool
+	order []string
+	next  int
+}
+
+// Broadcast sends a new message from the local client to the members of room
+// the direct peers always get the message, in addition to the random members
+func (g *gossip) Broadcast(kind string, room string, text string, direct ...network.Peer) gossipMessage {
+	message := gossipMessage{
+		ID:     newMessageID(),
+		Key:    g.stack.LocalKey(),
+		Origin: g.peers.GetLocalUsername(),
+		TTL:    gossipTTL,
+		Time:   time.UnixMilli(time.Now().UnixMilli()), // the precision of the encoded message, so every peer saves the same time
+		Room:   room,
+		Text:   text,
+	}
+	message.Signature = g.stack.SignGossip(message.signedFields(kind)...)
+
+	g.seen.Add(message.ID)
+	g.forward(kind, message, "")
+	for _, peer := range direct {
+		g.peers.SendTo(peer, network.Message{
+			Kind: kind,
+			Data: message.String(),
+		})
+	}
+
+	return message
+}
+
+// Relay handles a message received from a peer
+// it returns false if the message was already seen and must be ignored
+func (g *gossip) Relay(kind string, message gossipMessage, from network.Peer) bool {
+	if !g.seen.Add(message.ID) {
+		return false
+	}
+
+	if message.TTL > 1 {
+		message.TTL--
+		g.forward(kind, message, from.FullAddress())
+	}
+
+	return true
+}
+
+func (g *gossip) forward(kind string, message gossipMessage, except string) {
+	for _, peer := range g.peers.RandomPeers(gossipFanout, except, message.Room) {
+		g.peers.SendTo(peer, network.Message{
+			Kind: kind,
+			Data: message.String(),
+		})
+	}
+}
+
+// String encodes the message as the data of a network.Message
+func (m gossipMessage) String() string {
+	return m.ID + " " + network.EncodePublicKey(m.Key) + " " + strconv.Itoa(m.TTL) + " " + strconv.FormatInt(m.Time.UnixMilli(), 10) + " " +
+		m.Room + " " + m.Signature + " " + m.Text
+}
+
+// signedFields returns what the origin signs, the kind of the message is signed too so a SAY can't be replayed as a SAYTO
+func (m gossipMessage) signedFields(kind string) []string {
+	return []string{kind, m.ID, strconv.FormatInt(m.Time.UnixMilli(), 10), m.Room, m.Text}
+}
+
+// Verify returns true if the message of kind was signed by the owner of its origin key
+func (m gossipMessage) Verify(kind string) bool {
+	return network.VerifyGossip(m.Key, m.Signature, m.signedFields(kind)...)
+}
+
+// parseGossipMessage decodes the data of a network.Message, the signature is not checked
+func parseGossipMessage(data string) (gossipMessage, bool) {
+	fields := strings.SplitN(data, " ", 7)
+	if len(fields) < 7 {
+		return gossipMessage{}, false
+	}
+
+	key, err := network.DecodePublicKey(fields[1])
+	if err != nil {
+		return gossipMessage{}, false
+	}
+
+	ttl, err := strconv.Atoi(fields[2])
+	if err != nil || ttl < 1 {
+		return gossipMessage{}, false
+	}
+
+	millis, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return gossipMessage{}, false
+	}
+
+	return gossipMessage{
+		ID:        fields[0],
+		Key:       key,
+		TTL:       ttl,
+		Time:      time.UnixMilli(millis),
+		Room:      fields[4],
+		Signature: fields[5],
+		Text:      fields[6],
+	}, true
+}
+
+// Add remembers id, and returns false if it was already known
+func (cache *seenCache) Add(id string) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.ids[id] {
+		return false
+	}
+
+	if len(cache.order) < cap(cache.order) {
+		cache.order = append(cache.order, id)
+	} else {
+		delete(cache.ids, cache.order[cache.next])
+		cache.order[cache.next] = id
+		cache.next = (cache.next + 1) % len(cache.order)
+	}
+	cache.ids[id] = true
+
+	return true
+}
+
+func newMessageID() string {
+	raw := make([]byte, messageIDBytes)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// NewGossip builds a new gossip with pointer to the common PeersMap, stack signs the messages we write
+func NewGossip(stack *network.Stack, peers *PeersMap) *gossip {
+	return &gossip{
+		stack: stack,
+		peers: peers,
+		seen: &seenCache{
+			ids:   make(map[string]bool),
+			order: make([]string, 0, seenCacheSize),
+		},
+	}
+}
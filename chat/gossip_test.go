@@ -0,0 +1,56 @@
+package chat
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/teanan/GOssip-TP/network"
+)
+
+// newTestGossip returns the gossip of a peer named name, with a new identity
+func newTestGossip(name string) *gossip {
+	_, key, _ := ed25519.GenerateKey(nil)
+	peers := NewPeersMap()
+	peers.SetLocalUsername(name)
+	return NewGossip(network.NewStack(key), peers)
+}
+
+func TestGossipMessageSignedByOrigin(t *testing.T) {
+	alice := newTestGossip("alice")
+	message := alice.Broadcast("SAY", "#general", "hello everybody")
+
+	// a relay decrements the ttl, the signature still holds
+	message.TTL--
+	received, ok := parseGossipMessage(message.String())
+	if !ok || !received.Verify("SAY") {
+		t.Fatalf("the message of alice is refused : %q", message.String())
+	}
+	if !received.Key.Equal(alice.stack.LocalKey()) || received.Text != "hello everybody" || received.Room != "#general" {
+		t.Fatalf("unexpected message %+v", received)
+	}
+	if received.Verify("SAYTO") {
+		t.Error("a SAY is accepted as a SAYTO")
+	}
+
+	// a relay can't change the text, nor claim the message as its own
+	forged := received
+	forged.Text = "hello from alice, really"
+	if forged.Verify("SAY") {
+		t.Error("a changed text is accepted")
+	}
+	mallory := newTestGossip("mallory")
+	forged = received
+	forged.Key = mallory.stack.LocalKey()
+	if forged.Verify("SAY") {
+		t.Error("a changed origin is accepted")
+	}
+}
+
+func TestLegacySayIsNotGossip(t *testing.T) {
+	// the first versions send the text alone, it is read as a message of the peer which sent it
+	for _, data := range []string{"hello", "hello old peers, how are you doing today ?", ""} {
+		if message, ok := parseGossipMessage(data); ok {
+			t.Errorf("%q parsed as a gossip message %+v", data, message)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package chat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teanan/GOssip-TP/history"
+	"github.com/teanan/GOssip-TP/network"
+)
+
+const (
+	historyLength  = 20  // number of messages shown by /history without argument
+	historyPrivate = "@" // prefix of the private conversations in the history ("@username")
+)
+
+// since formats accepted by /history, parsed in the local timezone
+var sinceLayouts = []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02", "15:04"}
+
+// record saves a message in the history
+func record(store *history.Store, id string, t time.Time, conversation string, origin string, text string) {
+	_, err := store.Append(history.Entry{
+		ID:           id,
+		Time:         t,
+		Conversation: conversation,
+		Origin:       origin,
+		Text:         text,
+	})
+	if err != nil {
+		fmt.Println("Failed to save message in history", err)
+	}
+}
+
+// recordMessage saves a message of a room in the history
+func recordMessage(store *history.Store, message gossipMessage) {
+	if _, err := store.Append(messageEntry(message)); err != nil {
+		fmt.Println("Failed to save message in history", err)
+	}
+}
+
+// messageEntry returns the history entry of a message of a room, with the key and the signature of its origin
+func messageEntry(message gossipMessage) history.Entry {
+	return history.Entry{
+		ID:           message.ID,
+		Time:         message.Time,
+		Conversation: message.Room,
+		Origin:       message.Origin,
+		Text:         message.Text,
+		Key:          network.EncodePublicKey(message.Key),
+		Signature:    message.Signature,
+	}
+}
+
+// entryMessage returns the SAY message saved in a history entry, to check its signature
+// Origin is left empty, it is the name of the owner of the key
+func entryMessage(entry history.Entry) (gossipMessage, bool) {
+	if entry.Signature == "" {
+		return gossipMessage{}, false
+	}
+	key, err := network.DecodePublicKey(entry.Key)
+	if err != nil {
+		return gossipMessage{}, false
+	}
+	return gossipMessage{
+		ID:        entry.ID,
+		Key:       key,
+		Time:      time.UnixMilli(entry.Time.UnixMilli()),
+		Room:      entry.Conversation,
+		Signature: entry.Signature,
+		Text:      entry.Text,
+	}, true
+}
+
+// formatEntry returns the line displayed for a message of the history, like the live message with its time
+func formatEntry(entry history.Entry) string {
+	at := "[" + entry.Time.Local().Format("01-02 15:04") + "] "
+
+	if strings.HasPrefix(entry.Conversation, historyPrivate) {
+		with := strings.TrimPrefix(entry.Conversation, historyPrivate)
+		if entry.Origin == with {
+			return privatePrefix + at + "[" + with + "] " + entry.Text
+		}
+		return privatePrefix + at + "[" + entry.Origin + " -> " + with + "] " + entry.Text
+	}
+
+	if strings.HasPrefix(entry.Text, actionPrefix) {
+		return at + entry.Conversation + " * " + entry.Origin + " " + strings.TrimPrefix(entry.Text, actionPrefix)
+	}
+	return at + entry.Conversation + " [" + entry.Origin + "] " + entry.Text
+}
+
+// ReplayHistory returns the lines of the last n messages of every conversation, shown at startup
+// they are printed by the owner of the output, whose queue can't hold that many lines
+func (processor *CommandProcessor) ReplayHistory(n int) []string {
+	entries, err := processor.history.Last("", n)
+	if err != nil {
+		return []string{fmt.Sprint("Failed to read history : ", err)}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	lines := []string{"--- history ---"}
+	for _, entry := range entries {
+		lines = append(lines, formatEntry(entry))
+	}
+	return append(lines, "---")
+}
+
+// HistoryLines returns the lines of the history shown by the last command, and forgets them
+// like the replayed history, they are printed by the owner of the output
+func (processor *CommandProcessor) HistoryLines() []string {
+	lines := processor.historyLines
+	processor.historyLines = nil
+	return lines
+}
+
+// showHistory shows the history of a conversation (the current room by default), see HistoryLines
+// params is "[#room|@username] [n|since]", since is a duration ("2h") or a date ("2006-01-02", "15:04", ...)
+func (processor *CommandProcessor) showHistory(params string) {
+	conversation := processor.currentRoom
+	fields := strings.Fields(params)
+	if len(fields) > 0 && (strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], historyPrivate)) {
+		conversation, fields = fields[0], fields[1:]
+	}
+	if conversation == "" {
+		processor.messageOutput <- "You are not in any room, use /history #room"
+		return
+	}
+
+	var (
+		entries []history.Entry
+		err     error
+	)
+	arg := strings.Join(fields, " ")
+	if arg == "" {
+		entries, err = processor.history.Last(conversation, historyLength)
+	} else if n, convErr := strconv.Atoi(arg); convErr == nil && n > 0 {
+		entries, err = processor.history.Last(conversation, n)
+	} else if since, ok := parseSince(arg); ok {
+		entries, err = processor.history.Since(conversation, since)
+	} else {
+		processor.usage("history")
+		return
+	}
+
+	if err != nil {
+		processor.messageOutput <- fmt.Sprint("Failed to read history : ", err)
+		return
+	}
+	if len(entries) == 0 {
+		processor.messageOutput <- "No messages in the history of " + conversation
+		return
+	}
+
+	for _, entry := range entries {
+		processor.historyLines = append(processor.historyLines, formatEntry(entry))
+	}
+}
+
+// parseSince reads the start of a /history request, a duration before now or a date
+func parseSince(text string) (time.Time, bool) {
+	if duration, err := time.ParseDuration(text); err == nil && duration > 0 {
+		return time.Now().Add(-duration), true
+	}
+
+	now := time.Now()
+	for _, layout := range sinceLayouts {
+		t, err := time.ParseInLocation(layout, text, time.Local)
+		if err != nil {
+			continue
+		}
+		// a time without date is today
+		if layout == "15:04" {
+			t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, time.Local)
+		}
+		return t, true
+	}
+
+	return time.Time{}, false
+}
@@ -0,0 +1,326 @@
+package chat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teanan/GOssip-TP/history"
+	"github.com/teanan/GOssip-TP/network"
+)
+
+// History synchronization (anti-entropy) between two peers, for each room they share :
+//
+//	SYNC <room> <bucket>:<hash> ...     summary of our history : the hash of the message IDs of each hour
+//	SYNCIDS <room> <bucket> <id> ...    answer for each bucket whose hash differs : the IDs we have in this bucket
+//	SYNCGET <room> <id> ...             request of the messages we are missing
+//	HISTORY <json entries>              messages the other peer is missing, or that it requested
+//
+// Only the last syncWindow of the rooms is synchronized. Private messages are not, as we only keep them decrypted.
+const (
+	syncWindow       = 7 * 24 * time.Hour // how far back the history is synchronized
+	syncBucket       = time.Hour          // messages are summarized by period of syncBucket
+	syncHashBytes    = 8
+	historyChunkSize = 64 * 1024 // maximum size of the entries sent in a single HISTORY message
+)
+
+// SyncHistory sends the summary of the history of our rooms to a newly connected peer
+// the peer answers with the IDs of the periods where our histories differ
+func (receiver *MessageReceiver) SyncHistory(peer network.Peer) {
+	for _, room := range receiver.peers.GetLocalRooms() {
+		buckets, err := receiver.historyBuckets(room)
+		if err != nil {
+			fmt.Println("Failed to read history of", room, err)
+			continue
+		}
+
+		summary := []string{room}
+		for _, bucket := range sortedBuckets(buckets) {
+			summary = append(summary, strconv.FormatInt(bucket, 10)+":"+hashIDs(buckets[bucket]))
+		}
+
+		receiver.peers.SendTo(peer, network.Message{
+			Kind: "SYNC",
+			Data: strings.Join(summary, " "),
+		})
+	}
+}
+
+// handleSync compares the summary of a peer with ours, and sends our IDs for every period which differs
+func (receiver *MessageReceiver) handleSync(data string, from network.Peer) {
+	fields := strings.Fields(data)
+	if len(fields) < 1 || !receiver.peers.InLocalRoom(fields[0]) {
+		return
+	}
+	room := fields[0]
+
+	buckets, err := receiver.historyBuckets(room)
+	if err != nil {
+		fmt.Println("Failed to read history of", room, err)
+		return
+	}
+
+	theirs := make(map[int64]string)
+	for _, field := range fields[1:] {
+		parts := strings.SplitN(field, ":", 2)
+		bucket, err := strconv.ParseInt(parts[0], 10, 64)
+		if len(parts) != 2 || err != nil {
+			fmt.Println("Invalid SYNC message", data)
+			return
+		}
+		theirs[bucket] = parts[1]
+		if _, found := buckets[bucket]; !found {
+			buckets[bucket] = []string{}
+		}
+	}
+
+	for _, bucket := range sortedBuckets(buckets) {
+		if hashIDs(buckets[bucket]) == theirs[bucket] {
+			continue
+		}
+		receiver.peers.SendTo(from, network.Message{
+			Kind: "SYNCIDS",
+			Data: strings.Join(append([]string{room, strconv.FormatInt(bucket, 10)}, buckets[bucket]...), " "),
+		})
+	}
+}
+
+// handleSyncIDs compares the IDs of a period with ours
+// we request the messages we are missing, and send the ones the peer is missing
+func (receiver *MessageReceiver) handleSyncIDs(data string, from network.Peer) {
+	fields := strings.Fields(data)
+	if len(fields) < 2 || !receiver.peers.InLocalRoom(fields[0]) {
+		return
+	}
+	room := fields[0]
+
+	bucket, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		fmt.Println("Invalid SYNCIDS message", data)
+		return
+	}
+
+	theirs := make(map[string]bool)
+	for _, id := range fields[2:] {
+		theirs[id] = true
+	}
+
+	entries, err := receiver.recentHistory(room)
+	if err != nil {
+		fmt.Println("Failed to read history of", room, err)
+		return
+	}
+
+	ours := make(map[string]bool)
+	missing := make([]history.Entry, 0)
+	for _, entry := range entries {
+		if entryBucket(entry) != bucket {
+			continue
+		}
+		ours[entry.ID] = true
+		if !theirs[entry.ID] {
+			missing = append(missing, entry)
+		}
+	}
+
+	wanted := []string{room}
+	for id := range theirs {
+		if !ours[id] {
+			wanted = append(wanted, id)
+		}
+	}
+
+	if len(wanted) > 1 {
+		receiver.peers.SendTo(from, network.Message{
+			Kind: "SYNCGET",
+			Data: strings.Join(wanted, " "),
+		})
+	}
+	receiver.sendHistory(from, missing)
+}
+
+// handleSyncGet sends the requested messages of a room
+func (receiver *MessageReceiver) handleSyncGet(data string, from network.Peer) {
+	fields := strings.Fields(data)
+	if len(fields) < 2 || !receiver.peers.InLocalRoom(fields[0]) {
+		return
+	}
+
+	wanted := make(map[string]bool)
+	for _, id := range fields[1:] {
+		wanted[id] = true
+	}
+
+	entries, err := receiver.recentHistory(fields[0])
+	if err != nil {
+		fmt.Println("Failed to read history of", fields[0], err)
+		return
+	}
+
+	found := make([]history.Entry, 0)
+	for _, entry := range entries {
+		if wanted[entry.ID] {
+			found = append(found, entry)
+		}
+	}
+	receiver.sendHistory(from, found)
+}
+
+// handleHistory saves the messages sent by a peer during a synchronization, and displays the ones we didn't have
+func (receiver *MessageReceiver) handleHistory(data string, from network.Peer) {
+	var entries []history.Entry
+	if err := json.Unmarshal([]byte(data), &entries); err != nil {
+		fmt.Println("Invalid HISTORY message", err)
+		return
+	}
+
+	missed := make([]history.Entry, 0)
+	for _, entry := range entries {
+		if entry.ID == "" || strings.ContainsAny(entry.ID, " \t") || !receiver.peers.InLocalRoom(entry.Conversation) {
+			continue
+		}
+
+		// like a SAY, an entry must be signed by its origin, or a peer could change the messages of others
+		entry, ok := receiver.verifiedEntry(entry)
+		if !ok {
+			fmt.Println("Invalid signature of history entry sent by", from)
+			continue
+		}
+
+		added, err := receiver.history.Append(entry)
+		if err != nil {
+			fmt.Println("Failed to save message in history", err)
+			continue
+		}
+		if added {
+			// a late copy of this message relayed by the gossip will be dropped
+			receiver.gossip.seen.Add(entry.ID)
+			missed = append(missed, entry)
+		}
+	}
+
+	if len(missed) == 0 {
+		return
+	}
+
+	sort.SliceStable(missed, func(i, j int) bool {
+		return missed[i].Time.Before(missed[j].Time)
+	})
+
+	receiver.messageOutput <- fmt.Sprint("--- ", len(missed), " missed messages from ", from, " ---")
+	for _, entry := range missed {
+		if key, err := network.DecodePublicKey(entry.Key); err == nil && receiver.peers.IsIgnored(key) {
+			continue
+		}
+		receiver.messageOutput <- formatEntry(entry)
+	}
+	receiver.messageOutput <- "---"
+}
+
+// verifiedEntry checks the signature of an entry sent by a peer
+// it returns the entry with the signed time, and the name of the owner of its key as origin
+func (receiver *MessageReceiver) verifiedEntry(entry history.Entry) (history.Entry, bool) {
+	message, ok := entryMessage(entry)
+	if !ok || !message.Verify("SAY") {
+		return entry, false
+	}
+	entry.Time = message.Time
+	entry.Origin = receiver.originName(message.Key)
+	return entry, true
+}
+
+// sendHistory sends entries to a peer, in HISTORY messages of at most historyChunkSize
+func (receiver *MessageReceiver) sendHistory(to network.Peer, entries []history.Entry) {
+	chunk := make([]history.Entry, 0)
+	size := 0
+
+	flush := func() {
+		if len(chunk) == 0 {
+			return
+		}
+		raw, err := json.Marshal(chunk)
+		if err != nil {
+			fmt.Println("Failed to encode history", err)
+			return
+		}
+		receiver.peers.SendTo(to, network.Message{
+			Kind: "HISTORY",
+			Data: string(raw),
+		})
+		chunk, size = chunk[:0], 0
+	}
+
+	for _, entry := range entries {
+		entrySize := len(entry.Text) + len(entry.Origin) + len(entry.Conversation) + len(entry.Key) + len(entry.Signature) + 100
+		if size+entrySize > historyChunkSize {
+			flush()
+		}
+		chunk = append(chunk, entry)
+		size += entrySize
+	}
+	flush()
+}
+
+// recentHistory returns the signed messages of room in the synchronization window
+// the other ones (sent by the first versions) would be refused by the peers
+func (receiver *MessageReceiver) recentHistory(room string) ([]history.Entry, error) {
+	entries, err := receiver.history.Since(room, time.Now().Add(-syncWindow))
+	if err != nil {
+		return nil, err
+	}
+
+	signed := entries[:0]
+	for _, entry := range entries {
+		if entry.Signature != "" {
+			signed = append(signed, entry)
+		}
+	}
+	return signed, nil
+}
+
+// historyBuckets returns the sorted IDs of the recent messages of room, by period
+func (receiver *MessageReceiver) historyBuckets(room string) (map[int64][]string, error) {
+	entries, err := receiver.recentHistory(room)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make(map[int64][]string)
+	for _, entry := range entries {
+		bucket := entryBucket(entry)
+		buckets[bucket] = append(buckets[bucket], entry.ID)
+	}
+	for _, ids := range buckets {
+		sort.Strings(ids)
+	}
+	return buckets, nil
+}
+
+func entryBucket(entry history.Entry) int64 {
+	return entry.Time.Unix() / int64(syncBucket/time.Second)
+}
+
+func sortedBuckets(buckets map[int64][]string) []int64 {
+	sorted := make([]int64, 0, len(buckets))
+	for bucket := range buckets {
+		sorted = append(sorted, bucket)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	return sorted
+}
+
+// hashIDs returns the hash of a sorted list of IDs, or "-" if it is empty
+func hashIDs(ids []string) string {
+	if len(ids) == 0 {
+		return "-"
+	}
+	hash := sha256.Sum256([]byte(strings.Join(ids, " ")))
+	return hex.EncodeToString(hash[:syncHashBytes])
+}
@@ -0,0 +1,42 @@
+package chat
+
+import "testing"
+
+func TestHistoryEntrySignedByOrigin(t *testing.T) {
+	alice := newTestGossip("alice")
+	bob := newTestGossip("bob")
+	receiver := NewMessageReceiver(bob.stack, bob.peers, bob, nil, nil)
+
+	entry := messageEntry(alice.Broadcast("SAY", "#general", "hello everybody"))
+	received, ok := receiver.verifiedEntry(entry)
+	if !ok {
+		t.Fatalf("the entry of alice is refused : %+v", entry)
+	}
+	if received.Text != "hello everybody" || !received.Time.Equal(entry.Time) {
+		t.Fatalf("unexpected entry %+v", received)
+	}
+
+	// a peer can't change the message of another under its ID, nor send messages without signature
+	forged := entry
+	forged.Text = "hello from alice, really"
+	if _, ok := receiver.verifiedEntry(forged); ok {
+		t.Error("a changed text is accepted")
+	}
+	forged = entry
+	forged.Conversation = "#other"
+	if _, ok := receiver.verifiedEntry(forged); ok {
+		t.Error("a changed room is accepted")
+	}
+	forged = entry
+	forged.Signature = ""
+	if _, ok := receiver.verifiedEntry(forged); ok {
+		t.Error("an unsigned entry is accepted")
+	}
+
+	// the origin is the owner of the key, whatever the name in the entry
+	forged = entry
+	forged.Origin = "bob"
+	if received, ok := receiver.verifiedEntry(forged); !ok || received.Origin == "bob" {
+		t.Errorf("the entry of alice is shown from %q", received.Origin)
+	}
+}
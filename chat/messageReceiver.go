@@ -1,17 +1,48 @@
 package chat
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/teanan/GOssip-TP/history"
 	"github.com/teanan/GOssip-TP/network"
 )
 
 // MessageReceiver handles incoming messages from other peers
-// it contains a pointer to the common peersMap and a channel to output to the screen
+// it contains the network stack, a pointer to the common PeersMap, the gossip used to relay messages,
+// the history where received messages are saved, a channel to output to the screen
+// and the callback delivering the messages to the program embedding the chat (nil if there is none)
 type MessageReceiver struct {
-	peers         *peersMap
+	stack         *network.Stack
+	peers         *PeersMap
+	gossip        *gossip
+	history       *history.Store
 	messageOutput chan<- string
+	onDelivery    func(Delivery)
+}
+
+// Delivery is a message of another peer delivered to the local client
+// Room is empty for a private message, Origin is the username of the sender
+type Delivery struct {
+	Room   string
+	Origin string
+	Text   string
+	Time   time.Time
+}
+
+// OnDelivery sets the callback called with each message shown to the local client
+// it is called from the goroutine of the connection which received the message, and must not block
+func (receiver *MessageReceiver) OnDelivery(callback func(Delivery)) {
+	receiver.onDelivery = callback
+}
+
+// deliver calls the callback set with OnDelivery, if any
+func (receiver *MessageReceiver) deliver(delivery Delivery) {
+	if receiver.onDelivery != nil {
+		receiver.onDelivery(delivery)
+	}
 }
 
 // Receive handles arriving unsorted messages
@@ -24,6 +55,14 @@ func (receiver *MessageReceiver) Receive(message network.Message, from network.P
 		receiver.handleSayTo(message.Data, from)
 	case "NAME":
 		receiver.handleName(message.Data, from)
+	case "SYNC":
+		receiver.handleSync(message.Data, from)
+	case "SYNCIDS":
+		receiver.handleSyncIDs(message.Data, from)
+	case "SYNCGET":
+		receiver.handleSyncGet(message.Data, from)
+	case "HISTORY":
+		receiver.handleHistory(message.Data, from)
 	default:
 		fmt.Println("Unknown message kind :", message)
 	}
@@ -38,46 +77,169 @@ func (receiver *MessageReceiver) HandleHello(data string, from network.Peer) {
 	})
 }
 
+// HandleConnectionEvent is called when the state of the outgoing connection to a peer, or its liveness, changes
+// the history is synchronized again after a reconnection, to get the messages the peer missed
+func (receiver *MessageReceiver) HandleConnectionEvent(event network.ConnectionEvent) {
+	// events of a connection to a previous peer at the same address are ignored
+	found, peer := receiver.peers.Find(event.Peer.FullAddress())
+	if !found || !peer.PublicKey().Equal(event.Peer.PublicKey()) {
+		return
+	}
+	receiver.peers.SetConnectionState(peer.FullAddress(), event.State, event.Liveness)
+
+	switch {
+	case event.State == network.Reconnecting && peer.ConnectionState() != network.Reconnecting:
+		receiver.messageOutput <- fmt.Sprint("Lost connection to ", peer, ", reconnecting (", event.Err, ")")
+	case event.State == network.Connected && peer.ConnectionState() == network.Reconnecting:
+		receiver.messageOutput <- fmt.Sprint("Reconnected to ", peer)
+		receiver.SyncHistory(peer)
+	case event.Liveness == network.Suspect && peer.Liveness() == network.Alive:
+		receiver.messageOutput <- fmt.Sprint(peer, " is not answering")
+	case event.Liveness == network.Alive && peer.Liveness() == network.Suspect:
+		receiver.messageOutput <- fmt.Sprint(peer, " is answering again")
+	}
+}
+
 // handleSay is called when a message of kind "SAY" is received
-// data is the value of the received message, from is the Peer who sent it
+// data is the value of the received message, from is the Peer who sent it (or relayed it)
 func (receiver *MessageReceiver) handleSay(data string, from network.Peer) {
-	receiver.messageOutput <- fmt.Sprint("[", from, "] ", data)
+	message, ok := parseGossipMessage(data)
+	if !ok {
+		// the first versions send "SAY <text>", without gossip : the text is from the peer itself, in the default room
+		message = gossipMessage{
+			ID:     newMessageID(),
+			Key:    from.PublicKey(),
+			Origin: from.String(),
+			Time:   time.Now(),
+			Room:   defaultRoom,
+			Text:   data,
+		}
+		if receiver.peers.InLocalRoom(message.Room) {
+			receiver.show(message)
+		}
+		return
+	}
+
+	// the origin is the owner of the key which signed the message, whatever the peers which relayed it
+	if !message.Verify("SAY") {
+		fmt.Println("Invalid signature of SAY message relayed by", from)
+		return
+	}
+	message.Origin = receiver.originName(message.Key)
+
+	// messages are only delivered to (and relayed by) the members of the room
+	if !receiver.peers.InLocalRoom(message.Room) {
+		return
+	}
+
+	// already seen messages are dropped, new ones are forwarded to other peers
+	if !receiver.gossip.Relay("SAY", message, from) {
+		return
+	}
+
+	receiver.show(message)
 }
 
-// handleSay is called when a message of kind "SAYTO" is received
-// data is the value of the received message, from is the Peer who sent it
+// show saves a message received in a room, and displays it unless its author is ignored
+// (the messages of ignored peers are still relayed)
+func (receiver *MessageReceiver) show(message gossipMessage) {
+	recordMessage(receiver.history, message)
+
+	if receiver.peers.IsIgnored(message.Key) {
+		return
+	}
+	receiver.deliver(Delivery{Room: message.Room, Origin: message.Origin, Text: message.Text, Time: message.Time})
+
+	if strings.HasPrefix(message.Text, actionPrefix) {
+		receiver.messageOutput <- fmt.Sprint(message.Room, " * ", message.Origin, " ", strings.TrimPrefix(message.Text, actionPrefix))
+		return
+	}
+
+	receiver.messageOutput <- fmt.Sprint(message.Room, " [", message.Origin, "] ", message.Text)
+}
+
+// originName returns the name shown for the owner of key : the name of the peer if we know it, the beginning of the key otherwise
+func (receiver *MessageReceiver) originName(key ed25519.PublicKey) string {
+	if found, peer := receiver.peers.FindByKey(key); found {
+		return peer.String()
+	}
+	return "unknown:" + network.EncodePublicKey(key)[:8]
+}
+
+// handleSayTo is called when a message of kind "SAYTO" is received
+// data is the value of the received message, from is the Peer who sent it (or relayed it)
+// the text is "<recipient public key> <sealed message>", we relay it like a SAY and only open it if we are the recipient
 func (receiver *MessageReceiver) handleSayTo(data string, from network.Peer) {
-	// question 5
+	message, ok := parseGossipMessage(data)
+	if !ok {
+		fmt.Println("Invalid SAYTO message", data)
+		return
+	}
+	if !message.Verify("SAYTO") {
+		fmt.Println("Invalid signature of SAYTO message relayed by", from)
+		return
+	}
+
+	if !receiver.gossip.Relay("SAYTO", message, from) {
+		return
+	}
+
+	fields := strings.SplitN(message.Text, " ", 2)
+	if len(fields) != 2 || fields[0] != receiver.stack.LocalPublicKey() {
+		return
+	}
+
+	senderKey, text, err := receiver.stack.Open(fields[1])
+	if err != nil {
+		fmt.Println("Failed to open private message from", receiver.originName(message.Key), err)
+		return
+	}
+
+	if receiver.peers.IsIgnored(senderKey) {
+		return
+	}
+
+	// the sender is identified by the key which signed the sealed message
+	sender := receiver.originName(senderKey)
+
+	record(receiver.history, message.ID, message.Time, historyPrivate+sender, sender, text)
+	receiver.deliver(Delivery{Origin: sender, Text: text, Time: message.Time})
+	receiver.messageOutput <- privatePrefix + "[" + sender + "] " + text
 }
 
-// handleSay is called when a message of kind "NAME" is received
+// handleName is called when a message of kind "NAME" is received
 // data is the value of the received message, from is the Peer who sent it
 func (receiver *MessageReceiver) handleName(data string, from network.Peer) {
-	// Check if the submitted name is valid
-	if strings.ContainsAny(data, "\t\r\n ") {
+	// Check if the submitted name is valid (a peer without directory may not have a name yet)
+	if data == "" || strings.ContainsAny(data, " ") || network.Printable(data) != data {
 		return
 	}
 
-	// Check if the submitted name is different from the previous one
-	if data == from.String() {
+	// the name a peer claims is not vouched for by the directory : it is only used, qualified by the key of the peer,
+	// until the membership tells us its name
+	if from.Name() != "" {
 		return
 	}
+	name := network.ClaimedName(data, from.PublicKey())
 
 	// Check if the submitted name is different from other peers and our own
-	if found, _ := receiver.peers.FindByName(data); found || receiver.peers.GetLocalUsername() == data {
-		receiver.messageOutput <- fmt.Sprint(from.String(), "tried to use an already taken username")
+	if found, _ := receiver.peers.FindByName(name); found || receiver.peers.GetLocalUsername() == name {
+		receiver.messageOutput <- fmt.Sprint(from.String(), " tried to use an already taken username")
 		return
 	}
 
-	receiver.messageOutput <- fmt.Sprint(from.String(), " is now known as ", data)
-	from.SetName(data)
-	receiver.peers.Set(from.FullAddress(), from)
+	receiver.messageOutput <- fmt.Sprint(from.String(), " is now known as ", name)
+	receiver.peers.SetName(from.FullAddress(), name)
 }
 
-// NewMessageReceiver builds a new MessageReceiver with pointer to the common peersMap and channel to output to the screen
-func NewMessageReceiver(peers *peersMap, messageOutput chan<- string) *MessageReceiver {
+// NewMessageReceiver builds a new MessageReceiver with the network stack, pointer to the common PeersMap, the gossip, the history
+// and channel to output to the screen
+func NewMessageReceiver(stack *network.Stack, peers *PeersMap, gossip *gossip, store *history.Store, messageOutput chan<- string) *MessageReceiver {
 	return &MessageReceiver{
+		stack:         stack,
 		peers:         peers,
+		gossip:        gossip,
+		history:       store,
 		messageOutput: messageOutput,
 	}
 }
@@ -1,95 +1,296 @@
 package chat
 
 import (
+	"crypto/ed25519"
+	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/teanan/GOssip-TP/network"
 )
 
-// peersMap is a map of Peers identified by their full address ("a.b.c.d:0000")
-// peersMap.localUsername is used to store the username of the local client
-type peersMap struct {
+// PeersMap is a map of Peers identified by their full address ("a.b.c.d:0000")
+// PeersMap.localUsername is used to store the username of the local client, and localRooms the rooms it joined
+// ignored contains the encoded identity keys of the peers whose messages are hidden
+// it is shared between the main loop and the connections goroutines, so every access is synchronized
+type PeersMap struct {
+	mutex         sync.RWMutex
 	peers         map[string]network.Peer
 	localUsername string
+	localRooms    map[string]bool
+	ignored       map[string]bool
 }
 
 // Get returns the peer identified by its full address ("a.b.c.d:0000")
-func (pmap *peersMap) Get(addr string) network.Peer {
+func (pmap *PeersMap) Get(addr string) network.Peer {
+	pmap.mutex.RLock()
+	defer pmap.mutex.RUnlock()
 	return pmap.peers[addr]
 }
 
 // Set updates the peer identified by its full address ("a.b.c.d:0000")
-func (pmap *peersMap) Set(addr string, peer network.Peer) {
-	// Question 1
+func (pmap *PeersMap) Set(addr string, peer network.Peer) {
+	pmap.mutex.Lock()
+	defer pmap.mutex.Unlock()
+	pmap.peers[addr] = peer
+}
+
+// SetName updates the username of the peer identified by its full address ("a.b.c.d:0000")
+// only the name is changed, so a stale copy of the peer never overwrites newer information
+func (pmap *PeersMap) SetName(addr string, name string) {
+	pmap.mutex.Lock()
+	defer pmap.mutex.Unlock()
+	if peer, found := pmap.peers[addr]; found {
+		peer.SetName(name)
+		pmap.peers[addr] = peer
+	}
+}
+
+// SetConnectionState updates the state of the outgoing connection to the peer identified by its full address, and its liveness
+func (pmap *PeersMap) SetConnectionState(addr string, state network.ConnectionState, liveness network.Liveness) {
+	pmap.mutex.Lock()
+	defer pmap.mutex.Unlock()
+	if peer, found := pmap.peers[addr]; found {
+		peer.SetConnectionState(state)
+		peer.SetLiveness(liveness)
+		pmap.peers[addr] = peer
+	}
 }
 
 // Find looks for a peer identified by its full address ("a.b.c.d:0000")
 // first return parameter is true if we found it, false otherwise
-func (pmap *peersMap) Find(address string) (bool, network.Peer) {
-	// Question 1
-	return false, network.Peer{}
+func (pmap *PeersMap) Find(address string) (bool, network.Peer) {
+	pmap.mutex.RLock()
+	defer pmap.mutex.RUnlock()
+	peer, found := pmap.peers[address]
+	return found, peer
 }
 
 // FindByName looks for a peer identified by its username ("my_user_name")
+// first return parameter is true if we found it, false otherwise (or if several peers have this name)
+func (pmap *PeersMap) FindByName(name string) (bool, network.Peer) {
+	found, match := 0, network.Peer{}
+	for _, peer := range pmap.List() {
+		if peer.Name() == name {
+			found, match = found+1, peer
+		}
+	}
+	if found != 1 {
+		return false, network.Peer{}
+	}
+	return true, match
+}
+
+// FindByKey looks for a peer identified by its identity key
 // first return parameter is true if we found it, false otherwise
-func (pmap *peersMap) FindByName(name string) (bool, network.Peer) {
-	// Question 3
+func (pmap *PeersMap) FindByKey(publicKey ed25519.PublicKey) (bool, network.Peer) {
+	for _, peer := range pmap.List() {
+		if peer.PublicKey().Equal(publicKey) {
+			return true, peer
+		}
+	}
 	return false, network.Peer{}
 }
 
 // SendToAll adds a network.Message to the sending queue of every known peer
-func (pmap *peersMap) SendToAll(msg network.Message) {
-	// Question 1
+func (pmap *PeersMap) SendToAll(msg network.Message) {
+	for _, peer := range pmap.List() {
+		pmap.SendTo(peer, msg)
+	}
 }
 
 // SendToAll adds a network.Message to the sending queue of said peer
-func (pmap *peersMap) SendTo(peer network.Peer, msg network.Message) {
-	peer.Send <- msg
+func (pmap *PeersMap) SendTo(peer network.Peer, msg network.Message) {
+	peer.Enqueue(msg)
+}
+
+// RandomPeers returns at most n known members of room picked at random, except the one with address except
+func (pmap *PeersMap) RandomPeers(n int, except string, room string) []network.Peer {
+	candidates := make([]network.Peer, 0)
+	for _, peer := range pmap.List() {
+		if peer.FullAddress() != except && (room == anyRoom || peer.InRoom(room)) {
+			candidates = append(candidates, peer)
+		}
+	}
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+// List returns a copy of the known peers, so they can be used without holding the lock
+func (pmap *PeersMap) List() []network.Peer {
+	pmap.mutex.RLock()
+	defer pmap.mutex.RUnlock()
+
+	list := make([]network.Peer, 0, len(pmap.peers))
+	for _, peer := range pmap.peers {
+		list = append(list, peer)
+	}
+	return list
+}
+
+// StatusList returns a line for each known peer with its username, rooms and liveness, sorted by username
+// it is the peers list of the webui
+func (pmap *PeersMap) StatusList() []string {
+	peers := pmap.List()
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].String() < peers[j].String()
+	})
+
+	lines := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		lines = append(lines, strings.TrimSpace(peer.String()+" "+strings.Join(peer.Rooms(), " "))+peerStatus(peer))
+	}
+	return lines
 }
 
 // SetNewPeersList updates the known peers map with newly received list from the directory server
 // execute the callbacks onPeerConnected (onPeerDisconnected) when a new peer is connected (disconnected)
-func (pmap *peersMap) SetNewPeersList(newList map[string]string, onPeerConnected func(network.Peer), onPeerDisconnected func(network.Peer)) {
-	// remove peers that are no longer present
-	for addr := range pmap.peers {
-		_, found := newList[addr]
-		if !found {
-			onPeerDisconnected(pmap.peers[addr])
+func (pmap *PeersMap) SetNewPeersList(newList map[string]network.PeerInfo, onPeerConnected func(network.Peer), onPeerDisconnected func(network.Peer)) {
+	pmap.mutex.Lock()
+	disconnected := make([]network.Peer, 0)
+	connected := make([]network.Peer, 0)
+
+	// remove peers that are no longer present, or whose identity key has changed
+	for addr, peer := range pmap.peers {
+		info, found := newList[addr]
+		if !found || !peer.PublicKey().Equal(info.PublicKey) {
+			disconnected = append(disconnected, pmap.peers[addr])
 			delete(pmap.peers, addr)
 		}
 	}
 
 	// add new peers
-	for addr := range newList {
-		_, found := pmap.peers[addr]
+	for addr, info := range newList {
+		peer, found := pmap.peers[addr]
 		if found {
+			// the directory may know a newer username, and the rooms of the peer may have changed
+			if info.Name != addr {
+				peer.SetName(info.Name)
+			}
+			peer.SetRooms(info.Rooms)
+			pmap.peers[addr] = peer
 			continue
 		}
 
 		port, _ := strconv.Atoi(strings.SplitN(addr, ":", 2)[1])
-		peer := network.CreatePeer(
+		peer = network.CreatePeer(
 			strings.SplitN(addr, ":", 2)[0],
 			port,
+			info.PublicKey,
 		)
+		if info.Name != addr {
+			peer.SetName(info.Name)
+		}
+		peer.SetRooms(info.Rooms)
 		pmap.peers[addr] = peer
+		connected = append(connected, peer)
+	}
+	pmap.mutex.Unlock()
+
+	// callbacks are executed without holding the lock, so they can use the PeersMap
+	for _, peer := range disconnected {
+		onPeerDisconnected(peer)
+	}
+	for _, peer := range connected {
 		onPeerConnected(peer)
 	}
 }
 
 // SetLocalUsername set the username of local client
-func (pmap *peersMap) SetLocalUsername(localUsername string) {
+func (pmap *PeersMap) SetLocalUsername(localUsername string) {
+	pmap.mutex.Lock()
+	defer pmap.mutex.Unlock()
 	pmap.localUsername = localUsername
 }
 
 // GetLocalUsername returns the username of local client
-func (pmap *peersMap) GetLocalUsername() string {
+func (pmap *PeersMap) GetLocalUsername() string {
+	pmap.mutex.RLock()
+	defer pmap.mutex.RUnlock()
 	return pmap.localUsername
 }
 
-// NewPeersMap builds a new empty peersMap
-func NewPeersMap() *peersMap {
-	return &peersMap{
-		peers: make(map[string]network.Peer),
+// JoinRoom adds room to the rooms of the local client
+func (pmap *PeersMap) JoinRoom(room string) {
+	pmap.mutex.Lock()
+	defer pmap.mutex.Unlock()
+	pmap.localRooms[room] = true
+}
+
+// PartRoom removes room from the rooms of the local client
+func (pmap *PeersMap) PartRoom(room string) {
+	pmap.mutex.Lock()
+	defer pmap.mutex.Unlock()
+	delete(pmap.localRooms, room)
+}
+
+// InLocalRoom returns true if the local client joined room
+func (pmap *PeersMap) InLocalRoom(room string) bool {
+	pmap.mutex.RLock()
+	defer pmap.mutex.RUnlock()
+	return room == anyRoom || pmap.localRooms[room]
+}
+
+// GetLocalRooms returns the sorted list of the rooms joined by the local client
+func (pmap *PeersMap) GetLocalRooms() []string {
+	pmap.mutex.RLock()
+	defer pmap.mutex.RUnlock()
+
+	rooms := make([]string, 0, len(pmap.localRooms))
+	for room := range pmap.localRooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// RoomMembers returns the known peers who joined room
+func (pmap *PeersMap) RoomMembers(room string) []network.Peer {
+	members := make([]network.Peer, 0)
+	for _, peer := range pmap.List() {
+		if peer.InRoom(room) {
+			members = append(members, peer)
+		}
+	}
+	return members
+}
+
+// ToggleIgnore hides the messages of the peer with this identity key, or shows them again if they were hidden
+// it returns true if the peer is now ignored
+func (pmap *PeersMap) ToggleIgnore(publicKey ed25519.PublicKey) bool {
+	pmap.mutex.Lock()
+	defer pmap.mutex.Unlock()
+
+	key := network.EncodePublicKey(publicKey)
+	if pmap.ignored[key] {
+		delete(pmap.ignored, key)
+		return false
+	}
+	pmap.ignored[key] = true
+	return true
+}
+
+// IsIgnored returns true if the messages of the peer with this identity key are hidden
+func (pmap *PeersMap) IsIgnored(publicKey ed25519.PublicKey) bool {
+	pmap.mutex.RLock()
+	defer pmap.mutex.RUnlock()
+	return pmap.ignored[network.EncodePublicKey(publicKey)]
+}
+
+// NewPeersMap builds a new empty PeersMap
+func NewPeersMap() *PeersMap {
+	return &PeersMap{
+		peers:      make(map[string]network.Peer),
+		localRooms: make(map[string]bool),
+		ignored:    make(map[string]bool),
 	}
 }
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The settings of a binary are its flags, which can also be given by a config file and by environment variables.
+// For each flag, the first value found is used :
+//
+//	the command line                  -history chat-history
+//	the environment                   GOSSIP_HISTORY=chat-history (the prefix, then the flag name in upper case with "_" for "-")
+//	the config file                   {"history": "chat-history"}
+//	the default value of the flag
+//
+// The config file is a JSON object with a key per flag, given by -config (or <prefix>_CONFIG).
+// A list is given by an array, or by a string with the items separated by commas.
+
+// Load parses args into the flags of fs, completed by the environment variables starting with envPrefix
+// and by the config file, it also defines the -config flag
+func Load(fs *flag.FlagSet, args []string, envPrefix string) error {
+	configFile := fs.String("config", "", "JSON file of settings, the keys are the names of the flags (env "+envName(envPrefix, "config")+")")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	// the environment comes before the config file, so it can give the config file too
+	var problems []string
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envName(envPrefix, f.Name)
+		value, found := os.LookupEnv(name)
+		if set[f.Name] || !found {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			problems = append(problems, fmt.Sprintf("$%s : invalid value %q for -%s : %v", name, value, f.Name, err))
+		}
+		set[f.Name] = true
+	})
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+
+	if *configFile == "" {
+		return nil
+	}
+	return loadFile(fs, *configFile, set)
+}
+
+// loadFile sets the flags which are not set yet to the values of the config file
+func loadFile(fs *flag.FlagSet, path string, set map[string]bool) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file %s : %v", path, err)
+	}
+
+	var settings map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&settings); err != nil {
+		return fmt.Errorf("config file %s : not a JSON object : %v", path, err)
+	}
+
+	var problems []string
+	for name, value := range settings {
+		if name == "config" || fs.Lookup(name) == nil {
+			problems = append(problems, fmt.Sprintf("config file %s : unknown setting %q", path, name))
+			continue
+		}
+		if set[name] {
+			continue
+		}
+
+		text, err := settingText(value)
+		if err == nil {
+			err = fs.Set(name, text)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("config file %s : invalid value %v for %q : %v", path, value, name, err))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// settingText returns the value of a setting of the config file as it would be given on the command line
+func settingText(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool, json.Number:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			text, err := settingText(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, text)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", errors.New("expected a string, a number, a boolean or an array")
+	}
+}
+
+// envName returns the environment variable of a flag
+func envName(prefix string, name string) string {
+	return prefix + "_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Validator collects the problems of the settings, so they are all reported at once
+type Validator struct {
+	problems []string
+}
+
+// Check records problem unless ok
+func (v *Validator) Check(ok bool, problem string) {
+	if !ok {
+		v.problems = append(v.problems, problem)
+	}
+}
+
+// Port checks that -name is a TCP/UDP port, 0 is allowed if it means "any port"
+func (v *Validator) Port(name string, port int, allowZero bool) {
+	v.Check(port > 0 && port <= 65535 || allowZero && port == 0,
+		fmt.Sprintf("-%s : %d is not a valid port (1 to 65535)", name, port))
+}
+
+// Address checks that -name is an address "host:port" (the host may be empty to listen on every interface)
+func (v *Validator) Address(name string, address string) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		v.Check(false, fmt.Sprintf("-%s : %q is not an address \"host:port\"", name, address))
+		return
+	}
+	number, err := strconv.Atoi(port)
+	v.Check(err == nil && number > 0 && number <= 65535, fmt.Sprintf("-%s : %q is not a valid port (1 to 65535)", name, port))
+	v.Check(!strings.ContainsAny(host, " \t"), fmt.Sprintf("-%s : %q is not a valid host", name, host))
+}
+
+// Dir checks that -name is an existing directory
+func (v *Validator) Dir(name string, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		v.Check(false, fmt.Sprintf("-%s : %v", name, err))
+		return
+	}
+	v.Check(info.IsDir(), fmt.Sprintf("-%s : %s is not a directory", name, path))
+}
+
+// NotDir checks that -name is a file, or a path where a file can be created
+func (v *Validator) NotDir(name string, path string) {
+	info, err := os.Stat(path)
+	v.Check(err != nil || !info.IsDir(), fmt.Sprintf("-%s : %s is a directory, a file is expected", name, path))
+}
+
+// Err returns an error listing every problem, or nil if there is none
+func (v *Validator) Err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return errors.New("invalid settings :\n  " + strings.Join(v.problems, "\n  "))
+}
@@ -0,0 +1,75 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/bits"
+)
+
+// IDBits is the size of the node IDs and keys of the DHT
+const IDBits = 256
+
+// ID identifies a node (the hash of its identity key) or a key of the DHT (the hash of a username)
+// the distance between two IDs is their XOR
+type ID [IDBits / 8]byte
+
+// NewID returns the ID of data
+func NewID(data []byte) ID {
+	return ID(sha256.Sum256(data))
+}
+
+// nameKey returns the key where the records of a username are stored
+func nameKey(name string) ID {
+	return NewID([]byte("name:" + name))
+}
+
+func (id ID) distance(other ID) ID {
+	var distance ID
+	for i := range id {
+		distance[i] = id[i] ^ other[i]
+	}
+	return distance
+}
+
+// closer returns true if a is closer to id than b
+func (id ID) closer(a ID, b ID) bool {
+	da, db := id.distance(a), id.distance(b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// bucket returns the index of the k-bucket of other in the routing table of id : the length of their common prefix
+// it returns -1 if they are equal
+func (id ID) bucket(other ID) int {
+	distance := id.distance(other)
+	for i, b := range distance {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return -1
+}
+
+// String returns the ID in hexadecimal
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// MarshalText encodes the ID in hexadecimal in the DHT messages
+func (id ID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText decodes an ID encoded by MarshalText
+func (id *ID) UnmarshalText(text []byte) error {
+	raw, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	if len(raw) != len(id) {
+		return errors.New("invalid ID size")
+	}
+	copy(id[:], raw)
+	return nil
+}
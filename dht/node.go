@@ -0,0 +1,581 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Nodes talk with JSON messages over UDP. Every request is answered with the same ID :
+//
+//	PING                    -> PONG
+//	STORE <record>          -> STORED
+//	FIND_NODE <target>      -> NODES <closest contacts>
+//	FIND_VALUE <target>     -> VALUE <records> (or NODES <closest contacts> if we have none)
+//
+// every message tells the ID of its sender, and the answers tell the requester its address as seen by the node
+const (
+	alpha             = 3 // number of nodes queried in parallel during a lookup
+	rpcTimeout        = 1 * time.Second
+	republishInterval = 10 * time.Minute
+	maxDatagram       = 8192
+	maxOwners         = 4    // identities whose records are stored for the same username, the first ones seen are kept
+	maxRecords        = 4096 // records stored by a node, the ones which expire first are dropped for new ones
+)
+
+type message struct {
+	Type     string    `json:"type"`
+	ID       uint64    `json:"id"`
+	Sender   ID        `json:"sender"`
+	Target   *ID       `json:"target,omitempty"`
+	Record   *Record   `json:"record,omitempty"`
+	Records  []Record  `json:"records,omitempty"`
+	Contacts []Contact `json:"contacts,omitempty"`
+	Observed string    `json:"observed,omitempty"`
+}
+
+// Node is the local node of the DHT
+// its ID is the hash of the identity key, and it listens on the UDP port with the same number as the chat port
+// host is our address as seen by the other nodes, learned from their answers, and published in our record
+// bootstrapped is set once we looked up our own ID, to fill the routing table and learn our host
+// knownOwner tells if we know that an identity owns a username (as the directory told us), nil if we don't know any
+type Node struct {
+	self    ID
+	key     ed25519.PrivateKey
+	port    int
+	conn    net.PacketConn
+	table   *routingTable
+	mutex   sync.Mutex
+	records map[ID]map[string]storedRecord // stored records, by key then by owner public key
+	stored  int                            // number of stored records
+	pinned  map[string]ed25519.PublicKey   // identity key first resolved for each username
+	pending map[uint64]chan message        // requests waiting for their answer
+	nextID  uint64
+	host    string
+	name    string    // username published by the local node
+	done    chan bool // closed by Close
+
+	bootstrapped bool
+	knownOwner   func(name string, publicKey ed25519.PublicKey) bool
+}
+
+// storedRecord is a record stored for the other nodes, verified is true if we know that its identity owns the name
+type storedRecord struct {
+	Record
+	verified bool
+}
+
+// NewNode builds the local node on conn, the UDP socket opened on the port with the number of the chat port
+func NewNode(key ed25519.PrivateKey, conn net.PacketConn) (*Node, error) {
+	address, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, errors.New("the DHT needs a UDP socket, not " + conn.LocalAddr().Network())
+	}
+	port := address.Port
+
+	self := NewID(key.Public().(ed25519.PublicKey))
+	return &Node{
+		self:    self,
+		key:     key,
+		port:    port,
+		conn:    conn,
+		table:   &routingTable{self: self},
+		records: make(map[ID]map[string]storedRecord),
+		pinned:  make(map[string]ed25519.PublicKey),
+		pending: make(map[uint64]chan message),
+		done:    make(chan bool),
+	}, nil
+}
+
+// Run answers the other nodes and republishes our record, until ctx is done or Close is called
+func (node *Node) Run(ctx context.Context) {
+	go node.republish()
+	go func() {
+		select {
+		case <-ctx.Done():
+			node.Close()
+		case <-node.done:
+		}
+	}()
+
+	buffer := make([]byte, maxDatagram)
+	for {
+		n, from, err := node.conn.ReadFrom(buffer)
+		if err != nil {
+			select {
+			case <-node.done:
+			default:
+				fmt.Println("Failed to read DHT message", err)
+			}
+			return
+		}
+
+		source, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		var msg message
+		if err := json.Unmarshal(buffer[:n], &msg); err != nil {
+			fmt.Println("Invalid DHT message from", source, err)
+			continue
+		}
+		node.handle(msg, source)
+	}
+}
+
+// AddContact adds a known peer (identified by its identity key and chat address) to the routing table
+// the first contact bootstraps the routing table with a lookup of our own ID
+func (node *Node) AddContact(publicKey ed25519.PublicKey, address string) {
+	node.seen(Contact{ID: NewID(publicKey), Address: address})
+
+	node.mutex.Lock()
+	first := !node.bootstrapped
+	node.bootstrapped = true
+	node.mutex.Unlock()
+
+	if first {
+		go node.lookup(node.self, false)
+	}
+}
+
+// Bootstrap fills the routing table from any node, known by its address only
+func (node *Node) Bootstrap(address string) error {
+	answer, err := node.call(address, message{Type: "PING"})
+	if err != nil {
+		return err
+	}
+	node.seen(Contact{ID: answer.Sender, Address: address})
+
+	node.mutex.Lock()
+	node.bootstrapped = true
+	node.mutex.Unlock()
+
+	node.lookup(node.self, false)
+	return nil
+}
+
+// Publish stores the record of our username (at our chat address) on the nodes closest to it
+// the record is published again every republishInterval, and when our address becomes known
+func (node *Node) Publish(name string) error {
+	node.mutex.Lock()
+	node.name = name
+	host := node.host
+	node.mutex.Unlock()
+
+	if host == "" {
+		return errors.New("our address is not known yet, the record will be published once another node answered")
+	}
+
+	record := NewRecord(node.key, name, net.JoinHostPort(host, strconv.Itoa(node.port)))
+	node.store(record)
+
+	contacts, _ := node.lookup(nameKey(name), false)
+	for _, contact := range contacts {
+		go node.call(contact.Address, message{Type: "STORE", Record: &record})
+	}
+	return nil
+}
+
+// Lookup returns the valid records of username, stored locally or found on the nodes closest to it
+func (node *Node) Lookup(name string) []Record {
+	key := nameKey(name)
+
+	_, records := node.lookup(key, true)
+	records = append(records, node.localRecords(key)...)
+
+	// a record found both locally and remotely, or on several nodes, is only returned once
+	newest := make(map[string]Record)
+	for _, record := range records {
+		owner := string(record.PublicKey)
+		if record.Name == name && record.Verify() && record.Time >= newest[owner].Time {
+			newest[owner] = record
+		}
+	}
+
+	found := make([]Record, 0, len(newest))
+	for _, record := range newest {
+		found = append(found, record)
+	}
+	return found
+}
+
+// Resolve returns the identity key and chat address of username
+// anybody can publish a record for any name, so the timestamps of the records can't settle a contested name :
+// the first identity resolved for a name is kept for the next lookups (like the host keys of SSH),
+// and a name claimed by several identities is not resolved the first time
+func (node *Node) Resolve(name string) (ed25519.PublicKey, string, error) {
+	records := node.Lookup(name)
+
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	if pinned, found := node.pinned[name]; found {
+		for _, record := range records {
+			if record.PublicKey.Equal(pinned) {
+				return record.PublicKey, record.Address, nil
+			}
+		}
+		return nil, "", errors.New("no record for " + name + " from the identity it had before")
+	}
+
+	if len(records) == 0 {
+		return nil, "", errors.New("no record for " + name)
+	}
+	if len(records) > 1 {
+		return nil, "", fmt.Errorf("%d identities claim the username %s", len(records), name)
+	}
+	node.pinned[name] = records[0].PublicKey
+	return records[0].PublicKey, records[0].Address, nil
+}
+
+// handle answers a request, or gives an answer to the request waiting for it
+func (node *Node) handle(msg message, source *net.UDPAddr) {
+	node.seen(Contact{ID: msg.Sender, Address: source.String()})
+
+	answer := message{ID: msg.ID, Observed: source.IP.String()}
+	switch msg.Type {
+	case "PING":
+		answer.Type = "PONG"
+
+	case "STORE":
+		if msg.Record == nil || !msg.Record.Verify() {
+			fmt.Println("Invalid DHT record from", source)
+			return
+		}
+		if !node.store(*msg.Record) {
+			fmt.Println("Refused DHT record of", msg.Record.Name, "from", source, ": too many identities claim it")
+			return
+		}
+		answer.Type = "STORED"
+
+	case "FIND_NODE", "FIND_VALUE":
+		if msg.Target == nil {
+			return
+		}
+		if msg.Type == "FIND_VALUE" {
+			if records := node.localRecords(*msg.Target); len(records) > 0 {
+				answer.Type = "VALUE"
+				answer.Records = records
+				break
+			}
+		}
+		answer.Type = "NODES"
+		answer.Contacts = node.table.closest(*msg.Target, bucketSize)
+
+	default:
+		node.mutex.Lock()
+		waiting, found := node.pending[msg.ID]
+		delete(node.pending, msg.ID)
+		node.mutex.Unlock()
+
+		if found {
+			waiting <- msg
+		}
+		return
+	}
+
+	node.send(source.String(), answer)
+}
+
+// call sends a request to address and waits for its answer
+func (node *Node) call(address string, request message) (message, error) {
+	waiting := make(chan message, 1)
+
+	node.mutex.Lock()
+	node.nextID++
+	request.ID = node.nextID
+	node.pending[request.ID] = waiting
+	node.mutex.Unlock()
+
+	defer func() {
+		node.mutex.Lock()
+		delete(node.pending, request.ID)
+		node.mutex.Unlock()
+	}()
+
+	if err := node.send(address, request); err != nil {
+		return message{}, err
+	}
+
+	select {
+	case answer := <-waiting:
+		node.observed(answer.Observed)
+		return answer, nil
+	case <-time.After(rpcTimeout):
+		return message{}, errors.New("no answer from " + address)
+	case <-node.done:
+		return message{}, errors.New("the DHT node is closed")
+	}
+}
+
+func (node *Node) send(address string, msg message) error {
+	msg.Sender = node.self
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	destination, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	_, err = node.conn.WriteTo(raw, destination)
+	return err
+}
+
+// seen updates the routing table with a contact which sent us a message
+// if its bucket is full, the least recently seen contact is replaced if it doesn't answer a PING
+func (node *Node) seen(contact Contact) {
+	oldest, full := node.table.update(contact)
+	if !full {
+		return
+	}
+
+	go func() {
+		if _, err := node.call(oldest.Address, message{Type: "PING"}); err != nil {
+			node.table.replace(oldest, contact)
+		}
+	}()
+}
+
+// observed learns our host from the address seen by another node, and publishes our record if it was waiting for it
+func (node *Node) observed(host string) {
+	if host == "" {
+		return
+	}
+
+	node.mutex.Lock()
+	learned := node.host == ""
+	if learned {
+		node.host = host
+	}
+	name := node.name
+	node.mutex.Unlock()
+
+	if learned && name != "" {
+		go node.Publish(name)
+	}
+}
+
+// lookup finds the bucketSize nodes closest to target, by querying the closest known nodes iteratively
+// with findValue, it stops as soon as nodes return records for target
+func (node *Node) lookup(target ID, findValue bool) ([]Contact, []Record) {
+	request := message{Type: "FIND_NODE", Target: &target}
+	if findValue {
+		request.Type = "FIND_VALUE"
+	}
+
+	shortlist := node.table.closest(target, bucketSize)
+	queried := make(map[ID]bool)
+	records := make([]Record, 0)
+
+	for {
+		// the alpha closest nodes not queried yet
+		batch := make([]Contact, 0, alpha)
+		for _, contact := range shortlist {
+			if !queried[contact.ID] && len(batch) < alpha {
+				batch = append(batch, contact)
+				queried[contact.ID] = true
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		answers := make(chan message, len(batch))
+		var wait sync.WaitGroup
+		for _, contact := range batch {
+			wait.Add(1)
+			go func(contact Contact) {
+				defer wait.Done()
+				if answer, err := node.call(contact.Address, request); err == nil {
+					answers <- answer
+				}
+			}(contact)
+		}
+		wait.Wait()
+		close(answers)
+
+		known := make(map[ID]bool)
+		for _, contact := range shortlist {
+			known[contact.ID] = true
+		}
+		for answer := range answers {
+			records = append(records, answer.Records...)
+			for _, contact := range answer.Contacts {
+				if contact.ID != node.self && !known[contact.ID] {
+					known[contact.ID] = true
+					shortlist = append(shortlist, contact)
+				}
+			}
+		}
+
+		if findValue && len(records) > 0 {
+			break
+		}
+
+		sortByDistance(shortlist, target)
+		if len(shortlist) > bucketSize {
+			shortlist = shortlist[:bucketSize]
+		}
+	}
+
+	return shortlist, records
+}
+
+// UseOwnerCheck sets how we know that an identity owns a username, the records of known owners are kept first
+// it is called with the lock of the node held, it must not call the node
+func (node *Node) UseOwnerCheck(knownOwner func(name string, publicKey ed25519.PublicKey) bool) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.knownOwner = knownOwner
+}
+
+// store keeps a valid record, unless we have a newer one from the same owner
+// the records of maxOwners identities are kept for a username, the first ones seen, but the record of a known owner
+// replaces the one of an unknown identity, so a squatter can't keep the owner of a name out
+// when maxRecords are stored, the expired records are dropped, then the record which expires first (of an unknown owner if possible)
+// it returns false if the record is refused
+func (node *Node) store(record Record) bool {
+	key := nameKey(record.Name)
+	owner := string(record.PublicKey)
+
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	if known, found := node.records[key][owner]; found {
+		if known.Time < record.Time {
+			node.records[key][owner] = storedRecord{Record: record, verified: known.verified}
+		}
+		return true
+	}
+
+	verified := node.knownOwner != nil && node.knownOwner(record.Name, record.PublicKey)
+	node.dropExpired(key)
+	if len(node.records[key]) >= maxOwners {
+		_, other, found := node.firstToDrop([]ID{key}, false)
+		if !verified || !found {
+			return false
+		}
+		node.remove(key, other)
+	}
+
+	if node.stored >= maxRecords {
+		keys := make([]ID, 0, len(node.records))
+		for other := range node.records {
+			node.dropExpired(other)
+			keys = append(keys, other)
+		}
+		if node.stored >= maxRecords {
+			// a record of a known owner is only dropped for another one
+			otherKey, other, found := node.firstToDrop(keys, verified)
+			if !found {
+				return false
+			}
+			node.remove(otherKey, other)
+		}
+	}
+
+	if node.records[key] == nil {
+		node.records[key] = make(map[string]storedRecord)
+	}
+	node.records[key][owner] = storedRecord{Record: record, verified: verified}
+	node.stored++
+	return true
+}
+
+// firstToDrop returns the record of keys dropped first for a new one : of an unknown owner before a known one,
+// then the one which expires first ; the records of known owners are only considered if withKnown is true
+func (node *Node) firstToDrop(keys []ID, withKnown bool) (key ID, owner string, found bool) {
+	var first storedRecord
+	for _, k := range keys {
+		for o, record := range node.records[k] {
+			if record.verified && !withKnown {
+				continue
+			}
+			dropsFirst := !found || first.verified && !record.verified || record.verified == first.verified && record.Time < first.Time
+			if dropsFirst {
+				key, owner, first, found = k, o, record, true
+			}
+		}
+	}
+	return key, owner, found
+}
+
+// dropExpired removes the expired records of key, the lock must be held
+func (node *Node) dropExpired(key ID) {
+	for owner, record := range node.records[key] {
+		if record.expired() {
+			node.remove(key, owner)
+		}
+	}
+}
+
+// remove removes the record of owner for key, the lock must be held
+func (node *Node) remove(key ID, owner string) {
+	if _, found := node.records[key][owner]; !found {
+		return
+	}
+	delete(node.records[key], owner)
+	node.stored--
+	if len(node.records[key]) == 0 {
+		delete(node.records, key)
+	}
+}
+
+// localRecords returns the valid records stored for key
+func (node *Node) localRecords(key ID) []Record {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	node.dropExpired(key)
+	records := make([]Record, 0, len(node.records[key]))
+	for _, record := range node.records[key] {
+		records = append(records, record.Record)
+	}
+	return records
+}
+
+// Close stops the node and closes its UDP socket
+func (node *Node) Close() {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	select {
+	case <-node.done:
+	default:
+		close(node.done)
+		node.conn.Close()
+	}
+}
+
+// republish publishes our record again before it expires
+func (node *Node) republish() {
+	ticker := time.NewTicker(republishInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-node.done:
+			return
+		case <-ticker.C:
+		}
+
+		node.mutex.Lock()
+		name := node.name
+		node.mutex.Unlock()
+
+		if name != "" {
+			if err := node.Publish(name); err != nil {
+				fmt.Println("Failed to publish DHT record", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestNode(t *testing.T) *Node {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key, _ := ed25519.GenerateKey(nil)
+	node, err := NewNode(key, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(node.Close)
+	return node
+}
+
+// testRecord returns a record of name by owner, published age ago (store doesn't check the signature)
+func testRecord(name string, owner byte, age time.Duration) Record {
+	publicKey := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	publicKey[0] = owner
+	return Record{Name: name, Address: "10.0.0.1:9000", PublicKey: publicKey, Time: time.Now().Add(-age).Unix()}
+}
+
+func TestKnownOwnerReplacesSquatters(t *testing.T) {
+	node := newTestNode(t)
+	for owner := byte(1); owner <= maxOwners; owner++ {
+		if !node.store(testRecord("alice", owner, 0)) {
+			t.Fatal("a record is refused before the name is full")
+		}
+	}
+
+	alice := testRecord("alice", 100, 0)
+	if node.store(alice) {
+		t.Fatal("an unknown identity is stored after maxOwners others")
+	}
+
+	// the directory told us that alice owns the name, her record replaces one of the squatters
+	node.UseOwnerCheck(func(name string, publicKey ed25519.PublicKey) bool {
+		return name == "alice" && publicKey.Equal(alice.PublicKey)
+	})
+	if !node.store(alice) {
+		t.Fatal("the record of the known owner is refused")
+	}
+	records := node.localRecords(nameKey("alice"))
+	found := false
+	for _, record := range records {
+		found = found || record.PublicKey.Equal(alice.PublicKey)
+	}
+	if !found || len(records) != maxOwners {
+		t.Fatalf("%d records stored for alice, with hers %v", len(records), found)
+	}
+}
+
+func TestRecordsAreBounded(t *testing.T) {
+	node := newTestNode(t)
+	node.UseOwnerCheck(func(name string, publicKey ed25519.PublicKey) bool {
+		return name == "known"
+	})
+	if !node.store(testRecord("known", 1, 50*time.Minute)) {
+		t.Fatal("the record of a known owner is refused")
+	}
+
+	// a node can't fill the memory of another with many names, the records which expire first are dropped
+	const names = maxRecords + 100
+	for i := 0; i < names; i++ {
+		if !node.store(testRecord("name"+strconv.Itoa(i), 1, time.Duration(names-i)*300*time.Millisecond)) {
+			t.Fatalf("record %d refused", i)
+		}
+	}
+	if node.stored != maxRecords {
+		t.Fatalf("%d records stored, want %d", node.stored, maxRecords)
+	}
+	if len(node.localRecords(nameKey("known"))) != 1 {
+		t.Error("the record of a known owner was dropped for unknown ones")
+	}
+	if len(node.localRecords(nameKey("name0"))) != 0 || len(node.localRecords(nameKey("name"+strconv.Itoa(names-1)))) != 1 {
+		t.Error("the records which expire first were not the ones dropped")
+	}
+}
@@ -0,0 +1,57 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"time"
+)
+
+const (
+	recordContext = "GOssip DHT record " // prefix of the signed content of a record
+	recordTTL     = time.Hour            // a record is dropped if it wasn't published again for recordTTL
+	maxClockSkew  = 5 * time.Minute      // a record published later than now + maxClockSkew is invalid, it would never expire
+)
+
+// Record tells the chat address ("a.b.c.d:0000") of the owner of a username
+// it is signed by the identity key of the owner, so the nodes storing it can't change it
+type Record struct {
+	Name      string            `json:"name"`
+	Address   string            `json:"address"`
+	PublicKey ed25519.PublicKey `json:"publicKey"`
+	Time      int64             `json:"time"` // when it was published, in unix seconds
+	Signature []byte            `json:"signature"`
+}
+
+// NewRecord returns the record of name at address, signed by key
+func NewRecord(key ed25519.PrivateKey, name string, address string) Record {
+	record := Record{
+		Name:      name,
+		Address:   address,
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Time:      time.Now().Unix(),
+	}
+	record.Signature = ed25519.Sign(key, record.signed())
+	return record
+}
+
+// Verify returns true if the record is signed by its public key, not expired, and not published in the future
+func (record Record) Verify() bool {
+	if len(record.PublicKey) != ed25519.PublicKeySize || record.expired() || record.future() {
+		return false
+	}
+	return ed25519.Verify(record.PublicKey, record.signed(), record.Signature)
+}
+
+func (record Record) expired() bool {
+	return time.Since(time.Unix(record.Time, 0)) > recordTTL
+}
+
+func (record Record) future() bool {
+	return time.Until(time.Unix(record.Time, 0)) > maxClockSkew
+}
+
+func (record Record) signed() []byte {
+	signed := []byte(recordContext + record.Name + "\n" + record.Address + "\n")
+	signed = append(signed, record.PublicKey...)
+	return binary.BigEndian.AppendUint64(signed, uint64(record.Time))
+}
@@ -0,0 +1,104 @@
+package dht
+
+import (
+	"sort"
+	"sync"
+)
+
+// bucketSize is the maximum number of contacts of a k-bucket, and the number of nodes storing a record
+const bucketSize = 8
+
+// Contact is a node of the DHT, with its UDP address ("a.b.c.d:0000")
+type Contact struct {
+	ID      ID     `json:"id"`
+	Address string `json:"address"`
+}
+
+// routingTable keeps the known contacts in k-buckets, by length of the common prefix of their ID with ours
+// each bucket is sorted from the least recently seen contact to the most recently seen one
+type routingTable struct {
+	mutex   sync.Mutex
+	self    ID
+	buckets [IDBits][]Contact
+}
+
+// update moves contact at the end of its bucket, or adds it if there is room
+// if the bucket is full, it returns its least recently seen contact, which must be pinged before being replaced
+func (table *routingTable) update(contact Contact) (Contact, bool) {
+	index := table.self.bucket(contact.ID)
+	if index < 0 {
+		return Contact{}, false
+	}
+
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	bucket := table.buckets[index]
+	for i, known := range bucket {
+		if known.ID == contact.ID {
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			table.buckets[index] = append(bucket, contact)
+			return Contact{}, false
+		}
+	}
+
+	if len(bucket) < bucketSize {
+		table.buckets[index] = append(bucket, contact)
+		return Contact{}, false
+	}
+	return bucket[0], true
+}
+
+// replace removes a contact which didn't answer, and adds contact in its place
+func (table *routingTable) replace(old Contact, contact Contact) {
+	index := table.self.bucket(old.ID)
+	if index < 0 {
+		return
+	}
+
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	bucket := table.buckets[index]
+	for i, known := range bucket {
+		if known.ID == old.ID {
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			table.buckets[index] = append(bucket, contact)
+			return
+		}
+	}
+}
+
+// closest returns the n known contacts closest to target
+func (table *routingTable) closest(target ID, n int) []Contact {
+	table.mutex.Lock()
+	contacts := make([]Contact, 0)
+	for _, bucket := range table.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	table.mutex.Unlock()
+
+	sortByDistance(contacts, target)
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+// size returns the number of known contacts
+func (table *routingTable) size() int {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	size := 0
+	for _, bucket := range table.buckets {
+		size += len(bucket)
+	}
+	return size
+}
+
+func sortByDistance(contacts []Contact, target ID) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return target.closer(contacts[i].ID, contacts[j].ID)
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/teanan/GOssip-TP/config"
+	"github.com/teanan/GOssip-TP/directory/server"
+	"github.com/teanan/GOssip-TP/network"
+)
+
+var (
+	listenAddress = flag.String("listen", ":8080", "address on which the clients connect")
+	tlsDir        = flag.String("tls", "", "directory of the keys generated by \"gossip keygen\", enables TLS")
+	useLAN        = flag.Bool("lan", false, "announce the directory on the local network")
+	logLevel      = flag.String("log-level", "info", "messages traced : quiet, info (all but the periodic ones) or debug (all)")
+
+	clusterNodes  = flag.String("cluster", "", "cluster addresses of every directory of the cluster, by priority (\"host:port,host:port\")")
+	nodeAddress   = flag.String("node", "", "cluster address of this directory, it must be in the -cluster list")
+	clusterSecret = flag.String("cluster-secret", "", "secret shared by the directories of the cluster (defaults to $GOSSIP_CLUSTER_SECRET)")
+	advertise     = flag.String("advertise", "", "address of this directory given to the clients (defaults to the host of -node and the port of -listen)")
+
+	adminAddress = flag.String("admin", "", "address of the HTTP admin API (\":8081\"), disabled if empty")
+	adminToken   = flag.String("admin-token", "", "token required by the admin API (defaults to $GOSSIP_ADMIN_TOKEN)")
+
+	bansFile       = flag.String("bans", "directory-bans.json", "file of the banned hosts and identity keys")
+	dataDir        = flag.String("data", "directory-data", "directory where the registry is saved, to recover it after a restart (each directory of a cluster needs its own), disabled if empty")
+	maxPeers       = flag.Int("max-peers", 1000, "maximum number of connected clients, 0 for no limit")
+	connectionRate = flag.Float64("conn-rate", 0.5, "connections per second allowed to each host, 0 for no limit")
+	messageRate    = flag.Float64("msg-rate", 5, "messages per second allowed to each host, 0 for no limit")
+)
+
+func main() {
+	// The settings come from the command line, the environment ($GOSSIP_DIRECTORY_<FLAG>) and the config file (-config)
+	if err := config.Load(flag.CommandLine, os.Args[1:], "GOSSIP_DIRECTORY"); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if *adminToken == "" {
+		*adminToken = os.Getenv("GOSSIP_ADMIN_TOKEN")
+	}
+	if *clusterSecret == "" {
+		*clusterSecret = os.Getenv("GOSSIP_CLUSTER_SECRET")
+	}
+	if err := validateSettings(); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	level, _ := network.ParseLogLevel(*logLevel)
+
+	fmt.Println("GOssip peers directory server")
+	fmt.Println("===")
+
+	var tlsConfig *tls.Config
+	if *tlsDir != "" {
+		var err error
+		if tlsConfig, err = network.ServerTLSConfig(*tlsDir); err != nil {
+			fmt.Println("Failed to load TLS keys", err)
+			return
+		}
+		fmt.Println("TLS enabled")
+	}
+
+	directory, err := server.NewServer(server.Config{
+		ListenAddress:  *listenAddress,
+		TLS:            tlsConfig,
+		Node:           *nodeAddress,
+		Cluster:        clusterList(),
+		ClusterSecret:  *clusterSecret,
+		Advertise:      advertiseAddress(),
+		AdminAddress:   *adminAddress,
+		AdminToken:     *adminToken,
+		BansFile:       *bansFile,
+		DataDir:        *dataDir,
+		MaxPeers:       *maxPeers,
+		ConnectionRate: *connectionRate,
+		MessageRate:    *messageRate,
+		LogLevel:       level,
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// Ctrl+C and SIGTERM close the connections of the clients, they fail over to another directory
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *useLAN {
+		go network.AnnounceDirectory(ctx, listenPort())
+	}
+	if err := directory.Run(ctx); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// validateSettings checks the flags, and returns an error listing every invalid one
+func validateSettings() error {
+	var v config.Validator
+	v.Address("listen", *listenAddress)
+	_, err := network.ParseLogLevel(*logLevel)
+	v.Check(err == nil, "-log-level : "+fmt.Sprint(err))
+	if *tlsDir != "" {
+		v.Dir("tls", *tlsDir)
+	}
+
+	if *adminAddress != "" {
+		v.Address("admin", *adminAddress)
+		v.Check(*adminToken != "", "-admin-token : the admin API needs a token, set -admin-token or $GOSSIP_ADMIN_TOKEN")
+	}
+
+	v.NotDir("bans", *bansFile)
+	v.Check(*maxPeers >= 0, "-max-peers : must be 0 (no limit) or more")
+	v.Check(*connectionRate >= 0, "-conn-rate : must be 0 (no limit) or more")
+	v.Check(*messageRate >= 0, "-msg-rate : must be 0 (no limit) or more")
+
+	if *clusterNodes != "" {
+		for _, node := range clusterList() {
+			v.Address("cluster", node)
+		}
+		v.Address("node", *nodeAddress)
+		if *advertise != "" {
+			v.Address("advertise", *advertise)
+		}
+		v.Check(*clusterSecret != "", "-cluster-secret : the cluster needs a secret, set -cluster-secret or $GOSSIP_CLUSTER_SECRET")
+		v.Check(!strings.ContainsAny(*clusterSecret, " \t"), "-cluster-secret : the cluster secret can't contain spaces")
+	}
+	return v.Err()
+}
+
+// listenPort returns the port of -listen
+func listenPort() int {
+	_, port, _ := net.SplitHostPort(*listenAddress)
+	number, _ := strconv.Atoi(port)
+	return number
+}
+
+// clusterList returns the cluster addresses of -cluster
+func clusterList() []string {
+	nodes := make([]string, 0)
+	for _, node := range strings.Split(*clusterNodes, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// advertiseAddress returns -advertise, or the host of -node and the port of -listen
+func advertiseAddress() string {
+	if *advertise != "" || *nodeAddress == "" {
+		return *advertise
+	}
+	host, _, _ := net.SplitHostPort(*nodeAddress)
+	return net.JoinHostPort(host, strconv.Itoa(listenPort()))
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/teanan/GOssip-TP/network"
+)
+
+// The admin API lets the operators inspect and control the directory over HTTP, every answer is JSON :
+//
+//	GET  /peers                 list the connected clients
+//	POST /peers/<id>/kick       disconnect a client
+//	POST /peers/<id>/ban        ban the host and the identity key of a client, and disconnect it
+//	POST /peers/<id>/rename     force the username of a client, body {"name": "..."}
+//	POST /notice                send a notice to every client, body {"text": "..."}
+//	GET  /bans                  list the banned hosts and identity keys
+//	POST /bans                  ban a host (IP or CIDR range) and/or a key, body {"ip": "...", "key": "..."}
+//	DELETE /bans                remove bans, same body
+//
+// <id> is the address of the connection of the client to the directory ("a.b.c.d:0000"),
+// prefixed by the cluster address of its directory in a cluster ("e.f.g.h:0000/a.b.c.d:0000")
+// the clients of every directory of the cluster are listed, and can be controlled from any of them
+// every request must carry the header "Authorization: Bearer <token>"
+
+// adminPeer is a connected client, as listed by the admin API
+type adminPeer struct {
+	ID             string    `json:"id"`
+	Node           string    `json:"node,omitempty"`
+	Address        string    `json:"address"`
+	Pseudo         string    `json:"pseudo"`
+	ChatAddress    string    `json:"chatAddress"`
+	PublicKey      string    `json:"publicKey"`
+	Rooms          []string  `json:"rooms"`
+	ConnectedSince time.Time `json:"connectedSince"`
+}
+
+func toAdminPeer(peer Peer) adminPeer {
+	return adminPeer{
+		ID:             peer.id,
+		Node:           peer.node,
+		Address:        peer.address,
+		Pseudo:         peer.pseudo,
+		ChatAddress:    peer.chatAddress,
+		PublicKey:      peer.publicKey,
+		Rooms:          peer.sortedRooms(),
+		ConnectedSince: peer.connectedSince,
+	}
+}
+
+// serveAdmin runs the admin API on address until ctx is done, the requests must be authenticated with token
+func (s *Server) serveAdmin(ctx context.Context, address string, token string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/peers", s.adminPeers)
+	mux.HandleFunc("/peers/", s.adminPeerAction)
+	mux.HandleFunc("/notice", s.adminNotice)
+	mux.HandleFunc("/bans", s.adminBans)
+
+	server := &http.Server{Addr: address, Handler: requireToken(token, mux)}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	fmt.Println("Admin API listening on", address)
+	err := server.ListenAndServe()
+	fmt.Println("Admin API stopped", err)
+}
+
+// requireToken rejects the requests which don't carry the bearer token
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminPeers answers GET /peers
+func (s *Server) adminPeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use GET"))
+		return
+	}
+
+	list := make([]adminPeer, 0)
+	for _, peer := range s.registry.Clients() {
+		list = append(list, toAdminPeer(peer))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// adminPeerAction answers POST /peers/<id>/kick|ban|rename
+func (s *Server) adminPeerAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/peers/")
+	slash := strings.LastIndex(path, "/")
+	if slash < 0 {
+		writeError(w, http.StatusNotFound, errors.New("expected /peers/<id>/<action>"))
+		return
+	}
+	id, action := path[:slash], path[slash+1:]
+
+	peer, found := s.registry.Get(id)
+	if !found {
+		writeError(w, http.StatusNotFound, ErrUnknownClient)
+		return
+	}
+
+	switch action {
+	case "kick":
+		if err := s.registry.Kick(id, "you were kicked by the administrator"); err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		fmt.Println("Admin kicked", id)
+
+	case "ban":
+		if err := s.registry.Ban(hostOf(peer.address), peer.publicKey); err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		fmt.Println("Admin banned", id, peer.publicKey)
+
+	case "rename":
+		var body struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Name == "" || strings.ContainsAny(body.Name, " \t\r\n") || network.Printable(body.Name) != body.Name {
+			writeError(w, http.StatusBadRequest, errors.New("expected {\"name\": \"<username without spaces or control characters>\"}"))
+			return
+		}
+		if err := s.registry.ForceRename(id, body.Name); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		fmt.Println("Admin renamed", id, "to", body.Name)
+		peer, _ = s.registry.Get(id)
+
+	default:
+		writeError(w, http.StatusNotFound, errors.New("unknown action "+action))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, toAdminPeer(peer))
+}
+
+// adminNotice answers POST /notice
+func (s *Server) adminNotice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+
+	var body struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.Text) == "" {
+		writeError(w, http.StatusBadRequest, errors.New("expected {\"text\": \"<notice>\"}"))
+		return
+	}
+	text := strings.Join(strings.Fields(body.Text), " ")
+
+	if err := s.registry.Notice(text); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	fmt.Println("Admin notice :", text)
+	writeJSON(w, http.StatusOK, map[string]int{"sent": len(s.registry.Clients())})
+}
+
+// adminBans answers GET, POST and DELETE /bans
+// the clients matching a new ban are disconnected
+func (s *Server) adminBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		ips, keys := s.bans.List()
+		writeJSON(w, http.StatusOK, banFile{IPs: ips, Keys: keys})
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use GET, POST or DELETE"))
+		return
+	}
+
+	var body struct {
+		IP  string `json:"ip"`
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.IP == "" && body.Key == "" {
+		writeError(w, http.StatusBadRequest, errors.New("expected {\"ip\": \"<ip or cidr>\", \"key\": \"<identity key>\"}"))
+		return
+	}
+
+	if err := validBan(body.IP, body.Key); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var err error
+	if r.Method == http.MethodPost {
+		err = s.registry.Ban(body.IP, body.Key)
+	} else {
+		err = s.registry.Unban(body.IP, body.Key)
+	}
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	fmt.Println("Admin", r.Method, "ban", body.IP, body.Key)
+
+	ips, keys := s.bans.List()
+	writeJSON(w, http.StatusOK, banFile{IPs: ips, Keys: keys})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/teanan/GOssip-TP/network"
+)
+
+// BanList holds the banned hosts (single IPs or CIDR ranges) and identity keys
+// it is saved to a JSON file after every change, so the bans survive a restart of the directory
+type BanList struct {
+	mutex  sync.RWMutex
+	path   string
+	ranges map[string]*net.IPNet // by their CIDR notation, a single IP is a /32 (or /128) range
+	keys   map[string]bool
+}
+
+// banFile is the content of the file of a BanList
+type banFile struct {
+	IPs  []string `json:"ips"`
+	Keys []string `json:"keys"`
+}
+
+// LoadBanList reads the ban list saved at path, it is empty if the file does not exist yet
+// with an empty path, the ban list is only kept in memory
+func LoadBanList(path string) (*BanList, error) {
+	bans := &BanList{
+		path:   path,
+		ranges: make(map[string]*net.IPNet),
+		keys:   make(map[string]bool),
+	}
+	if path == "" {
+		return bans, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return bans, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var content banFile
+	if err := json.Unmarshal(raw, &content); err != nil {
+		return nil, err
+	}
+	for _, ip := range content.IPs {
+		ipNet, err := parseRange(ip)
+		if err != nil {
+			return nil, err
+		}
+		bans.ranges[ipNet.String()] = ipNet
+	}
+	for _, key := range content.Keys {
+		bans.keys[key] = true
+	}
+	return bans, nil
+}
+
+// parseRange reads an IP ("a.b.c.d") or a CIDR range ("a.b.c.d/n")
+func parseRange(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("invalid IP " + s)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
+
+// BanHost bans an IP or a CIDR range
+func (bans *BanList) BanHost(s string) error {
+	ipNet, err := parseRange(s)
+	if err != nil {
+		return err
+	}
+
+	bans.mutex.Lock()
+	defer bans.mutex.Unlock()
+	bans.ranges[ipNet.String()] = ipNet
+	return bans.save()
+}
+
+// UnbanHost removes an IP or a CIDR range from the bans
+func (bans *BanList) UnbanHost(s string) error {
+	ipNet, err := parseRange(s)
+	if err != nil {
+		return err
+	}
+
+	bans.mutex.Lock()
+	defer bans.mutex.Unlock()
+	delete(bans.ranges, ipNet.String())
+	return bans.save()
+}
+
+// BanKey bans an identity key
+func (bans *BanList) BanKey(key string) error {
+	if _, err := network.DecodePublicKey(key); err != nil {
+		return err
+	}
+
+	bans.mutex.Lock()
+	defer bans.mutex.Unlock()
+	bans.keys[key] = true
+	return bans.save()
+}
+
+// UnbanKey removes an identity key from the bans
+func (bans *BanList) UnbanKey(key string) error {
+	bans.mutex.Lock()
+	defer bans.mutex.Unlock()
+	delete(bans.keys, key)
+	return bans.save()
+}
+
+// Replace sets the whole ban list, it is used when the registry is replaced by a snapshot
+func (bans *BanList) Replace(ips []string, keys []string) error {
+	ranges := make(map[string]*net.IPNet, len(ips))
+	for _, ip := range ips {
+		ipNet, err := parseRange(ip)
+		if err != nil {
+			return err
+		}
+		ranges[ipNet.String()] = ipNet
+	}
+
+	bans.mutex.Lock()
+	defer bans.mutex.Unlock()
+	bans.ranges = ranges
+	bans.keys = make(map[string]bool, len(keys))
+	for _, key := range keys {
+		bans.keys[key] = true
+	}
+	return bans.save()
+}
+
+// HostBanned returns true if host is in a banned range
+func (bans *BanList) HostBanned(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	bans.mutex.RLock()
+	defer bans.mutex.RUnlock()
+	for _, ipNet := range bans.ranges {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyBanned returns true if the identity key is banned
+func (bans *BanList) KeyBanned(key string) bool {
+	bans.mutex.RLock()
+	defer bans.mutex.RUnlock()
+	return bans.keys[key]
+}
+
+// List returns the banned ranges and keys, sorted
+func (bans *BanList) List() (ips []string, keys []string) {
+	bans.mutex.RLock()
+	defer bans.mutex.RUnlock()
+	return bans.content()
+}
+
+// content returns the sorted banned ranges and keys, the lock must be held
+func (bans *BanList) content() ([]string, []string) {
+	ips := make([]string, 0, len(bans.ranges))
+	for s := range bans.ranges {
+		ips = append(ips, s)
+	}
+	keys := make([]string, 0, len(bans.keys))
+	for key := range bans.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(ips)
+	sort.Strings(keys)
+	return ips, keys
+}
+
+// save writes the ban list to its file, through a temporary file so a crash never leaves it half written
+// the lock must be held
+func (bans *BanList) save() error {
+	if bans.path == "" {
+		return nil
+	}
+	ips, keys := bans.content()
+	raw, err := json.MarshalIndent(banFile{IPs: ips, Keys: keys}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := bans.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, bans.path)
+}
@@ -0,0 +1,634 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teanan/GOssip-TP/network"
+)
+
+// A cluster of directories replicates the registry with a primary/backup log :
+// every directory knows the same ordered list of directories, and the primary is the first one it can hear.
+// The operations of all directories are sent to the primary (PROPOSE), which applies them with a sequence number
+// and answers with the result (RESULT), then sends them to the backups (APPEND), which apply them in the same order.
+// A backup which misses an operation, or which follows a new primary, asks for the whole registry (SYNC, SNAPSHOT),
+// and proposes again the state of its own clients if the snapshot does not match it.
+// The primary removes the clients of the directories which are down, or which restarted.
+//
+// The log is replicated asynchronously : the last operations of a primary which crashes may be lost,
+// and the clients of the remaining directories are then restored from what their own directory knows.
+// Directories which can't hear each other may both act as primary until they can again.
+//
+// The directories talk over plain TCP (or the transport of the server), on the cluster addresses.
+// The secret of the cluster is never sent : both ends of a connection prove they know it with an HMAC
+// of the transcript of the handshake (both nonces and both addresses), see authenticateNode.
+// Every message sent after the handshake carries an HMAC keyed by a session key derived from the handshake,
+// so the operations can't be injected, changed, replayed or dropped on the way (see clusterSession).
+// They are not encrypted : the snapshots show the password hashes to whoever can read the cluster network.
+
+const (
+	clusterHeartbeat = 500 * time.Millisecond // interval between two PING to each directory, and between two checks of the primary
+	nodeTimeout      = 2 * time.Second        // time without any message after which a directory is down
+	proposeTimeout   = 5 * time.Second        // time allowed to the primary to apply an operation
+	clusterQueue     = 4096                   // messages waiting to be sent to a directory, the newest are dropped when it is full
+)
+
+var errClusterUnavailable = errors.New("the directory cluster has no primary, retry later")
+
+// proposal is the content of a PROPOSE message, request is the id of the answer
+type proposal struct {
+	Request uint64    `json:"request"`
+	Op      Operation `json:"op"`
+}
+
+// proposalResult is the content of a RESULT message
+type proposalResult struct {
+	Request uint64 `json:"request"`
+	Seq     uint64 `json:"seq"`
+	Result  string `json:"result"`
+	Error   string `json:"error"`
+}
+
+// Cluster replicates the registry with the other directories
+type Cluster struct {
+	self      string   // cluster address of this directory
+	nodes     []string // cluster addresses of every directory, by priority
+	secret    string
+	advertise string // address of this directory for the chat clients
+	bootTime  int64  // tells the other directories when we restarted
+	registry  *Registry
+	transport network.Transport
+	logLevel  network.LogLevel // messages sent traced on the standard output, none by default
+
+	mutex       sync.Mutex
+	outbound    map[string]chan network.Message // messages to send to each directory
+	lastHeard   map[string]time.Time
+	bootTimes   map[string]int64
+	advertised  map[string]string // address for the chat clients of each directory
+	primary     string
+	synced      bool // our registry follows the log of the primary
+	requests    map[uint64]chan proposalResult
+	nextRequest uint64
+}
+
+// NewCluster builds the cluster of the directories nodes (cluster addresses), self being ours, which talk with transport
+// the operations of registry are then replicated by the cluster
+func NewCluster(self string, nodes []string, secret string, advertise string, registry *Registry, transport network.Transport) (*Cluster, error) {
+	found := false
+	for _, node := range nodes {
+		found = found || node == self
+	}
+	if !found {
+		return nil, errors.New("this directory (" + self + ") is not in the cluster list")
+	}
+
+	c := &Cluster{
+		self:       self,
+		nodes:      nodes,
+		secret:     secret,
+		advertise:  advertise,
+		bootTime:   time.Now().UnixNano(),
+		registry:   registry,
+		transport:  transport,
+		outbound:   make(map[string]chan network.Message),
+		lastHeard:  make(map[string]time.Time),
+		bootTimes:  make(map[string]int64),
+		advertised: map[string]string{self: advertise},
+		requests:   make(map[uint64]chan proposalResult),
+	}
+	for _, node := range nodes {
+		if node != self {
+			c.outbound[node] = make(chan network.Message, clusterQueue)
+		}
+	}
+
+	registry.replicator = c
+	registry.onCommit = c.replicate
+	return c, nil
+}
+
+// Run listens for the other directories, connects to them, and follows the primary, until ctx is done
+func (c *Cluster) Run(ctx context.Context) {
+	_, port, err := net.SplitHostPort(c.self)
+	if err != nil {
+		fmt.Println("Invalid cluster address", c.self, err)
+		return
+	}
+	ln, err := c.transport.Listen(":" + port)
+	if err != nil {
+		fmt.Println("Failed to open cluster listen connection", err)
+		return
+	}
+	defer network.CloseOnDone(ctx, ln)()
+
+	for node, queue := range c.outbound {
+		go c.connectNode(ctx, node, queue)
+	}
+	go c.monitor(ctx)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Println("Failed to accept cluster connection", err)
+			continue
+		}
+		go c.handleNode(ctx, network.NewConn(conn, c.logLevel))
+	}
+}
+
+// Directories returns the addresses for the chat clients of the directories which are up, ours first
+func (c *Cluster) Directories() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	list := []string{c.advertise}
+	for _, node := range c.nodes {
+		if node != c.self && c.alive(node) && c.advertised[node] != "" {
+			list = append(list, c.advertised[node])
+		}
+	}
+	return list
+}
+
+// propose has op applied by the primary, and waits until it is applied by our registry
+func (c *Cluster) propose(op Operation) (string, error) {
+	c.mutex.Lock()
+	primary, synced := c.primary, c.synced
+	if primary == c.self {
+		c.mutex.Unlock()
+		result, _, err := c.registry.commit(op)
+		return result, err
+	}
+	if primary == "" || !synced {
+		c.mutex.Unlock()
+		return "", errClusterUnavailable
+	}
+	c.nextRequest++
+	request := c.nextRequest
+	answer := make(chan proposalResult, 1)
+	c.requests[request] = answer
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.requests, request)
+		c.mutex.Unlock()
+	}()
+
+	c.sendJSON(primary, "PROPOSE", proposal{Request: request, Op: op})
+
+	select {
+	case result := <-answer:
+		if result.Error != "" {
+			return "", remoteError(result.Error)
+		}
+		if !c.registry.waitApplied(result.Seq, proposeTimeout) {
+			fmt.Println("Operation", result.Seq, "was not replicated to this directory yet")
+		}
+		return result.Result, nil
+	case <-time.After(proposeTimeout):
+		return "", errClusterUnavailable
+	}
+}
+
+// remoteError returns the known error with this text, so the callers can compare it
+func remoteError(text string) error {
+	for _, err := range knownErrors {
+		if err.Error() == text {
+			return err
+		}
+	}
+	return errors.New(text)
+}
+
+// replicate sends an operation committed by the primary to every backup, it is called by the registry
+func (c *Cluster) replicate(op Operation) {
+	for node := range c.outbound {
+		c.sendJSON(node, "APPEND", op)
+	}
+}
+
+// monitor checks regularly which directory is the primary, and what it must do :
+// a backup asks for a snapshot until it follows the log of the primary, the primary removes the clients of the directories which are down
+func (c *Cluster) monitor(ctx context.Context) {
+	ticker := time.NewTicker(clusterHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		c.mutex.Lock()
+		primary := c.self
+		for _, node := range c.nodes {
+			if node == c.self || c.alive(node) {
+				primary = node
+				break
+			}
+		}
+		if primary != c.primary {
+			fmt.Println("Primary directory is now", primary)
+			c.primary = primary
+			c.synced = primary == c.self
+		}
+		synced := c.synced
+		down := make(map[string]bool)
+		for _, node := range c.nodes {
+			down[node] = node != c.self && !c.alive(node)
+		}
+		c.mutex.Unlock()
+
+		if primary != c.self {
+			if !synced {
+				c.send(primary, network.Message{Kind: "SYNC"})
+			}
+			continue
+		}
+
+		for node := range c.registry.nodesWithClients() {
+			if down[node] {
+				fmt.Println("Directory", node, "is down, removing its clients")
+				c.registry.commit(Operation{Kind: opNodeDown, Node: node})
+			}
+		}
+	}
+}
+
+// alive returns true if we heard from node recently, the lock must be held
+func (c *Cluster) alive(node string) bool {
+	return time.Since(c.lastHeard[node]) < nodeTimeout
+}
+
+// connectNode keeps a connection to another directory, on which the messages of queue are sent
+func (c *Cluster) connectNode(ctx context.Context, node string, queue chan network.Message) {
+	for ctx.Err() == nil {
+		dialCtx, cancel := context.WithTimeout(ctx, nodeTimeout)
+		tcpConn, err := c.transport.Dial(dialCtx, node)
+		cancel()
+		if err != nil {
+			select {
+			case <-time.After(clusterHeartbeat):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		conn := network.NewConn(tcpConn, c.logLevel)
+
+		session, err := c.authenticateNode(conn, node)
+		if err != nil {
+			fmt.Println("Failed to join directory", node, ":", err)
+			conn.Close()
+			select {
+			case <-time.After(clusterHeartbeat):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		ping := time.NewTicker(clusterHeartbeat)
+		for err == nil {
+			select {
+			case message := <-queue:
+				err = conn.Send(session.seal(message))
+			case <-ping.C:
+				err = conn.Send(session.seal(network.Message{Kind: "PING"}))
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		ping.Stop()
+		conn.Close()
+	}
+}
+
+// authenticateNode runs the handshake of a connection we opened to the directory node :
+//
+//	-> NODE <clusterAddress> <clientAddress> <bootTime> <nonce>
+//	<- CHALLENGE <nonce2> <HMAC of the transcript, as listener>
+//	-> PROOF <HMAC of the transcript, as dialer>
+//
+// nothing else is sent to a directory which doesn't know the secret, the next messages are sealed by the session returned
+func (c *Cluster) authenticateNode(conn *network.Conn, node string) (*clusterSession, error) {
+	nonce := network.NewChallenge()
+	bootTime := strconv.FormatInt(c.bootTime, 10)
+	err := conn.Send(network.Message{Kind: "NODE", Data: c.self + " " + c.advertise + " " + bootTime + " " + nonce})
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(nodeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	message, err := conn.Next()
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(message.Data)
+	if message.Kind != "CHALLENGE" || len(fields) != 2 {
+		return nil, errors.New("unexpected answer " + message.String())
+	}
+	transcript := []string{c.self, node, c.advertise, bootTime, nonce, fields[0]}
+	if !c.validMAC(fields[1], roleClusterListener, transcript...) {
+		return nil, errors.New("the directory doesn't know the cluster secret")
+	}
+	if err := conn.Send(network.Message{Kind: "PROOF", Data: c.mac(roleClusterDialer, transcript...)}); err != nil {
+		return nil, err
+	}
+	return c.newSession(transcript), nil
+}
+
+// acceptNode runs our end of the handshake of a connection opened by another directory (see authenticateNode),
+// it returns the directory, what it told in NODE and the session opening its next messages,
+// session is nil if it is not a directory of the cluster
+func (c *Cluster) acceptNode(conn *network.Conn) (node string, advertise string, bootTime int64, session *clusterSession) {
+	conn.SetReadDeadline(time.Now().Add(nodeTimeout))
+	message, err := conn.Next()
+	if err != nil {
+		return "", "", 0, nil
+	}
+	fields := strings.Fields(message.Data)
+	if message.Kind != "NODE" || len(fields) != 4 {
+		fmt.Println("Refused cluster connection from", conn.RemoteAddr())
+		return "", "", 0, nil
+	}
+	node, advertise = fields[0], fields[1]
+	bootTime, _ = strconv.ParseInt(fields[2], 10, 64)
+	if _, known := c.outbound[node]; !known {
+		fmt.Println("Refused cluster connection from unknown directory", node)
+		return "", "", 0, nil
+	}
+
+	challenge := network.NewChallenge()
+	transcript := []string{node, c.self, advertise, fields[2], fields[3], challenge}
+	if err := conn.Send(network.Message{Kind: "CHALLENGE", Data: challenge + " " + c.mac(roleClusterListener, transcript...)}); err != nil {
+		return "", "", 0, nil
+	}
+
+	message, err = conn.Next()
+	if err != nil {
+		return "", "", 0, nil
+	}
+	if message.Kind != "PROOF" || !c.validMAC(strings.TrimSpace(message.Data), roleClusterDialer, transcript...) {
+		fmt.Println("Refused cluster connection from", node, ": it doesn't know the cluster secret")
+		return "", "", 0, nil
+	}
+	return node, advertise, bootTime, c.newSession(transcript)
+}
+
+// the HMAC of each end of the handshake names its role, so the answer of a directory can't be sent back to it
+// the session key is derived from the same transcript, with a role of its own
+const (
+	roleClusterListener = "cluster-listener"
+	roleClusterDialer   = "cluster-dialer"
+	roleClusterSession  = "cluster-session"
+)
+
+// mac returns the HMAC-SHA256, keyed by the cluster secret, of the transcript of a handshake for role
+func (c *Cluster) mac(role string, transcript ...string) string {
+	return base64.RawURLEncoding.EncodeToString(c.rawMAC(role, transcript...))
+}
+
+func (c *Cluster) rawMAC(role string, transcript ...string) []byte {
+	h := hmac.New(sha256.New, []byte(c.secret))
+	h.Write([]byte("GOssip " + role + " " + strings.Join(transcript, " ")))
+	return h.Sum(nil)
+}
+
+// validMAC returns true if mac is the HMAC of the transcript for role, compared in constant time
+func (c *Cluster) validMAC(mac string, role string, transcript ...string) bool {
+	return subtle.ConstantTimeCompare([]byte(mac), []byte(c.mac(role, transcript...))) == 1
+}
+
+// clusterSession authenticates the messages sent on a cluster connection after its handshake :
+// the data of each message starts with the HMAC-SHA256, keyed by the session key, of its sequence number, kind and data
+// the sequence number is not sent, both ends count the messages, so a message replayed, reordered or dropped is refused
+type clusterSession struct {
+	key []byte
+	seq uint64
+}
+
+// newSession returns the session of the connection whose handshake had transcript
+func (c *Cluster) newSession(transcript []string) *clusterSession {
+	return &clusterSession{key: c.rawMAC(roleClusterSession, transcript...)}
+}
+
+// mac returns the HMAC of the next message
+func (s *clusterSession) mac(message network.Message) string {
+	s.seq++
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(strconv.FormatUint(s.seq, 10) + " " + message.Kind + " " + message.Data))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// seal returns message with its HMAC, to send it
+func (s *clusterSession) seal(message network.Message) network.Message {
+	message.Data = s.mac(message) + " " + message.Data
+	return message
+}
+
+// open returns the message sealed by the other end, ok is false if its HMAC is wrong
+func (s *clusterSession) open(sealed network.Message) (message network.Message, ok bool) {
+	fields := strings.SplitN(sealed.Data, " ", 2)
+	message = network.Message{Kind: sealed.Kind}
+	if len(fields) == 2 {
+		message.Data = fields[1]
+	}
+	return message, subtle.ConstantTimeCompare([]byte(fields[0]), []byte(s.mac(message))) == 1
+}
+
+// handleNode reads the messages sent by another directory, once it proved it knows the cluster secret
+func (c *Cluster) handleNode(ctx context.Context, conn *network.Conn) {
+	defer conn.Close()
+	defer network.CloseOnDone(ctx, conn)()
+
+	node, advertise, bootTime, session := c.acceptNode(conn)
+	if session == nil {
+		return
+	}
+	c.heardFrom(node, advertise, bootTime)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(nodeTimeout))
+		sealed, err := conn.Next()
+		if err != nil {
+			return
+		}
+		message, ok := session.open(sealed)
+		if !ok {
+			fmt.Println("Invalid HMAC of cluster message from", node, ", closing the connection")
+			return
+		}
+		c.heardFrom(node, advertise, bootTime)
+
+		switch message.Kind {
+		case "PING":
+		case "PROPOSE":
+			c.handlePropose(node, message.Data)
+		case "RESULT":
+			c.handleResult(message.Data)
+		case "APPEND":
+			c.handleAppend(node, message.Data)
+		case "SYNC":
+			c.handleSync(node)
+		case "SNAPSHOT":
+			c.handleSnapshot(node, message.Data)
+		default:
+			fmt.Println("Unknown cluster message", message)
+		}
+	}
+}
+
+// heardFrom records that node is alive
+// the primary removes the clients of a directory which restarted, they are not connected anymore,
+// and a backup asks for a snapshot when the primary restarted, since its log starts again from what it recovered
+func (c *Cluster) heardFrom(node string, advertise string, bootTime int64) {
+	c.mutex.Lock()
+	c.lastHeard[node] = time.Now()
+	c.advertised[node] = advertise
+	restarted := c.bootTimes[node] != 0 && c.bootTimes[node] != bootTime
+	c.bootTimes[node] = bootTime
+	primary := c.primary == c.self
+	if restarted && c.primary == node {
+		c.synced = false
+	}
+	c.mutex.Unlock()
+
+	if restarted && primary {
+		fmt.Println("Directory", node, "restarted, removing its previous clients")
+		c.registry.commit(Operation{Kind: opNodeDown, Node: node})
+	}
+}
+
+// handlePropose applies an operation proposed by a backup, if we are the primary
+func (c *Cluster) handlePropose(node string, data string) {
+	var p proposal
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		fmt.Println("Invalid PROPOSE message", err)
+		return
+	}
+
+	c.mutex.Lock()
+	primary := c.primary == c.self
+	c.mutex.Unlock()
+
+	result := proposalResult{Request: p.Request}
+	if !primary {
+		result.Error = errClusterUnavailable.Error()
+	} else if name, seq, err := c.registry.commit(p.Op); err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Result, result.Seq = name, seq
+	}
+	c.sendJSON(node, "RESULT", result)
+}
+
+// handleResult gives the answer of the primary to the proposal waiting for it
+func (c *Cluster) handleResult(data string) {
+	var result proposalResult
+	if err := json.Unmarshal([]byte(data), &result); err != nil {
+		fmt.Println("Invalid RESULT message", err)
+		return
+	}
+
+	c.mutex.Lock()
+	answer, found := c.requests[result.Request]
+	c.mutex.Unlock()
+	if found {
+		answer <- result
+	}
+}
+
+// handleAppend applies an operation of the log of the primary
+func (c *Cluster) handleAppend(node string, data string) {
+	var op Operation
+	if err := json.Unmarshal([]byte(data), &op); err != nil {
+		fmt.Println("Invalid APPEND message", err)
+		return
+	}
+
+	c.mutex.Lock()
+	following := c.primary == node && c.synced
+	c.mutex.Unlock()
+	if !following {
+		return
+	}
+
+	if !c.registry.replay(op) {
+		fmt.Println("Missed operations before", op.Seq, "- asking for a snapshot")
+		c.mutex.Lock()
+		c.synced = false
+		c.mutex.Unlock()
+	}
+}
+
+// handleSync sends the whole registry to a backup, if we are the primary
+func (c *Cluster) handleSync(node string) {
+	c.mutex.Lock()
+	primary := c.primary == c.self
+	c.mutex.Unlock()
+
+	if primary {
+		c.sendJSON(node, "SNAPSHOT", c.registry.snapshot())
+	}
+}
+
+// handleSnapshot replaces our registry by the one of the primary,
+// and proposes again the state of our clients if it does not match
+func (c *Cluster) handleSnapshot(node string, data string) {
+	var s snapshot
+	if err := json.Unmarshal([]byte(data), &s); err != nil {
+		fmt.Println("Invalid SNAPSHOT message", err)
+		return
+	}
+
+	c.mutex.Lock()
+	if c.primary != node || c.synced {
+		c.mutex.Unlock()
+		return
+	}
+	c.synced = true
+	c.mutex.Unlock()
+
+	fmt.Println("Registry synchronized with", node, "at operation", s.Seq)
+	for _, op := range c.registry.install(s) {
+		go func(op Operation) {
+			if _, err := c.propose(op); err != nil {
+				fmt.Println("Failed to restore client", op.ID, err)
+			}
+		}(op)
+	}
+}
+
+// sendJSON queues a message with value encoded in JSON for node
+func (c *Cluster) sendJSON(node string, kind string, value interface{}) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		fmt.Println("Failed to encode", kind, err)
+		return
+	}
+	c.send(node, network.Message{Kind: kind, Data: string(raw)})
+}
+
+// send queues a message for node, it is dropped if the queue is full
+// (the lost operations are noticed by the backup, which asks for a snapshot)
+func (c *Cluster) send(node string, message network.Message) {
+	select {
+	case c.outbound[node] <- message:
+	default:
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/teanan/GOssip-TP/network"
+)
+
+var testNodes = []string{"10.0.0.1:7000", "10.0.0.2:7000"}
+
+// newTestCluster returns the cluster of the directory self of testNodes, with secret
+func newTestCluster(t *testing.T, self string, secret string) *Cluster {
+	registry, _ := newTestRegistry(t)
+	cluster, err := NewCluster(self, testNodes, secret, self, registry, network.TCPTransport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cluster
+}
+
+// handshake runs the NODE handshake from dialer to listener, and returns the sessions of both ends (nil if they refused)
+// the messages sent by the dialer are returned too
+func handshake(t *testing.T, dialer *Cluster, listener *Cluster) (dialed *clusterSession, accepted *clusterSession, sent []string) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// the listener end records what the dialer sends
+	recorded := &recordingConn{Conn: b}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		_, _, _, accepted = listener.acceptNode(network.NewConn(recorded, network.LogQuiet))
+		b.Close()
+	}()
+	dialed, _ = dialer.authenticateNode(network.NewConn(a, network.LogQuiet), listener.self)
+	a.Close()
+	<-done
+	return dialed, accepted, recorded.read
+}
+
+// recordingConn keeps a copy of what is read
+type recordingConn struct {
+	net.Conn
+	read []string
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read = append(c.read, string(b[:n]))
+	return n, err
+}
+
+func TestClusterHandshake(t *testing.T) {
+	dialer := newTestCluster(t, testNodes[0], "s3cret")
+	listener := newTestCluster(t, testNodes[1], "s3cret")
+
+	dialed, accepted, sent := handshake(t, dialer, listener)
+	if dialed == nil || accepted == nil {
+		t.Fatalf("directories of the same cluster refused : dialer %v, listener %v", dialed, accepted)
+	}
+	if strings.Contains(strings.Join(sent, ""), "s3cret") {
+		t.Error("the cluster secret was sent")
+	}
+}
+
+func TestClusterHandshakeWrongSecret(t *testing.T) {
+	// neither end goes on with a directory which doesn't know the secret
+	dialer := newTestCluster(t, testNodes[0], "s3cret")
+	listener := newTestCluster(t, testNodes[1], "other")
+
+	dialed, accepted, _ := handshake(t, dialer, listener)
+	if dialed != nil {
+		t.Error("the dialer accepted a listener without the secret")
+	}
+	if accepted != nil {
+		t.Error("the listener accepted a dialer without the secret")
+	}
+}
+
+func TestClusterHandshakeUnknownDirectory(t *testing.T) {
+	dialer := newTestCluster(t, testNodes[0], "s3cret")
+	dialer.self = "10.0.0.3:7000"
+	listener := newTestCluster(t, testNodes[1], "s3cret")
+
+	if _, accepted, _ := handshake(t, dialer, listener); accepted != nil {
+		t.Error("the listener accepted a directory which is not in the cluster")
+	}
+}
+
+// newTestSessions returns the sessions of both ends of a connection between directories of the same cluster
+func newTestSessions(t *testing.T) (sealer *clusterSession, opener *clusterSession) {
+	dialer := newTestCluster(t, testNodes[0], "s3cret")
+	listener := newTestCluster(t, testNodes[1], "s3cret")
+	sealer, opener, _ = handshake(t, dialer, listener)
+	if sealer == nil || opener == nil {
+		t.Fatal("directories of the same cluster refused")
+	}
+	return sealer, opener
+}
+
+func TestClusterSessionRefusesChangedMessages(t *testing.T) {
+	sealer, opener := newTestSessions(t)
+	append1 := sealer.seal(network.Message{Kind: "APPEND", Data: `{"seq":1}`})
+	if message, ok := opener.open(append1); !ok || message.Data != `{"seq":1}` {
+		t.Fatalf("the message of the dialer is refused : %v", message)
+	}
+	if message, ok := opener.open(sealer.seal(network.Message{Kind: "PING"})); !ok || message.Data != "" {
+		t.Fatalf("the PING of the dialer is refused : %v", message)
+	}
+
+	// an on-path attacker can't replay a message, change it, drop it or send one of another connection
+	if _, ok := opener.open(append1); ok {
+		t.Error("a replayed message is accepted")
+	}
+
+	sealer, opener = newTestSessions(t)
+	changed := sealer.seal(network.Message{Kind: "APPEND", Data: `{"seq":3}`})
+	changed.Data = strings.Replace(changed.Data, "3}", "4}", 1)
+	if _, ok := opener.open(changed); ok {
+		t.Error("a changed message is accepted")
+	}
+
+	sealer, opener = newTestSessions(t)
+	sealer.seal(network.Message{Kind: "APPEND", Data: `{"seq":1}`})
+	if _, ok := opener.open(sealer.seal(network.Message{Kind: "APPEND", Data: `{"seq":2}`})); ok {
+		t.Error("a message is accepted after a dropped one")
+	}
+
+	_, opener = newTestSessions(t)
+	if _, ok := opener.open(append1); ok {
+		t.Error("a message of another connection is accepted")
+	}
+}
+
+func TestNewServerNeedsClusterSecret(t *testing.T) {
+	_, err := NewServer(Config{Node: testNodes[0], Cluster: testNodes})
+	if err == nil {
+		t.Error("a cluster without secret is accepted")
+	}
+}
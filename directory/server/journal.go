@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The journal saves the registry in its data directory, so a directory which restarts (or crashes) recovers
+// the registered usernames, the last username of each identity key, the bans and the guest counter :
+//
+//	snapshot.json   the whole registry after some operation, written through a temporary file
+//	journal.log     every operation applied after the snapshot, one JSON object per line
+//
+// Each operation is appended to the log before its result is given to the client (or replicated to the cluster),
+// and the log is compacted into a new snapshot every snapshotInterval operations.
+// The connected clients are in the journal too, but they are dropped by the recovery : they must connect again.
+
+const (
+	snapshotFile     = "snapshot.json"
+	journalFile      = "journal.log"
+	snapshotInterval = 1000 // operations appended to the log before it is compacted into a new snapshot
+)
+
+// Journal is the write-ahead log and the snapshots of a registry
+type Journal struct {
+	dir     string
+	log     *os.File
+	entries int // operations appended to the log since the last snapshot
+}
+
+// OpenJournal opens (or creates) the journal saved in dir
+func OpenJournal(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Journal{dir: dir}, nil
+}
+
+// load returns the saved snapshot (nil if there is none yet), and the operations of the log which come after it
+// a line which can't be read ends the log : it was being written when the directory crashed
+func (j *Journal) load() (*snapshot, []Operation, error) {
+	var s *snapshot
+	raw, err := os.ReadFile(filepath.Join(j.dir, snapshotFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+	if err == nil {
+		s = &snapshot{}
+		if err := json.Unmarshal(raw, s); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	file, err := os.Open(filepath.Join(j.dir, journalFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	ops := make([]Operation, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var op Operation
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+			fmt.Println("Ignoring the end of the journal, after operation", len(ops), ":", err)
+			break
+		}
+		if s == nil || op.Seq > s.Seq {
+			ops = append(ops, op)
+		}
+	}
+	return s, ops, nil
+}
+
+// append writes an operation at the end of the log, and waits until it is on the disk
+func (j *Journal) append(op Operation) error {
+	if j.log == nil {
+		log, err := os.OpenFile(filepath.Join(j.dir, journalFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		j.log = log
+	}
+
+	raw, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	if _, err := j.log.Write(append(raw, '\n')); err != nil {
+		return err
+	}
+	j.entries++
+	return j.log.Sync()
+}
+
+// full returns true when the log should be compacted into a new snapshot
+func (j *Journal) full() bool {
+	return j.entries >= snapshotInterval
+}
+
+// saveSnapshot writes the whole registry, and empties the log which it replaces
+func (j *Journal) saveSnapshot(s snapshot) error {
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(j.dir, snapshotFile)
+	tmp, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(raw)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the operations of the log are in the snapshot now
+	if j.log != nil {
+		j.log.Close()
+		j.log = nil
+	}
+	j.entries = 0
+	err = os.Truncate(filepath.Join(j.dir, journalFile), 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Recover restores the registry saved in journal, and saves every next operation to it
+// the clients of the saved registry are dropped, only what survives their sessions is kept
+func (r *Registry) Recover(journal *Journal) error {
+	s, ops, err := journal.load()
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if s != nil {
+		r.setState(*s)
+	}
+	for _, op := range ops {
+		r.apply(op)
+		r.seq = op.Seq
+	}
+	r.peers = make(map[string]*Peer)
+	r.pending = nil
+
+	r.journal = journal
+	r.saveSnapshot()
+	fmt.Println("Registry recovered at operation", r.seq, ":", len(r.names), "registered usernames,",
+		len(r.lastNames), "identity keys, guest counter", r.guestNum)
+	return nil
+}
+
+// record appends an applied operation to the journal, which is compacted when it is full
+// the lock must be held
+func (r *Registry) record(op Operation) {
+	if r.journal == nil {
+		return
+	}
+	if err := r.journal.append(op); err != nil {
+		fmt.Println("Failed to write the journal", err)
+	}
+	if r.journal.full() {
+		r.saveSnapshot()
+	}
+}
+
+// saveSnapshot replaces the journal by a snapshot of the registry, the lock must be held
+func (r *Registry) saveSnapshot() {
+	if r.journal == nil {
+		return
+	}
+	if err := r.journal.saveSnapshot(r.state()); err != nil {
+		fmt.Println("Failed to save a snapshot of the registry", err)
+	}
+}
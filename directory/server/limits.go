@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter counts events per host with token buckets :
+// each host may do burst events at once, then rate events per second
+// the buckets of the quiet hosts are forgotten while forgetIdle runs
+type rateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// idleBucket is the time after which a full bucket is forgotten
+const idleBucket = 10 * time.Minute
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	limiter := &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+	return limiter
+}
+
+// Allow returns true if host may do one more event now, and counts it
+// a limiter with a rate of 0 allows everything
+func (limiter *rateLimiter) Allow(host string) bool {
+	if limiter.rate <= 0 {
+		return true
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	b, found := limiter.buckets[host]
+	if !found {
+		b = &bucket{tokens: limiter.burst, last: now}
+		limiter.buckets[host] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * limiter.rate
+	if b.tokens > limiter.burst {
+		b.tokens = limiter.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// forgetIdle removes the buckets of the hosts which have been quiet for a while, so the map does not grow forever,
+// until ctx is done
+func (limiter *rateLimiter) forgetIdle(ctx context.Context) {
+	ticker := time.NewTicker(idleBucket)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		limiter.mutex.Lock()
+		for host, b := range limiter.buckets {
+			if time.Since(b.last) > idleBucket {
+				delete(limiter.buckets, host)
+			}
+		}
+		limiter.mutex.Unlock()
+	}
+}
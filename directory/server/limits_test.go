@@ -0,0 +1,24 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestForgetIdleStopsWithContext(t *testing.T) {
+	limiter := newRateLimiter(1, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan bool)
+	go func() {
+		limiter.forgetIdle(ctx)
+		close(stopped)
+	}()
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("forgetIdle still runs after the server stopped")
+	}
+}
@@ -0,0 +1,423 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kinds of Operation
+const (
+	opConnect    = "connect"    // a client connected to Node from Address, it gets a guest username
+	opDisconnect = "disconnect" // the client ID disconnected
+	opIdentify   = "identify"   // the client ID proved it owns PublicKey, and chats on ChatAddress
+	opRename     = "rename"     // the client ID asked for the username Name
+	opProtect    = "protect"    // the client ID registered its username, with its key or with Salt and PasswordHash
+	opJoin       = "join"       // the client ID joined Room
+	opPart       = "part"       // the client ID left Room
+	opKick       = "kick"       // the client ID must be disconnected, Text is the reason
+	opNotice     = "notice"     // Text must be sent to every client
+	opBan        = "ban"        // Host and/or PublicKey are banned
+	opUnban      = "unban"      // Host and/or PublicKey are not banned anymore
+	opNodeDown   = "nodeDown"   // the directory Node is down, its clients are gone
+	opRestore    = "restore"    // the client ID is set back as it was before a failover of the cluster
+)
+
+// Operation is a change of the registry
+// the primary directory of a cluster gives a sequence number to each operation, and every directory applies them in order,
+// so apply must give the same result everywhere : it only depends on the registry and on the operation
+type Operation struct {
+	Seq  uint64 `json:"seq"`
+	Kind string `json:"kind"`
+
+	ID          string    `json:"id,omitempty"`
+	Node        string    `json:"node,omitempty"`
+	Address     string    `json:"address,omitempty"`
+	ChatAddress string    `json:"chatAddress,omitempty"`
+	PublicKey   string    `json:"publicKey,omitempty"`
+	Name        string    `json:"name,omitempty"`
+	Room        string    `json:"room,omitempty"`
+	Rooms       []string  `json:"rooms,omitempty"`
+	Time        time.Time `json:"time,omitempty"`
+	MaxPeers    int       `json:"maxPeers,omitempty"`
+	Text        string    `json:"text,omitempty"`
+	Host        string    `json:"host,omitempty"`
+
+	Authorized   bool   `json:"authorized,omitempty"` // rename : the password was checked by the directory of the client
+	Force        bool   `json:"force,omitempty"`      // rename : asked by the administrator, registrations are ignored
+	Salt         []byte `json:"salt,omitempty"`
+	PasswordHash []byte `json:"passwordHash,omitempty"`
+	Iterations   int    `json:"iterations,omitempty"` // protect : of the password hash, 0 for the salted SHA-256 of the first versions
+}
+
+// apply changes the registry as told by op, and queues the events for the clients
+// it returns the username of the client for connect and protect
+// an operation which fails changes nothing
+// the lock must be held
+func (r *Registry) apply(op Operation) (string, error) {
+	peer, found := r.peers[op.ID]
+	needsPeer := op.Kind != opConnect && op.Kind != opNotice && op.Kind != opBan && op.Kind != opUnban &&
+		op.Kind != opNodeDown && op.Kind != opRestore
+	if needsPeer && !found {
+		return "", ErrUnknownClient
+	}
+
+	switch op.Kind {
+	case opConnect:
+		if found {
+			return "", errors.New("client " + op.ID + " already connected")
+		}
+		if op.MaxPeers > 0 && len(r.peers) >= op.MaxPeers {
+			return "", ErrFull
+		}
+		r.guestNum++
+		peer = &Peer{
+			id:             op.ID,
+			node:           op.Node,
+			address:        op.Address,
+			pseudo:         guestPrefix + strconv.Itoa(r.guestNum),
+			chatAddress:    "?",
+			rooms:          make(map[string]bool),
+			connectedSince: op.Time,
+		}
+		r.peers[op.ID] = peer
+		return peer.pseudo, nil
+
+	case opDisconnect:
+		delete(r.peers, op.ID)
+		if peer.identified() {
+			r.emit(PeerLeft, peer, "")
+		}
+
+	case opIdentify:
+		peer.chatAddress = op.ChatAddress
+		peer.publicKey = op.PublicKey
+		if strings.HasPrefix(peer.pseudo, guestPrefix) {
+			r.restoreName(peer)
+		}
+		r.lastNames[peer.publicKey] = peer.pseudo
+		r.emit(PeerJoined, peer, "")
+
+	case opRename:
+		if !op.Force && strings.HasPrefix(op.Name, guestPrefix) {
+			return "", ErrNameReserved
+		}
+		if r.nameInUse(op.Name, op.ID) {
+			return "", ErrNameTaken
+		}
+		if owner, registered := r.names[op.Name]; registered && !op.Force && !op.Authorized {
+			if !owner.ownedBy(peer.publicKey) {
+				return "", ErrNameProtected
+			}
+		}
+		peer.pseudo = op.Name
+		if peer.identified() {
+			r.lastNames[peer.publicKey] = peer.pseudo
+		}
+		r.emit(PeerRenamed, peer, "")
+
+	case opProtect:
+		if !peer.identified() {
+			return "", ErrNotIdentified
+		}
+		if strings.HasPrefix(peer.pseudo, guestPrefix) {
+			return "", ErrNameReserved
+		}
+		r.names[peer.pseudo] = nameOwner{publicKey: peer.publicKey, salt: op.Salt, passwordHash: op.PasswordHash, iterations: op.Iterations}
+		return peer.pseudo, nil
+
+	case opJoin, opPart:
+		if peer.rooms[op.Room] == (op.Kind == opJoin) {
+			return "", nil
+		}
+		if op.Kind == opJoin {
+			peer.rooms[op.Room] = true
+		} else {
+			delete(peer.rooms, op.Room)
+		}
+		if peer.identified() {
+			r.emit(PeerRoomsChanged, peer, "")
+		}
+
+	case opKick:
+		r.emit(PeerKicked, peer, op.Text)
+
+	case opNotice:
+		r.emit(Notice, nil, op.Text)
+
+	case opBan:
+		r.applyBan(op)
+
+	case opUnban:
+		if op.Host != "" {
+			r.bans.UnbanHost(op.Host)
+		}
+		if op.PublicKey != "" {
+			r.bans.UnbanKey(op.PublicKey)
+		}
+
+	case opNodeDown:
+		for id, p := range r.peers {
+			if p.node == op.Node {
+				delete(r.peers, id)
+				if p.identified() {
+					r.emit(PeerLeft, p, "")
+				}
+			}
+		}
+
+	case opRestore:
+		r.applyRestore(op, peer)
+
+	default:
+		return "", errors.New("unknown operation " + op.Kind)
+	}
+	return "", nil
+}
+
+// applyBan adds the bans of op, and has the matching clients disconnected
+func (r *Registry) applyBan(op Operation) {
+	if op.Host != "" {
+		if err := r.bans.BanHost(op.Host); err != nil {
+			fmt.Println("Failed to save the ban list", err)
+		}
+	}
+	if op.PublicKey != "" {
+		if err := r.bans.BanKey(op.PublicKey); err != nil {
+			fmt.Println("Failed to save the ban list", err)
+		}
+	}
+
+	for _, p := range r.peers {
+		if r.bans.HostBanned(hostOf(p.address)) || p.publicKey != "" && r.bans.KeyBanned(p.publicKey) {
+			r.emit(PeerBanned, p, "you were banned by the administrator")
+		}
+	}
+}
+
+// applyRestore sets a client back as its directory knew it before a failover of the cluster
+// if another client took its username meanwhile, it gets a new guest username
+func (r *Registry) applyRestore(op Operation, peer *Peer) {
+	if peer == nil {
+		peer = &Peer{id: op.ID}
+		r.peers[op.ID] = peer
+	}
+	peer.node = op.Node
+	peer.address = op.Address
+	peer.chatAddress = op.ChatAddress
+	peer.publicKey = op.PublicKey
+	peer.connectedSince = op.Time
+	peer.rooms = make(map[string]bool)
+	for _, room := range op.Rooms {
+		peer.rooms[room] = true
+	}
+
+	peer.pseudo = op.Name
+	if r.nameInUse(op.Name, op.ID) {
+		r.guestNum++
+		peer.pseudo = guestPrefix + strconv.Itoa(r.guestNum)
+		r.emit(PeerRenamed, peer, "")
+	}
+	if peer.identified() {
+		r.lastNames[peer.publicKey] = peer.pseudo
+		r.emit(PeerJoined, peer, "")
+	}
+}
+
+// restoreName gives back to a newly identified client the username it had in its last session, if it is free,
+// or else a username registered with its identity key
+// a name protected by a password is never restored : the password isn't given, and the lock is held
+func (r *Registry) restoreName(peer *Peer) {
+	if last, found := r.lastNames[peer.publicKey]; found && !r.nameInUse(last, peer.id) {
+		if owner, registered := r.names[last]; !registered || owner.ownedBy(peer.publicKey) {
+			peer.pseudo = last
+			return
+		}
+	}
+
+	// the names are sorted, so every directory restores the same one
+	for _, name := range r.sortedNames() {
+		owner := r.names[name]
+		if owner.ownedBy(peer.publicKey) && !r.nameInUse(name, peer.id) {
+			peer.pseudo = name
+			return
+		}
+	}
+}
+
+// sortedNames returns the registered usernames, sorted, the lock must be held
+func (r *Registry) sortedNames() []string {
+	names := make([]string, 0, len(r.names))
+	for name := range r.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// memberState is a client, as saved in a snapshot of the registry
+type memberState struct {
+	ID             string    `json:"id"`
+	Node           string    `json:"node"`
+	Address        string    `json:"address"`
+	Pseudo         string    `json:"pseudo"`
+	ChatAddress    string    `json:"chatAddress"`
+	PublicKey      string    `json:"publicKey"`
+	Rooms          []string  `json:"rooms"`
+	ConnectedSince time.Time `json:"connectedSince"`
+}
+
+// nameState is a registered username, as saved in a snapshot of the registry
+type nameState struct {
+	PublicKey    string `json:"publicKey"`
+	Salt         []byte `json:"salt,omitempty"`
+	PasswordHash []byte `json:"passwordHash,omitempty"`
+	Iterations   int    `json:"iterations,omitempty"`
+}
+
+// snapshot is the whole state of the registry after the operation Seq
+type snapshot struct {
+	Seq       uint64               `json:"seq"`
+	GuestNum  int                  `json:"guestNum"`
+	Members   []memberState        `json:"members"`
+	Names     map[string]nameState `json:"names"`
+	LastNames map[string]string    `json:"lastNames"` // last username of each identity key
+	Bans      banFile              `json:"bans"`
+}
+
+func stateOf(peer *Peer) memberState {
+	return memberState{
+		ID:             peer.id,
+		Node:           peer.node,
+		Address:        peer.address,
+		Pseudo:         peer.pseudo,
+		ChatAddress:    peer.chatAddress,
+		PublicKey:      peer.publicKey,
+		Rooms:          peer.sortedRooms(),
+		ConnectedSince: peer.connectedSince,
+	}
+}
+
+// snapshot returns the state of the registry
+func (r *Registry) snapshot() snapshot {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.state()
+}
+
+// state returns the state of the registry, the lock must be held
+func (r *Registry) state() snapshot {
+	s := snapshot{
+		Seq:       r.seq,
+		GuestNum:  r.guestNum,
+		Members:   make([]memberState, 0, len(r.peers)),
+		Names:     make(map[string]nameState, len(r.names)),
+		LastNames: make(map[string]string, len(r.lastNames)),
+	}
+	for _, peer := range r.peers {
+		s.Members = append(s.Members, stateOf(peer))
+	}
+	for name, owner := range r.names {
+		s.Names[name] = nameState{PublicKey: owner.publicKey, Salt: owner.salt, PasswordHash: owner.passwordHash, Iterations: owner.iterations}
+	}
+	for key, name := range r.lastNames {
+		s.LastNames[key] = name
+	}
+	s.Bans.IPs, s.Bans.Keys = r.bans.List()
+	return s
+}
+
+// setState replaces the state of the registry by a snapshot, the lock must be held
+func (r *Registry) setState(s snapshot) {
+	r.seq = s.Seq
+	r.guestNum = s.GuestNum
+	r.peers = make(map[string]*Peer, len(s.Members))
+	for _, m := range s.Members {
+		peer := &Peer{
+			id:             m.ID,
+			node:           m.Node,
+			address:        m.Address,
+			pseudo:         m.Pseudo,
+			chatAddress:    m.ChatAddress,
+			publicKey:      m.PublicKey,
+			rooms:          make(map[string]bool),
+			connectedSince: m.ConnectedSince,
+		}
+		for _, room := range m.Rooms {
+			peer.rooms[room] = true
+		}
+		r.peers[m.ID] = peer
+	}
+	r.names = make(map[string]nameOwner, len(s.Names))
+	for name, owner := range s.Names {
+		r.names[name] = nameOwner{publicKey: owner.PublicKey, salt: owner.Salt, passwordHash: owner.PasswordHash, iterations: owner.Iterations}
+	}
+	r.lastNames = make(map[string]string, len(s.LastNames))
+	for key, name := range s.LastNames {
+		r.lastNames[key] = name
+	}
+	if err := r.bans.Replace(s.Bans.IPs, s.Bans.Keys); err != nil {
+		fmt.Println("Failed to save the ban list", err)
+	}
+}
+
+// install replaces the state of the registry by a snapshot
+// it returns the restore operations for the local clients the snapshot does not know as we do,
+// and the disconnect operations for the clients it still has on this directory but which are gone
+func (r *Registry) install(s snapshot) []Operation {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// what we know about our own clients
+	ours := make(map[string]memberState)
+	for id := range r.local {
+		if peer, found := r.peers[id]; found {
+			ours[id] = stateOf(peer)
+		}
+	}
+
+	r.setState(s)
+	r.saveSnapshot()
+	r.applied.Broadcast()
+	r.emit(Resync, nil, "")
+
+	restores := make([]Operation, 0)
+	for id, m := range ours {
+		if peer, found := r.peers[id]; found && reflect.DeepEqual(stateOf(peer), m) {
+			continue
+		}
+		restores = append(restores, Operation{
+			Kind:        opRestore,
+			ID:          m.ID,
+			Node:        m.Node,
+			Address:     m.Address,
+			Name:        m.Pseudo,
+			ChatAddress: m.ChatAddress,
+			PublicKey:   m.PublicKey,
+			Rooms:       m.Rooms,
+			Time:        m.ConnectedSince,
+		})
+	}
+	for id, peer := range r.peers {
+		if _, found := r.local[id]; !found && peer.node == r.node {
+			restores = append(restores, Operation{Kind: opDisconnect, ID: id})
+		}
+	}
+	return restores
+}
+
+// nodesWithClients returns the directories which have clients in the registry
+func (r *Registry) nodesWithClients() map[string]bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	nodes := make(map[string]bool)
+	for _, peer := range r.peers {
+		nodes[peer.node] = true
+	}
+	return nodes
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"hash"
+)
+
+// The passwords protecting the usernames are stretched with PBKDF2-HMAC-SHA256 (RFC 8018), so the hashes saved in
+// the journal and sent to the other directories of the cluster are slow to guess : each guess costs passwordIterations HMAC.
+// The names registered by the first versions have a single salted SHA-256 (0 iterations), they get the new hash
+// the next time their password is given.
+const (
+	passwordIterations = 600000
+	passwordSaltBytes  = 16
+)
+
+// nameOwner protects a registered username
+// the name is reserved to the client with the identity key publicKey, or to the clients which know the password
+type nameOwner struct {
+	publicKey    string
+	salt         []byte
+	passwordHash []byte
+	iterations   int
+}
+
+// allows returns true if the client with publicKey, giving password, may use the name
+// it takes a while with a password, the registry must not be locked
+func (owner nameOwner) allows(publicKey string, password string) bool {
+	if owner.passwordHash == nil {
+		return owner.ownedBy(publicKey)
+	}
+	return subtle.ConstantTimeCompare(hashPassword(owner.salt, password, owner.iterations), owner.passwordHash) == 1
+}
+
+// ownedBy returns true if the name is reserved to the client with publicKey, without password
+// it hashes nothing, so it can be called with the registry locked
+func (owner nameOwner) ownedBy(publicKey string) bool {
+	return owner.passwordHash == nil && publicKey != "" && publicKey == owner.publicKey
+}
+
+// weakHash returns true if the password of the name is hashed with fewer iterations than the current ones
+func (owner nameOwner) weakHash() bool {
+	return owner.passwordHash != nil && owner.iterations < passwordIterations
+}
+
+// hashPassword returns the hash of password with salt, by iterations rounds of PBKDF2-HMAC-SHA256
+// (or by the salted SHA-256 of the first versions with 0 iterations)
+func hashPassword(salt []byte, password string, iterations int) []byte {
+	if iterations == 0 {
+		sum := sha256.Sum256(append(append([]byte{}, salt...), password...))
+		return sum[:]
+	}
+	return pbkdf2(sha256.New, []byte(password), salt, iterations, sha256.Size)
+}
+
+// pbkdf2 derives a key of keyLength bytes from password and salt, as told by RFC 8018 (section 5.2) with HMAC-hash
+func pbkdf2(hash func() hash.Hash, password []byte, salt []byte, iterations int, keyLength int) []byte {
+	prf := hmac.New(hash, password)
+	size := prf.Size()
+	key := make([]byte, 0, keyLength+size)
+	u := make([]byte, 0, size)
+	for block := uint32(1); len(key) < keyLength; block++ {
+		// U1 = PRF(password, salt || INT(block)), T = U1 xor U2 xor ... Uc with Ui = PRF(password, Ui-1)
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u = prf.Sum(u[:0])
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLength]
+}
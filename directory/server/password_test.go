@@ -0,0 +1,88 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestPBKDF2Vectors(t *testing.T) {
+	// PBKDF2-HMAC-SHA256 test vectors of RFC 7914, section 11
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, test := range tests {
+		got := hex.EncodeToString(pbkdf2(sha256.New, []byte(test.password), []byte(test.salt), test.iterations, 64))
+		if got != test.want {
+			t.Errorf("PBKDF2(%q, %q, %d) = %s, want %s", test.password, test.salt, test.iterations, got, test.want)
+		}
+	}
+}
+
+func TestWeakPasswordHashIsReplaced(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+
+	// a name registered by the first versions, with a single salted SHA-256
+	salt := []byte("0123456789abcdef")
+	registry.names["alice"] = nameOwner{publicKey: "old key", salt: salt, passwordHash: hashPassword(salt, "secret", 0)}
+
+	peer, err := registry.Register(newTestClient(t, 1), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key, _ := ed25519.GenerateKey(nil)
+	identify(t, registry, peer.id, key, 9000)
+
+	if err := registry.Rename(peer.id, "alice", "wrong"); err != ErrNameProtected {
+		t.Fatalf("renamed with a wrong password : %v", err)
+	}
+	if err := registry.Rename(peer.id, "alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	registry.mutex.RLock()
+	owner := registry.names["alice"]
+	registry.mutex.RUnlock()
+	if owner.iterations != passwordIterations || owner.weakHash() {
+		t.Fatalf("the password is still hashed with %d iterations", owner.iterations)
+	}
+	if !owner.allows("", "secret") || owner.allows("", "wrong") {
+		t.Error("the new hash doesn't check the password")
+	}
+}
+
+func TestProtectedNameIsNotRestored(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	_, key, _ := ed25519.GenerateKey(nil)
+
+	peer, err := registry.Register(newTestClient(t, 1), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identify(t, registry, peer.id, key, 9000)
+	if err := registry.Rename(peer.id, "alice", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Protect(peer.id, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	registry.Unregister(peer.id)
+
+	// the identify is applied with the lock held, it can't check the password, so the name isn't given back
+	peer, err = registry.Register(newTestClient(t, 2), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored := identify(t, registry, peer.id, key, 9000); restored.pseudo == "alice" {
+		t.Fatal("a name protected by a password was restored without the password")
+	}
+	if err := registry.Rename(peer.id, "alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,532 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teanan/GOssip-TP/network"
+)
+
+// Peer is a connected client, identified by id in the whole cluster of directories
+// node is the directory it is connected to ("" without cluster), address the address of its connection
+// chatAddress stays "?" until the client proved it owns publicKey by signing its challenge
+// conn is only set on the directory the client is connected to, with outbox, the messages waiting to be written to it
+type Peer struct {
+	conn           *network.Conn
+	outbox         chan network.Message
+	id             string
+	node           string
+	address        string
+	pseudo         string
+	chatAddress    string
+	publicKey      string
+	rooms          map[string]bool
+	connectedSince time.Time
+}
+
+// identified returns true once the client proved its identity, it is then a member of the chat
+func (peer Peer) identified() bool {
+	return peer.chatAddress != "?"
+}
+
+// local returns true if the client is connected to this directory
+func (peer Peer) local() bool {
+	return peer.conn != nil
+}
+
+// sortedRooms returns the rooms joined by the client, sorted by name
+func (peer Peer) sortedRooms() []string {
+	rooms := make([]string, 0, len(peer.rooms))
+	for room := range peer.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// clientID returns the id of the client connected from address to the directory node
+func clientID(node string, address string) string {
+	if node == "" {
+		return address
+	}
+	return node + "/" + address
+}
+
+// localClient is what only the directory a client is connected to knows about it :
+// its connection and the messages waiting to be written to it, and the chat port and identity key it claimed in HELLO until it signs challenge
+type localClient struct {
+	conn      *network.Conn
+	outbox    chan network.Message
+	chatPort  int
+	publicKey string
+	challenge string
+}
+
+// EventKind is the kind of change of the registry an Event reports
+type EventKind int
+
+const (
+	PeerJoined       EventKind = iota // the client proved its identity and joined the chat
+	PeerLeft                          // an identified client disconnected
+	PeerRenamed                       // the username of a client changed
+	PeerRoomsChanged                  // an identified client joined or left a room
+	PeerKicked                        // the client must be disconnected, Text is the reason
+	PeerBanned                        // the client is banned and must be disconnected, Text is the reason
+	Notice                            // Text must be sent to every client
+	Resync                            // the registry was replaced by a snapshot, every client must be told the whole state
+)
+
+// Event is a change of the registry, with a copy of the client as it was after the change
+type Event struct {
+	Kind EventKind
+	Peer Peer
+	Text string
+}
+
+// guestPrefix starts the usernames given by the directory, they can't be requested by the clients
+const guestPrefix = "Guest#"
+
+var (
+	ErrNameTaken       = errors.New("username already taken")
+	ErrNameProtected   = errors.New("username registered by someone else, a valid password is required")
+	ErrNameReserved    = errors.New("usernames starting with " + guestPrefix + " are reserved")
+	ErrNotIdentified   = errors.New("the identity key must be proved first")
+	ErrUnknownClient   = errors.New("no client connected from this address")
+	ErrFull            = errors.New("the directory is full")
+	ErrUnexpectedProof = errors.New("unexpected PROOF message")
+	ErrInvalidProof    = errors.New("invalid PROOF message")
+
+	// knownErrors are recognised when they come back from the primary directory of a cluster
+	knownErrors = []error{ErrNameTaken, ErrNameProtected, ErrNameReserved, ErrNotIdentified, ErrUnknownClient, ErrFull}
+)
+
+// replicator orders the operations of a cluster of directories
+// propose returns once op is applied by the local registry, with the result of apply
+type replicator interface {
+	propose(op Operation) (string, error)
+}
+
+// Registry holds the connected clients, of this directory and of the other directories of the cluster
+// it is shared by the connections goroutines, so every operation is synchronized
+// every change is an Operation, applied in the same order by every directory of the cluster (see operation.go)
+// the changes which concern the clients are reported, in order, on the channel returned by Events
+type Registry struct {
+	mutex     sync.RWMutex
+	node      string
+	peers     map[string]*Peer
+	local     map[string]*localClient // the clients connected to this directory, by id
+	names     map[string]nameOwner    // registered usernames
+	lastNames map[string]string       // username of each identity key in its last session
+	bans      *BanList
+	guestNum  int
+	journal   *Journal // nil if the registry is not saved
+
+	seq        uint64             // sequence number of the last applied operation
+	applied    *sync.Cond         // signaled when seq changes
+	replicator replicator         // nil without cluster, the operations are then committed directly
+	onCommit   func(op Operation) // called with the lock held after an operation is committed
+
+	// events are queued without blocking while the lock is held, and delivered by deliverEvents until Close
+	pending []Event
+	wake    chan struct{}
+	events  chan Event
+	done    chan struct{}
+	closed  sync.Once
+}
+
+// NewRegistry builds a new empty Registry for the directory node ("" without cluster), which enforces bans
+func NewRegistry(node string, bans *BanList) *Registry {
+	registry := &Registry{
+		node:      node,
+		peers:     make(map[string]*Peer),
+		local:     make(map[string]*localClient),
+		names:     make(map[string]nameOwner),
+		lastNames: make(map[string]string),
+		bans:      bans,
+
+		wake:   make(chan struct{}, 1),
+		events: make(chan Event),
+		done:   make(chan struct{}),
+	}
+	registry.applied = sync.NewCond(&registry.mutex)
+	go registry.deliverEvents()
+	return registry
+}
+
+// Events returns the channel on which the changes of the registry are reported
+func (r *Registry) Events() <-chan Event {
+	return r.events
+}
+
+// Close stops the delivery of the events, the changes made afterwards are not reported anymore
+func (r *Registry) Close() {
+	r.closed.Do(func() {
+		close(r.done)
+	})
+}
+
+// propose has op applied, by the cluster if there is one
+func (r *Registry) propose(op Operation) (string, error) {
+	if r.replicator != nil {
+		return r.replicator.propose(op)
+	}
+	result, _, err := r.commit(op)
+	return result, err
+}
+
+// commit applies op with the next sequence number, it is done by the primary directory of a cluster
+// it returns the result of apply and the sequence number
+// an operation which fails changes nothing, and is not replicated
+func (r *Registry) commit(op Operation) (string, uint64, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	op.Seq = r.seq + 1
+	result, err := r.apply(op)
+	if err != nil {
+		return "", 0, err
+	}
+	r.seq = op.Seq
+	r.record(op)
+	r.applied.Broadcast()
+	if r.onCommit != nil {
+		r.onCommit(op)
+	}
+	return result, op.Seq, nil
+}
+
+// replay applies an operation committed by the primary directory
+// it returns false if an operation is missing before it, the registry must then be replaced by a snapshot
+func (r *Registry) replay(op Operation) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if op.Seq <= r.seq {
+		return true
+	}
+	if op.Seq != r.seq+1 {
+		return false
+	}
+	r.apply(op)
+	r.seq = op.Seq
+	r.record(op)
+	r.applied.Broadcast()
+	return true
+}
+
+// waitApplied waits until the operation seq was applied, or timeout
+func (r *Registry) waitApplied(seq uint64, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		r.mutex.Lock()
+		r.applied.Broadcast()
+		r.mutex.Unlock()
+	})
+	defer timer.Stop()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for r.seq < seq && time.Now().Before(deadline) {
+		r.applied.Wait()
+	}
+	return r.seq >= seq
+}
+
+// Register adds the client connected with conn, under a new guest username
+// it fails with ErrFull if maxPeers clients are already connected to the cluster
+func (r *Registry) Register(conn *network.Conn, maxPeers int) (Peer, error) {
+	address := conn.RemoteAddr().String()
+	id := clientID(r.node, address)
+
+	r.mutex.Lock()
+	r.local[id] = &localClient{conn: conn, outbox: make(chan network.Message, clientQueue)}
+	r.mutex.Unlock()
+
+	_, err := r.propose(Operation{
+		Kind:     opConnect,
+		ID:       id,
+		Node:     r.node,
+		Address:  address,
+		Time:     time.Now(),
+		MaxPeers: maxPeers,
+	})
+	if err != nil {
+		r.mutex.Lock()
+		delete(r.local, id)
+		r.mutex.Unlock()
+		return Peer{}, err
+	}
+
+	peer, _ := r.Get(id)
+	return peer, nil
+}
+
+// Unregister removes the client with this id
+func (r *Registry) Unregister(id string) {
+	r.propose(Operation{Kind: opDisconnect, ID: id})
+
+	r.mutex.Lock()
+	delete(r.local, id)
+	r.mutex.Unlock()
+}
+
+// Get returns a copy of the client with this id
+// second return parameter is false if there is no such client
+func (r *Registry) Get(id string) (Peer, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	peer, found := r.peers[id]
+	if !found {
+		return Peer{}, false
+	}
+	return r.copyOf(peer), true
+}
+
+// List returns a copy of every identified client, sorted by chat address
+func (r *Registry) List() []Peer {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	list := make([]Peer, 0, len(r.peers))
+	for _, peer := range r.peers {
+		if peer.identified() {
+			list = append(list, r.copyOf(peer))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].chatAddress < list[j].chatAddress
+	})
+	return list
+}
+
+// Clients returns a copy of every connected client, identified or not, sorted by id
+func (r *Registry) Clients() []Peer {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	list := make([]Peer, 0, len(r.peers))
+	for _, peer := range r.peers {
+		list = append(list, r.copyOf(peer))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].id < list[j].id
+	})
+	return list
+}
+
+// Hello records the chat port and identity key claimed by a local client, and the challenge it must sign to prove it
+func (r *Registry) Hello(id string, chatPort int, publicKey string, challenge string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	client, found := r.local[id]
+	if !found {
+		return false
+	}
+	client.chatPort = chatPort
+	client.publicKey = publicKey
+	client.challenge = challenge
+	return true
+}
+
+// Identify checks the signature of the challenge of a local client, and registers its chat address and identity key
+// a client which still has its guest username gets back the name registered with its identity key, if it is free
+// it returns a copy of the identified client
+func (r *Registry) Identify(id string, proof string) (Peer, error) {
+	r.mutex.Lock()
+	client, found := r.local[id]
+	peer := r.peers[id]
+	if !found || peer == nil || client.challenge == "" {
+		r.mutex.Unlock()
+		return Peer{}, ErrUnexpectedProof
+	}
+	chatPort, publicKey, challenge := client.chatPort, client.publicKey, client.challenge
+	client.challenge = ""
+	address := peer.address
+	r.mutex.Unlock()
+
+	key, _ := network.DecodePublicKey(publicKey)
+	if !network.VerifyDirectoryProof(key, challenge, proof) {
+		return Peer{}, ErrInvalidProof
+	}
+
+	_, err := r.propose(Operation{
+		Kind:        opIdentify,
+		ID:          id,
+		ChatAddress: strings.SplitN(address, ":", 2)[0] + ":" + strconv.Itoa(chatPort),
+		PublicKey:   publicKey,
+	})
+	if err != nil {
+		return Peer{}, err
+	}
+
+	identified, _ := r.Get(id)
+	return identified, nil
+}
+
+// Rename changes the username of the client, if no other client uses it
+// a registered name can only be taken by its owner, or with its password
+// the check and the change are done by the same operation, so two clients can never get the same name
+func (r *Registry) Rename(id string, name string, password string) error {
+	// the password is checked here, so it is never sent to the other directories
+	// (out of the lock, hashing it takes a while)
+	r.mutex.RLock()
+	owner, registered := r.names[name]
+	peer := r.peers[id]
+	publicKey := ""
+	if peer != nil {
+		publicKey = peer.publicKey
+	}
+	r.mutex.RUnlock()
+	authorized := registered && peer != nil && owner.allows(publicKey, password)
+
+	_, err := r.propose(Operation{Kind: opRename, ID: id, Name: name, Authorized: authorized})
+	if err == nil && authorized && owner.weakHash() {
+		// the password of a name registered by the first versions is hashed again, with the current iterations
+		r.Protect(id, password)
+	}
+	return err
+}
+
+// ForceRename changes the username of the client on behalf of the administrator :
+// the name must not be used by another client, but it may be registered by someone else
+func (r *Registry) ForceRename(id string, name string) error {
+	_, err := r.propose(Operation{Kind: opRename, ID: id, Name: name, Force: true})
+	return err
+}
+
+// Protect registers the current username of the client, so it is reserved to it in the next sessions :
+// to its identity key if password is empty, to the clients which know password otherwise
+func (r *Registry) Protect(id string, password string) (string, error) {
+	op := Operation{Kind: opProtect, ID: id}
+	if password != "" {
+		op.Salt = make([]byte, passwordSaltBytes)
+		if _, err := rand.Read(op.Salt); err != nil {
+			return "", err
+		}
+		op.Iterations = passwordIterations
+		op.PasswordHash = hashPassword(op.Salt, password, op.Iterations)
+	}
+	return r.propose(op)
+}
+
+// JoinRoom adds room to the rooms of the client
+func (r *Registry) JoinRoom(id string, room string) {
+	r.propose(Operation{Kind: opJoin, ID: id, Room: room})
+}
+
+// PartRoom removes room from the rooms of the client
+func (r *Registry) PartRoom(id string, room string) {
+	r.propose(Operation{Kind: opPart, ID: id, Room: room})
+}
+
+// Kick has the client disconnected by its directory, reason is sent to it
+func (r *Registry) Kick(id string, reason string) error {
+	_, err := r.propose(Operation{Kind: opKick, ID: id, Text: reason})
+	return err
+}
+
+// Notice has text sent to every client of the cluster
+func (r *Registry) Notice(text string) error {
+	_, err := r.propose(Operation{Kind: opNotice, Text: text})
+	return err
+}
+
+// Ban bans a host (IP or CIDR range) and/or an identity key, the matching clients are disconnected
+func (r *Registry) Ban(host string, key string) error {
+	if err := validBan(host, key); err != nil {
+		return err
+	}
+	_, err := r.propose(Operation{Kind: opBan, Host: host, PublicKey: key})
+	return err
+}
+
+// Unban removes a host and/or an identity key from the bans
+func (r *Registry) Unban(host string, key string) error {
+	if err := validBan(host, key); err != nil {
+		return err
+	}
+	_, err := r.propose(Operation{Kind: opUnban, Host: host, PublicKey: key})
+	return err
+}
+
+func validBan(host string, key string) error {
+	if host != "" {
+		if _, err := parseRange(host); err != nil {
+			return err
+		}
+	}
+	if key != "" {
+		if _, err := network.DecodePublicKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyOf returns a copy of the client which does not share its rooms with the registry, the lock must be held
+func (r *Registry) copyOf(peer *Peer) Peer {
+	c := *peer
+	c.rooms = make(map[string]bool, len(peer.rooms))
+	for room := range peer.rooms {
+		c.rooms[room] = true
+	}
+	if client, found := r.local[peer.id]; found && peer.node == r.node {
+		c.conn, c.outbox = client.conn, client.outbox
+	}
+	return c
+}
+
+// nameInUse returns true if a client other than id uses name, the lock must be held
+func (r *Registry) nameInUse(name string, id string) bool {
+	for otherID, p := range r.peers {
+		if otherID != id && p.pseudo == name {
+			return true
+		}
+	}
+	return false
+}
+
+// emit queues an event, the lock must be held so the events are queued in the order of the changes
+func (r *Registry) emit(kind EventKind, peer *Peer, text string) {
+	event := Event{Kind: kind, Text: text}
+	if peer != nil {
+		event.Peer = r.copyOf(peer)
+	}
+	r.pending = append(r.pending, event)
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverEvents sends the queued events on the events channel, so a slow consumer never blocks the registry
+// it stops when the registry is closed
+func (r *Registry) deliverEvents() {
+	for {
+		select {
+		case <-r.wake:
+		case <-r.done:
+			return
+		}
+
+		r.mutex.Lock()
+		pending := r.pending
+		r.pending = nil
+		r.mutex.Unlock()
+
+		for _, event := range pending {
+			select {
+			case r.events <- event:
+			case <-r.done:
+				return
+			}
+		}
+	}
+}
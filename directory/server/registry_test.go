@@ -0,0 +1,218 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/teanan/GOssip-TP/network"
+)
+
+const concurrentClients = 300
+
+// testConn is a connection with its own remote address, so every client of a test has its own id
+type testConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c testConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// newTestClient returns the connection of a client connected from 10.0.<i>:<port>, the remote end is closed with the test
+func newTestClient(t *testing.T, i int) *network.Conn {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	address := &net.TCPAddr{IP: net.IPv4(10, 0, byte(i/256), byte(i%256)), Port: 40000 + i}
+	return network.NewConn(testConn{Conn: local, remote: address}, network.LogQuiet)
+}
+
+// newTestRegistry returns a registry without bans, whose events are read (and counted) until the test ends
+func newTestRegistry(t *testing.T) (*Registry, func() map[EventKind]int) {
+	bans, err := LoadBanList("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewRegistry("", bans)
+
+	var mutex sync.Mutex
+	counts := make(map[EventKind]int)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case event := <-registry.Events():
+				mutex.Lock()
+				counts[event.Kind]++
+				mutex.Unlock()
+			case <-registry.done:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		registry.Close()
+		<-stopped
+	})
+
+	return registry, func() map[EventKind]int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		copied := make(map[EventKind]int, len(counts))
+		for kind, n := range counts {
+			copied[kind] = n
+		}
+		return copied
+	}
+}
+
+// identify proves the identity key of the client id, as a real client would
+func identify(t *testing.T, registry *Registry, id string, key ed25519.PrivateKey, chatPort int) Peer {
+	challenge := network.NewChallenge()
+	publicKey := network.EncodePublicKey(key.Public().(ed25519.PublicKey))
+	if !registry.Hello(id, chatPort, publicKey, challenge) {
+		t.Errorf("%s : Hello refused", id)
+		return Peer{}
+	}
+	peer, err := registry.Identify(id, network.NewStack(key).SignDirectoryChallenge(challenge))
+	if err != nil {
+		t.Errorf("%s : %v", id, err)
+	}
+	return peer
+}
+
+func TestConcurrentJoinsAndLeaves(t *testing.T) {
+	registry, events := newTestRegistry(t)
+
+	var clients sync.WaitGroup
+	for i := 0; i < concurrentClients; i++ {
+		clients.Add(1)
+		go func(i int) {
+			defer clients.Done()
+
+			peer, err := registry.Register(newTestClient(t, i), 0)
+			if err != nil {
+				t.Errorf("client %d : %v", i, err)
+				return
+			}
+			_, key, _ := ed25519.GenerateKey(nil)
+			identify(t, registry, peer.id, key, 9000)
+			registry.JoinRoom(peer.id, "#room"+strconv.Itoa(i%5))
+			if err := registry.Rename(peer.id, "user"+strconv.Itoa(i), ""); err != nil {
+				t.Errorf("client %d : %v", i, err)
+			}
+			registry.List()
+			registry.Clients()
+			registry.Unregister(peer.id)
+		}(i)
+	}
+
+	// the lists are read while the clients come and go
+	reading := make(chan bool)
+	go func() {
+		defer close(reading)
+		for i := 0; i < 100; i++ {
+			for _, peer := range registry.List() {
+				peer.sortedRooms()
+			}
+		}
+	}()
+	clients.Wait()
+	<-reading
+
+	if clients := registry.Clients(); len(clients) != 0 {
+		t.Errorf("%d clients left after they all unregistered", len(clients))
+	}
+
+	// every client joined and left once, the events may still be on their way
+	for i := 0; i < 100 && events()[PeerLeft] < concurrentClients; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	counts := events()
+	if counts[PeerJoined] != concurrentClients || counts[PeerLeft] != concurrentClients {
+		t.Errorf("%d joined and %d left events, want %d of each", counts[PeerJoined], counts[PeerLeft], concurrentClients)
+	}
+}
+
+func TestConcurrentRenamesGiveTheNameOnce(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+
+	ids := make([]string, concurrentClients)
+	for i := range ids {
+		peer, err := registry.Register(newTestClient(t, i), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = peer.id
+	}
+
+	var clients sync.WaitGroup
+	var mutex sync.Mutex
+	winners := 0
+	for _, id := range ids {
+		clients.Add(1)
+		go func(id string) {
+			defer clients.Done()
+			err := registry.Rename(id, "alice", "")
+			if err != nil && err != ErrNameTaken {
+				t.Errorf("%s : %v", id, err)
+			}
+			if err == nil {
+				mutex.Lock()
+				winners++
+				mutex.Unlock()
+			}
+		}(id)
+	}
+	clients.Wait()
+
+	if winners != 1 {
+		t.Fatalf("%d clients got the name, want 1", winners)
+	}
+	named := 0
+	for _, peer := range registry.Clients() {
+		if peer.pseudo == "alice" {
+			named++
+		}
+	}
+	if named != 1 {
+		t.Errorf("%d clients are named alice, want 1", named)
+	}
+}
+
+func TestConcurrentRegisterRespectsMaxPeers(t *testing.T) {
+	registry, _ := newTestRegistry(t)
+	const maxPeers = 50
+
+	var clients sync.WaitGroup
+	var mutex sync.Mutex
+	accepted := 0
+	for i := 0; i < concurrentClients; i++ {
+		clients.Add(1)
+		go func(i int) {
+			defer clients.Done()
+			_, err := registry.Register(newTestClient(t, i), maxPeers)
+			if err != nil && err != ErrFull {
+				t.Errorf("client %d : %v", i, err)
+			}
+			if err == nil {
+				mutex.Lock()
+				accepted++
+				mutex.Unlock()
+			}
+		}(i)
+	}
+	clients.Wait()
+
+	if accepted != maxPeers || len(registry.Clients()) != maxPeers {
+		t.Errorf("%d clients accepted and %d registered, want %d", accepted, len(registry.Clients()), maxPeers)
+	}
+}
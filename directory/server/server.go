@@ -0,0 +1,501 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teanan/GOssip-TP/network"
+)
+
+const (
+	connectionBurst = 10              // connections a host may open at once, before Config.ConnectionRate applies
+	messageBurst    = 20              // messages a host may send at once, before Config.MessageRate applies
+	clientQueue     = 256             // messages waiting to be written to a client, a client which lets it fill up is disconnected
+	writeTimeout    = 5 * time.Second // time allowed to write a message to a client
+)
+
+var errSlowClient = errors.New("the client does not read its messages")
+
+// Config is the configuration of a directory server, the zero values disable the optional parts
+type Config struct {
+	ListenAddress string            // address on which the clients connect (":8080")
+	Transport     network.Transport // network.TCPTransport if nil
+	TLS           *tls.Config       // nil for plaintext connections
+	LogLevel      network.LogLevel  // messages sent and received traced on the standard output, none if zero (network.LogQuiet)
+
+	Node          string   // cluster address of this directory, it must be in Cluster
+	Cluster       []string // cluster addresses of every directory of the cluster by priority, none without cluster
+	ClusterSecret string   // secret shared by the directories of the cluster
+	Advertise     string   // address of this directory given to the clients of the cluster
+
+	AdminAddress string // address of the HTTP admin API (":8081"), disabled if empty
+	AdminToken   string // token required by the admin API
+
+	BansFile       string  // file of the banned hosts and identity keys, the bans are only kept in memory if empty
+	DataDir        string  // directory where the registry is saved, to recover it after a restart, disabled if empty
+	MaxPeers       int     // maximum number of connected clients, 0 for no limit
+	ConnectionRate float64 // connections per second allowed to each host, 0 for no limit
+	MessageRate    float64 // messages per second allowed to each host, 0 for no limit
+}
+
+// Server is a directory server : the registry of its clients, shared with the other directories of its cluster,
+// the bans and rate limits which protect it, and its admin API
+// several servers can run in the same process, as the directory of a scenario
+type Server struct {
+	config            Config
+	registry          *Registry
+	cluster           *Cluster // nil without cluster
+	bans              *BanList
+	connectionLimiter *rateLimiter
+	messageLimiter    *rateLimiter
+}
+
+// NewServer loads the bans and the saved registry of a directory, and builds its cluster
+func NewServer(config Config) (*Server, error) {
+	if config.MaxPeers < 0 || config.ConnectionRate < 0 || config.MessageRate < 0 {
+		return nil, errors.New("the limits of the directory must be 0 (no limit) or more")
+	}
+	if config.AdminAddress != "" && config.AdminToken == "" {
+		return nil, errors.New("the admin API needs a token")
+	}
+	if len(config.Cluster) > 0 && config.ClusterSecret == "" {
+		return nil, errors.New("the cluster needs a secret")
+	}
+	if config.Transport == nil {
+		config.Transport = network.TCPTransport{}
+	}
+
+	s := &Server{config: config}
+	var err error
+	if s.bans, err = LoadBanList(config.BansFile); err != nil {
+		return nil, fmt.Errorf("failed to load the ban list : %v", err)
+	}
+	s.connectionLimiter = newRateLimiter(config.ConnectionRate, connectionBurst)
+	s.messageLimiter = newRateLimiter(config.MessageRate, messageBurst)
+
+	s.registry = NewRegistry(config.Node, s.bans)
+	if config.DataDir != "" {
+		journal, err := OpenJournal(config.DataDir)
+		if err == nil {
+			err = s.registry.Recover(journal)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to recover the registry : %v", err)
+		}
+	}
+	if len(config.Cluster) > 0 {
+		s.cluster, err = NewCluster(config.Node, config.Cluster, config.ClusterSecret, config.Advertise, s.registry, config.Transport)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster configuration : %v", err)
+		}
+		s.cluster.logLevel = config.LogLevel
+	}
+	return s, nil
+}
+
+// Run listens on the address of the configuration (with TLS if it is enabled) and serves until ctx is done
+// it returns an error if the directory can't listen
+func (s *Server) Run(ctx context.Context) error {
+	ln, err := s.config.Transport.Listen(s.config.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("failed to open listen connection : %v", err)
+	}
+	if s.config.TLS != nil {
+		ln = tls.NewListener(ln, s.config.TLS)
+	}
+	return s.Serve(ctx, ln)
+}
+
+// Serve accepts the clients on ln, and runs the cluster and the admin API, until ctx is done
+// ln and the connections of the clients are then closed
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	defer s.registry.Close()
+	defer network.CloseOnDone(ctx, ln)()
+
+	if s.cluster != nil {
+		go s.cluster.Run(ctx)
+	}
+	go s.broadcast(ctx, s.registry.Events())
+	go s.connectionLimiter.forgetIdle(ctx)
+	go s.messageLimiter.forgetIdle(ctx)
+	if s.config.AdminAddress != "" {
+		go s.serveAdmin(ctx, s.config.AdminAddress, s.config.AdminToken)
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			fmt.Println("Failed to accept incoming connection", err)
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			continue
+		}
+		go s.accept(ctx, network.NewConn(conn, s.config.LogLevel))
+	}
+}
+
+// accept registers a new client, unless its host is banned or opens too many connections, or the directory is full
+func (s *Server) accept(ctx context.Context, conn *network.Conn) {
+	host := hostOf(conn.RemoteAddr().String())
+
+	if s.bans.HostBanned(host) {
+		refuse(conn, "banned", "your address is banned from this directory")
+		return
+	}
+	if !s.connectionLimiter.Allow(host) {
+		refuse(conn, "rate", "too many connections, retry later")
+		return
+	}
+
+	peer, err := s.registry.Register(conn, s.config.MaxPeers)
+	if err == ErrFull {
+		refuse(conn, "full", "the directory is full, retry later")
+		return
+	}
+	if err != nil {
+		refuse(conn, "unavailable", err.Error())
+		return
+	}
+	s.handleConnection(ctx, peer)
+}
+
+// refuse sends "ERROR <code> <reason>" to a client and closes its connection
+func refuse(conn *network.Conn, code string, reason string) {
+	fmt.Println("Refused", conn.RemoteAddr(), ":", reason)
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	conn.Send(network.Message{Kind: "ERROR", Data: code + " " + reason})
+	conn.Close()
+}
+
+// hostOf returns the IP of a "host:port" address
+func hostOf(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+func (s *Server) handleConnection(ctx context.Context, peer Peer) {
+	conn := peer.conn
+	host := hostOf(peer.address)
+
+	defer conn.Close()
+	defer s.registry.Unregister(peer.id)
+	defer network.CloseOnDone(ctx, conn)()
+
+	written := make(chan struct{})
+	defer close(written)
+	go writeQueue(peer, written)
+
+	if err := send(peer, "WELCOME", peer.pseudo); err != nil {
+		return
+	}
+	if s.cluster != nil {
+		send(peer, "DIRECTORIES", strings.Join(s.cluster.Directories(), " "))
+	}
+
+	for {
+		message, err := conn.Next()
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Println("Error reading message ", err)
+			}
+			return
+		}
+
+		if s.config.LogLevel.Logged(message) {
+			fmt.Println(conn.RemoteAddr(), "said :", message)
+		}
+
+		if !s.messageLimiter.Allow(host) {
+			refuse(conn, "rate", "too many messages")
+			return
+		}
+
+		switch message.Kind {
+		case "HELLO":
+			s.handleHello(peer, message.Data)
+		case "PROOF":
+			s.handleProof(peer, message.Data)
+		case "JOIN":
+			s.handleJoin(peer, message.Data)
+		case "PART":
+			s.handlePart(peer, message.Data)
+		case "NICK":
+			s.handleNick(peer, message.Data)
+		case "REGISTER":
+			s.handleRegister(peer, message.Data)
+		case "BYE":
+			// the client is shutting down, it is unregistered without waiting for its connection to be closed
+			fmt.Println(conn.RemoteAddr(), "left")
+			return
+		default:
+			fmt.Println("Unknown message type", message)
+		}
+	}
+}
+
+// handleHello reads "HELLO <port> <publicKey>" and asks the client to sign a challenge with this key
+func (s *Server) handleHello(peer Peer, data string) {
+	fields := strings.Fields(data)
+	if len(fields) != 2 {
+		fmt.Println("Invalid HELLO message", data)
+		return
+	}
+
+	port, err := strconv.Atoi(fields[0])
+	if err != nil {
+		fmt.Println("Invalid HELLO message ", err)
+		return
+	}
+
+	if _, err := network.DecodePublicKey(fields[1]); err != nil {
+		fmt.Println("Invalid public key in HELLO message ", err)
+		return
+	}
+
+	if s.bans.KeyBanned(fields[1]) {
+		refuse(peer.conn, "banned", "your identity key is banned from this directory")
+		return
+	}
+
+	challenge := network.NewChallenge()
+	if !s.registry.Hello(peer.id, port, fields[1], challenge) {
+		return
+	}
+
+	send(peer, "CHALLENGE", challenge)
+}
+
+// handleProof checks the signature of the challenge, and registers the chat address and public key of the client
+func (s *Server) handleProof(peer Peer, data string) {
+	current, _ := s.registry.Get(peer.id)
+	identified, err := s.registry.Identify(peer.id, strings.TrimSpace(data))
+	if err != nil {
+		fmt.Println("Refused PROOF message from", peer.address, ":", err)
+		return
+	}
+
+	// the client may get back the username registered with its identity key
+	if identified.pseudo != current.pseudo {
+		send(identified, "WELCOME", identified.pseudo)
+	}
+}
+
+// handleNick reads "NICK <username> [password]" and gives the username to the client if it is free,
+// the client is told with WELCOME (or ERROR), by broadcast like the others
+func (s *Server) handleNick(peer Peer, data string) {
+	fields := strings.Fields(data)
+	if len(fields) < 1 || len(fields) > 2 {
+		fmt.Println("Invalid NICK message", data)
+		return
+	}
+
+	password := ""
+	if len(fields) == 2 {
+		password = fields[1]
+	}
+
+	// the names are shown on the screens of the peers, they can't hold escape sequences
+	if network.Printable(fields[0]) != fields[0] {
+		send(peer, "ERROR", "name "+network.Printable(fields[0])+" : control characters are not allowed")
+		return
+	}
+
+	if err := s.registry.Rename(peer.id, fields[0], password); err != nil {
+		send(peer, "ERROR", "name "+fields[0]+" : "+err.Error())
+	}
+}
+
+// handleRegister reads "REGISTER [password]" and protects the current username of the client,
+// with its identity key or with the password, so it can take it back in its next sessions
+func (s *Server) handleRegister(peer Peer, data string) {
+	password := strings.TrimSpace(data)
+	if strings.ContainsAny(password, " \t") {
+		fmt.Println("Invalid REGISTER message", data)
+		return
+	}
+
+	name, err := s.registry.Protect(peer.id, password)
+	if err != nil {
+		send(peer, "ERROR", "name registration : "+err.Error())
+		return
+	}
+
+	protection := "key"
+	if password != "" {
+		protection = "password"
+	}
+	send(peer, "REGISTERED", name+" "+protection)
+}
+
+// handleJoin adds a room to the rooms of the client, the other clients are told by broadcast
+func (s *Server) handleJoin(peer Peer, data string) {
+	room := strings.TrimSpace(data)
+	if !network.ValidRoomName(room) {
+		fmt.Println("Invalid JOIN message", data)
+		return
+	}
+
+	s.registry.JoinRoom(peer.id, room)
+}
+
+// handlePart removes a room from the rooms of the client, the other clients are told by broadcast
+func (s *Server) handlePart(peer Peer, data string) {
+	s.registry.PartRoom(peer.id, strings.TrimSpace(data))
+}
+
+// broadcast tells the identified clients of this directory about the changes of the registry :
+// the new list of peers when a client joins or leaves, its username and rooms when they change
+// a newly identified client also gets the username and rooms of every other client
+// the clients of the other directories of the cluster are told by their own directory
+// it stops when ctx is done
+func (s *Server) broadcast(ctx context.Context, events <-chan Event) {
+	for {
+		var event Event
+		select {
+		case event = <-events:
+		case <-ctx.Done():
+			return
+		}
+		member := event.Peer
+		switch event.Kind {
+		case PeerJoined:
+			others := s.registry.List()
+			for _, p := range others {
+				if p.local() {
+					sendPeers(p, others)
+				}
+			}
+			for _, p := range others {
+				if p.id != member.id {
+					if member.local() {
+						send(member, "NAME", p.chatAddress+" "+p.pseudo)
+						sendRooms(member, p)
+					}
+					if p.local() {
+						send(p, "NAME", member.chatAddress+" "+member.pseudo)
+						sendRooms(p, member)
+					}
+				}
+			}
+		case PeerLeft:
+			others := s.registry.List()
+			for _, p := range others {
+				if p.local() {
+					sendPeers(p, others)
+				}
+			}
+		case PeerRenamed:
+			if member.local() {
+				send(member, "WELCOME", member.pseudo)
+			}
+			if !member.identified() {
+				continue
+			}
+			for _, p := range s.registry.List() {
+				if p.local() && p.id != member.id {
+					send(p, "NAME", member.chatAddress+" "+member.pseudo)
+				}
+			}
+		case PeerRoomsChanged:
+			for _, p := range s.registry.List() {
+				if p.local() && p.id != member.id {
+					sendRooms(p, member)
+				}
+			}
+		case PeerKicked:
+			if member.local() {
+				go refuse(member.conn, "kicked", event.Text)
+			}
+		case PeerBanned:
+			if member.local() {
+				go refuse(member.conn, "banned", event.Text)
+			}
+		case Notice:
+			for _, p := range s.registry.Clients() {
+				if p.local() {
+					send(p, "NOTICE", event.Text)
+				}
+			}
+		case Resync:
+			s.resync()
+		}
+	}
+}
+
+// resync sends the whole list of peers, with their usernames and rooms, to every identified client of this directory
+func (s *Server) resync() {
+	list := s.registry.List()
+	for _, p := range list {
+		if !p.local() {
+			continue
+		}
+		sendPeers(p, list)
+		for _, member := range list {
+			if member.id != p.id {
+				send(p, "NAME", member.chatAddress+" "+member.pseudo)
+				sendRooms(p, member)
+			}
+		}
+	}
+}
+
+// sendRooms sends "ROOMS <chatAddress> [#room ...]" with the rooms of member to peer
+func sendRooms(peer Peer, member Peer) {
+	send(peer, "ROOMS", strings.TrimSpace(member.chatAddress+" "+strings.Join(member.sortedRooms(), " ")))
+}
+
+// sendPeers sends "PEERS <chatAddress>,<publicKey> ..." with every member of list except peer itself
+func sendPeers(peer Peer, list []Peer) {
+	peersList := ""
+	for _, p := range list {
+		if p.id != peer.id {
+			peersList = peersList + p.chatAddress + "," + p.publicKey + " "
+		}
+	}
+
+	send(peer, "PEERS", peersList)
+}
+
+// send queues a message for the client, it is written by writeQueue, so a slow client never holds back the others
+// a client which lets its queue fill up is disconnected, and unregistered
+func send(peer Peer, msgType string, data string) error {
+	select {
+	case peer.outbox <- network.Message{Kind: msgType, Data: data}:
+		return nil
+	default:
+		fmt.Println("Disconnecting", peer.address, ":", errSlowClient)
+		peer.conn.Close()
+		return errSlowClient
+	}
+}
+
+// writeQueue writes the messages queued for the client until done is closed,
+// the connection is closed if a write fails or takes more than writeTimeout, so the client is unregistered
+func writeQueue(peer Peer, done <-chan struct{}) {
+	for {
+		select {
+		case message := <-peer.outbox:
+			peer.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := peer.conn.Send(message); err != nil {
+				fmt.Println("Error writing socket ", err)
+				peer.conn.Close()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,578 @@
+package gossip
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teanan/GOssip-TP/chat"
+	"github.com/teanan/GOssip-TP/dht"
+	"github.com/teanan/GOssip-TP/history"
+	"github.com/teanan/GOssip-TP/network"
+)
+
+// A Node is a peer of the chat which can be embedded in a program : the command line client is one,
+// and a test can run several of them in the same process, each with its own identity, port and history.
+//
+//	node, err := gossip.NewNode(gossip.Config{Identity: key, Port: 9001, Directories: []string{"127.0.0.1:8080"}, HistoryDir: dir})
+//	events := node.Subscribe()
+//	node.Start(ctx)
+//	node.Send("#general", "hello")
+//
+// Everything the command line client prints is also an Output event.
+//
+// When the node stops, it sends the messages still queued for each peer and a BYE (within Config.ShutdownTimeout),
+// then says BYE to the directory and closes its sockets.
+
+const (
+	outputQueueSize        = 256 // messages waiting to be printed (or turned into Output events)
+	subscriberQueueSize    = 256 // events waiting to be read by a subscriber, the next ones are dropped
+	defaultShutdownTimeout = 3 * time.Second
+)
+
+var (
+	ErrNotStarted     = errors.New("the node is not started")
+	ErrStopped        = errors.New("the node is stopped")
+	ErrAlreadyStarted = errors.New("the node is already started")
+)
+
+// Config is the configuration of a Node, Identity, Port and HistoryDir are required
+// the node connects to the first of Directories, and fails over to the next ones, it runs without directory if there is none
+// with LAN and no directory, it connects to the first directory server found on the local network
+type Config struct {
+	Identity     ed25519.PrivateKey
+	Port         int      // chat port (TCP, and UDP for the DHT)
+	Directories  []string // addresses ("host:port") of the directory servers of a cluster
+	Username     string   // username asked to the directory server, a guest name is given if it is empty
+	HistoryDir   string   // directory where the chat history is saved
+	Replay       int      // number of messages of the history shown (as Output events) at startup
+	TLS          *network.TLSConfig
+	Heartbeat    network.HeartbeatConfig // network.DefaultHeartbeat if it is zero
+	LAN          bool                    // discover peers and directory servers on the local network
+	DHTBootstrap string                  // address of any DHT node, to find users without the directory
+
+	ShutdownTimeout time.Duration // time allowed to send the queued messages and BYE when the node stops, 3s if zero
+
+	Transport network.Transport // network.TCPTransport if nil, a host of a network.MemoryNetwork in the scenarios
+	LogLevel  network.LogLevel  // messages sent and received traced on the standard output, none if zero (network.LogQuiet)
+}
+
+// EventKind is the kind of an Event
+type EventKind int
+
+const (
+	MessageReceived        EventKind = iota // a message of another peer in a joined room
+	PrivateMessageReceived                  // a private message of another peer, Room is empty
+	PeerJoined                              // a new peer is a member of the chat
+	PeerLeft                                // a peer left the chat, or is dead
+	UsernameChanged                         // the username of the local client changed, Text is the new one
+	Output                                  // a line printed by the command line client, Text is the line (the lines of a history, one per line)
+	DHTBootstrapFailed                      // the DHT node given by Config.DHTBootstrap didn't answer, Text is the error
+)
+
+// Event is something which happened to the node, as delivered to its subscribers
+// From is the username of the sender of a message, Peer is the peer which joined or left
+type Event struct {
+	Kind EventKind
+	Room string
+	From string
+	Text string
+	Time time.Time
+	Peer PeerInfo
+}
+
+// PeerInfo is a peer known by the node
+type PeerInfo struct {
+	Address   string // chat address ("a.b.c.d:0000")
+	Name      string // username, or the address while we don't know it
+	PublicKey ed25519.PublicKey
+	Rooms     []string
+	State     network.ConnectionState
+	Liveness  network.Liveness
+}
+
+// Node is a peer of the chat, see NewNode
+// the command processor, the peer connections and the username are only used by the goroutine of run
+type Node struct {
+	config Config
+	stack  *network.Stack
+
+	store     *history.Store
+	dhtNode   *dht.Node
+	peers     *chat.PeersMap
+	processor *chat.CommandProcessor
+	receiver  *chat.MessageReceiver
+
+	messageOutput    chan string
+	peersList        chan map[string]network.PeerInfo
+	usernames        chan string
+	connectionEvents chan network.ConnectionEvent
+	calls            chan func() // run by the main loop
+	peerConnections  map[string]*network.PeerConnection
+	username         string
+
+	// the network runs until cancel is called, after the queues of the peers were sent
+	networkContext context.Context
+	cancel         context.CancelFunc
+	routines       sync.WaitGroup // the loops of the stack, waited for so the directory gets our BYE
+
+	subscribersMutex sync.Mutex
+	subscribers      []chan Event
+
+	stateMutex sync.Mutex
+	started    bool
+	stop       chan bool // closed by Stop
+	stopOnce   sync.Once
+	done       chan bool // closed when the node is stopped
+}
+
+// NewNode checks config and builds a node, which does nothing until Start
+func NewNode(config Config) (*Node, error) {
+	if len(config.Identity) != ed25519.PrivateKeySize {
+		return nil, errors.New("an Ed25519 identity key is required")
+	}
+	if config.Port <= 0 || config.Port > 65535 {
+		return nil, fmt.Errorf("%d is not a valid port (1 to 65535)", config.Port)
+	}
+	if config.HistoryDir == "" {
+		return nil, errors.New("the history directory is required")
+	}
+	for _, address := range config.Directories {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, fmt.Errorf("%q is not a directory server address \"host:port\"", address)
+		}
+	}
+	if config.Replay < 0 {
+		return nil, errors.New("the number of messages replayed must be 0 or more")
+	}
+	if config.ShutdownTimeout < 0 {
+		return nil, errors.New("the shutdown timeout must be 0 or more")
+	}
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if config.Transport == nil {
+		config.Transport = network.TCPTransport{}
+	}
+
+	stack := network.NewStack(config.Identity)
+	stack.UseTransport(config.Transport)
+	stack.UseLogLevel(config.LogLevel)
+	if config.TLS != nil {
+		stack.UseTLS(config.TLS)
+	}
+	if config.Heartbeat != (network.HeartbeatConfig{}) {
+		if err := stack.UseHeartbeat(config.Heartbeat); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Node{
+		config:           config,
+		stack:            stack,
+		messageOutput:    make(chan string, outputQueueSize),
+		peersList:        make(chan map[string]network.PeerInfo, 5),
+		usernames:        make(chan string, 5),
+		connectionEvents: make(chan network.ConnectionEvent, 64),
+		calls:            make(chan func()),
+		peerConnections:  make(map[string]*network.PeerConnection),
+		stop:             make(chan bool),
+		done:             make(chan bool),
+	}, nil
+}
+
+// PublicKey returns the encoded public key of the identity of the node
+func (n *Node) PublicKey() string {
+	return n.stack.LocalPublicKey()
+}
+
+// Start opens the history and the sockets of the node, and runs it until ctx is done, Stop is called or /quit is typed
+func (n *Node) Start(ctx context.Context) error {
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+
+	select {
+	case <-n.stop:
+		return ErrStopped
+	default:
+	}
+	if n.started {
+		return ErrAlreadyStarted
+	}
+
+	store, err := history.Open(n.config.HistoryDir)
+	if err != nil {
+		return fmt.Errorf("failed to open history : %v", err)
+	}
+
+	// the DHT node listens on the UDP port with the number of our chat port, it finds users outside of the peers map
+	dhtConn, err := n.config.Transport.ListenPacket(":" + strconv.Itoa(n.config.Port))
+	if err != nil {
+		store.Close()
+		return fmt.Errorf("failed to start DHT node : %v", err)
+	}
+	dhtNode, err := dht.NewNode(n.config.Identity, dhtConn)
+	if err != nil {
+		dhtConn.Close()
+		store.Close()
+		return fmt.Errorf("failed to start DHT node : %v", err)
+	}
+
+	n.store = store
+	n.dhtNode = dhtNode
+	n.peers = chat.NewPeersMap()
+	gossip := chat.NewGossip(n.stack, n.peers)
+	n.processor = chat.NewCommandProcessor(n.stack, n.peers, gossip, store, n.messageOutput)
+	n.receiver = chat.NewMessageReceiver(n.stack, n.peers, gossip, store, n.messageOutput)
+	n.processor.UseNameService(dhtNode)
+	dhtNode.UseOwnerCheck(func(name string, publicKey ed25519.PublicKey) bool {
+		// the names of the peers are given by the directory, the ones they claim themselves are qualified by their key
+		found, peer := n.peers.FindByName(name)
+		return found && peer.PublicKey().Equal(publicKey)
+	})
+	n.receiver.OnDelivery(n.delivered)
+	n.started = true
+
+	// the network is not stopped by ctx directly : the peers must be told that we leave first
+	n.networkContext, n.cancel = context.WithCancel(context.Background())
+
+	n.spawn(dhtNode.Run)
+	if n.config.DHTBootstrap != "" {
+		n.spawn(func(ctx context.Context) {
+			if err := dhtNode.Bootstrap(n.config.DHTBootstrap); err != nil && ctx.Err() == nil {
+				n.publish(Event{Kind: DHTBootstrapFailed, Text: err.Error(), Time: time.Now()})
+			}
+		})
+	}
+
+	replayed := n.processor.ReplayHistory(n.config.Replay)
+
+	n.spawn(func(ctx context.Context) { n.stack.Listen(ctx, n.config.Port, n.peers, n.receiver) })
+	n.spawn(func(ctx context.Context) { n.stack.RunMembership(ctx, n.peers, n.peersList) })
+
+	if n.config.Username != "" {
+		n.stack.RequestName(n.config.Username, "")
+	}
+	if n.config.LAN {
+		discovered := make(chan string, 1)
+		n.spawn(func(ctx context.Context) { n.stack.DiscoverLAN(ctx, n.config.Port, discovered) })
+
+		if len(n.config.Directories) == 0 {
+			n.spawn(func(ctx context.Context) { n.connectToDiscoveredDirectory(ctx, discovered) })
+		}
+	}
+	if len(n.config.Directories) > 0 {
+		n.spawn(func(ctx context.Context) {
+			n.stack.ConnectToDirectory(ctx, n.config.Directories, n.config.Port, n.usernames)
+		})
+	}
+
+	go n.run(ctx, replayed)
+	return nil
+}
+
+// Stop stops the node and waits until it is stopped, the channels returned by Subscribe are closed
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.stop)
+	})
+
+	n.stateMutex.Lock()
+	started := n.started
+	n.stateMutex.Unlock()
+
+	if started {
+		<-n.done
+	} else {
+		n.finish()
+	}
+}
+
+// Done returns a channel which is closed once the node is stopped
+func (n *Node) Done() <-chan bool {
+	return n.done
+}
+
+// Send sends text to the members of room, which must have been joined (the node joins #general when it starts)
+func (n *Node) Send(room string, text string) error {
+	var err error
+	callErr := n.call(func() {
+		err = n.processor.Say(room, text)
+	})
+	if callErr != nil {
+		return callErr
+	}
+	return err
+}
+
+// Command handles a line typed by the user : a slash command ("/join #room", "/msg user text"...),
+// or a message sent to the current room
+func (n *Node) Command(text string) error {
+	return n.call(func() {
+		n.processor.Process(text)
+	})
+}
+
+// Subscribe returns a channel on which the next events of the node are delivered
+// a subscriber which doesn't keep up misses the events which don't fit in its queue
+func (n *Node) Subscribe() <-chan Event {
+	events := make(chan Event, subscriberQueueSize)
+
+	n.subscribersMutex.Lock()
+	defer n.subscribersMutex.Unlock()
+
+	select {
+	case <-n.done:
+		close(events)
+	default:
+		n.subscribers = append(n.subscribers, events)
+	}
+	return events
+}
+
+// Peers returns the peers known by the node, sorted by username
+func (n *Node) Peers() []PeerInfo {
+	n.stateMutex.Lock()
+	peers := n.peers
+	n.stateMutex.Unlock()
+	if peers == nil {
+		return nil
+	}
+
+	list := peers.List()
+	infos := make([]PeerInfo, 0, len(list))
+	for _, peer := range list {
+		infos = append(infos, peerInfo(peer))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// StatusList returns a line for each known peer with its username, rooms and liveness, as shown in the webui
+func (n *Node) StatusList() []string {
+	n.stateMutex.Lock()
+	peers := n.peers
+	n.stateMutex.Unlock()
+	if peers == nil {
+		return nil
+	}
+	return peers.StatusList()
+}
+
+// call runs f in the main loop, and waits until it is done
+func (n *Node) call(f func()) error {
+	n.stateMutex.Lock()
+	started := n.started
+	n.stateMutex.Unlock()
+	if !started {
+		return ErrNotStarted
+	}
+
+	finished := make(chan bool)
+	select {
+	case n.calls <- func() { f(); close(finished) }:
+	case <-n.done:
+		return ErrStopped
+	}
+	<-finished
+	return nil
+}
+
+// run is the main loop of the node, it handles the changes of the members and of the connections, the calls
+// and the messages to print, until the node is stopped
+// replayed are the lines of the history shown at startup, printed first
+func (n *Node) run(ctx context.Context, replayed []string) {
+	defer n.shutdown()
+
+	n.output(replayed...)
+
+	for {
+		select {
+
+		case <-ctx.Done():
+			return
+
+		case <-n.stop:
+			return
+
+		case <-n.processor.Quit():
+			return
+
+		case f := <-n.calls: // Send or Command
+			f()
+			n.output(n.processor.HistoryLines()...)
+			n.checkUsername()
+
+		case newList := <-n.peersList: // New peers list from the membership
+			n.peers.SetNewPeersList(newList, n.onPeerConnected, n.onPeerDisconnected)
+
+			// Any known peer is a DHT node
+			for addr, info := range newList {
+				n.dhtNode.AddContact(info.PublicKey, addr)
+			}
+
+		case event := <-n.connectionEvents: // An outgoing connection was opened or lost, or the liveness of a peer changed
+			n.receiver.HandleConnectionEvent(event)
+
+		case name := <-n.usernames: // Assigned username from discovery server
+			n.processor.SetUsername(name)
+			n.checkUsername()
+
+		case message := <-n.messageOutput: // New message to print on the screen
+			if message == chat.ClearScreen {
+				n.publish(Event{Kind: Output, Text: message, Time: time.Now()})
+			} else {
+				n.output(message)
+			}
+		}
+	}
+}
+
+// output publishes lines to print on the screen, in a single Output event so a subscriber gets all of them or none
+func (n *Node) output(lines ...string) {
+	if len(lines) == 0 {
+		return
+	}
+	// the lines hold the texts and names sent by the peers, they must not break lines or send escape sequences
+	for i, line := range lines {
+		lines[i] = network.Printable(line)
+	}
+	n.publish(Event{Kind: Output, Text: strings.Join(lines, "\n"), Time: time.Now()})
+}
+
+// spawn runs a loop of the stack until the network is stopped
+func (n *Node) spawn(loop func(ctx context.Context)) {
+	n.routines.Add(1)
+	go func() {
+		defer n.routines.Done()
+		loop(n.networkContext)
+	}()
+}
+
+// shutdown closes everything opened by Start, once the main loop is over :
+// the queued messages and BYE are sent to every peer at the same time, then the directory is told BYE
+func (n *Node) shutdown() {
+	n.stopOnce.Do(func() {
+		close(n.stop)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.config.ShutdownTimeout)
+	var connections sync.WaitGroup
+	for address, connection := range n.peerConnections {
+		connections.Add(1)
+		go func(connection *network.PeerConnection) {
+			defer connections.Done()
+			connection.Shutdown(ctx)
+		}(connection)
+		delete(n.peerConnections, address)
+	}
+	connections.Wait()
+	cancel()
+
+	n.cancel()
+	n.routines.Wait()
+	n.dhtNode.Close()
+	n.store.Close()
+	n.finish()
+}
+
+// finish closes the channels of the subscribers, and tells that the node is stopped
+func (n *Node) finish() {
+	n.subscribersMutex.Lock()
+	defer n.subscribersMutex.Unlock()
+
+	select {
+	case <-n.done:
+		return
+	default:
+	}
+	for _, events := range n.subscribers {
+		close(events)
+	}
+	n.subscribers = nil
+	close(n.done)
+}
+
+func (n *Node) onPeerConnected(peer network.Peer) {
+	// Open the outgoing connection used to send (and relay) messages to this peer
+	connection := n.stack.NewPeerConnection(peer, n.config.Port, n.connectionEvents)
+	n.peerConnections[peer.FullAddress()] = connection
+	connection.Start(n.networkContext)
+
+	// Get the messages sent while we were away, the summary is sent once the connection is open
+	n.receiver.SyncHistory(peer)
+
+	n.publish(Event{Kind: PeerJoined, From: peer.String(), Time: time.Now(), Peer: peerInfo(peer)})
+}
+
+func (n *Node) onPeerDisconnected(peer network.Peer) {
+	// Close the outgoing connection, the peer left
+	if connection, found := n.peerConnections[peer.FullAddress()]; found {
+		connection.Stop()
+		delete(n.peerConnections, peer.FullAddress())
+	}
+
+	n.publish(Event{Kind: PeerLeft, From: peer.String(), Time: time.Now(), Peer: peerInfo(peer)})
+}
+
+// delivered turns a message shown to the local client into an event, it is called by the message receiver
+func (n *Node) delivered(delivery chat.Delivery) {
+	event := Event{Kind: MessageReceived, Room: delivery.Room, From: delivery.Origin, Text: delivery.Text, Time: delivery.Time}
+	if delivery.Room == "" {
+		event.Kind = PrivateMessageReceived
+	}
+	n.publish(event)
+}
+
+// checkUsername publishes UsernameChanged if the username of the local client changed
+// (given by the directory, or chosen with /nick without directory)
+func (n *Node) checkUsername() {
+	username := n.peers.GetLocalUsername()
+	if username == n.username {
+		return
+	}
+	n.username = username
+	n.publish(Event{Kind: UsernameChanged, Text: username, Time: time.Now()})
+}
+
+// connectToDiscoveredDirectory connects to the first directory server announced on the local network
+func (n *Node) connectToDiscoveredDirectory(ctx context.Context, discovered <-chan string) {
+	select {
+	case address := <-discovered:
+		n.stack.ConnectToDirectory(ctx, []string{address}, n.config.Port, n.usernames)
+	case <-ctx.Done():
+	}
+}
+
+// publish delivers an event to every subscriber, without blocking
+func (n *Node) publish(event Event) {
+	n.subscribersMutex.Lock()
+	defer n.subscribersMutex.Unlock()
+
+	for _, events := range n.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+func peerInfo(peer network.Peer) PeerInfo {
+	return PeerInfo{
+		Address:   peer.FullAddress(),
+		Name:      peer.String(),
+		PublicKey: peer.PublicKey(),
+		Rooms:     peer.Rooms(),
+		State:     peer.ConnectionState(),
+		Liveness:  peer.Liveness(),
+	}
+}
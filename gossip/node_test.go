@@ -0,0 +1,174 @@
+package gossip
+
+import (
+	"context"
+	"crypto/ed25519"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teanan/GOssip-TP/history"
+	"github.com/teanan/GOssip-TP/network"
+)
+
+// more messages than the output queue, and the queue of a subscriber, hold
+const testHistorySize = 2 * outputQueueSize
+
+// newTestNode returns a node whose history holds testHistorySize messages of #general
+func newTestNode(t *testing.T, replay int) *Node {
+	dir := t.TempDir()
+	store, err := history.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < testHistorySize; i++ {
+		_, err := store.Append(history.Entry{
+			ID:           "id" + strconv.Itoa(i),
+			Time:         start.Add(time.Duration(i) * time.Second),
+			Conversation: "#general",
+			Origin:       "alice",
+			Text:         "old message " + strconv.Itoa(i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	_, key, _ := ed25519.GenerateKey(nil)
+	node, err := NewNode(Config{
+		Identity:   key,
+		Port:       9000,
+		HistoryDir: dir,
+		Replay:     replay,
+		Transport:  network.NewMemoryNetwork(1).Host("10.0.0.1"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+// countHistory counts the Output events showing an old message, until there are none for a while
+func countHistory(events <-chan Event) <-chan int {
+	counted := make(chan int, 1)
+	go func() {
+		count := 0
+		for {
+			select {
+			case event := <-events:
+				if event.Kind == Output {
+					count += strings.Count(event.Text, "old message")
+				}
+			case <-time.After(500 * time.Millisecond):
+				counted <- count
+				return
+			}
+		}
+	}()
+	return counted
+}
+
+func TestReplayLongHistory(t *testing.T) {
+	node := newTestNode(t, testHistorySize)
+	counted := countHistory(node.Subscribe())
+
+	started := make(chan error)
+	go func() {
+		started <- node.Start(context.Background())
+	}()
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start is blocked by the replayed history")
+	}
+	defer node.Stop()
+
+	if count := <-counted; count != testHistorySize {
+		t.Errorf("%d messages replayed, want %d", count, testHistorySize)
+	}
+}
+
+func TestShowLongHistory(t *testing.T) {
+	node := newTestNode(t, 0)
+	events := node.Subscribe()
+	if err := node.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer node.Stop()
+
+	counted := countHistory(events)
+	shown := make(chan error)
+	go func() {
+		shown <- node.Command("/history #general " + strconv.Itoa(testHistorySize))
+	}()
+	select {
+	case err := <-shown:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("/history blocks the node")
+	}
+
+	if count := <-counted; count != testHistorySize {
+		t.Errorf("%d messages shown, want %d", count, testHistorySize)
+	}
+}
+
+func TestDHTBootstrapFailure(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	node, err := NewNode(Config{
+		Identity:     key,
+		Port:         9000,
+		HistoryDir:   t.TempDir(),
+		Transport:    network.NewMemoryNetwork(1).Host("10.0.0.1"),
+		DHTBootstrap: "10.0.0.2:9000", // nobody answers
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := node.Subscribe()
+	if err := node.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for failed := false; !failed; {
+		select {
+		case event := <-events:
+			failed = event.Kind == DHTBootstrapFailed
+		case <-timeout:
+			t.Fatal("the bootstrap failure was not published")
+		}
+	}
+
+	stopped := make(chan bool)
+	go func() {
+		node.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waits for the DHT node")
+	}
+}
+
+func TestInvalidDirectoryIsRefused(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	_, err := NewNode(Config{
+		Identity:    key,
+		Port:        9000,
+		HistoryDir:  t.TempDir(),
+		Directories: []string{""},
+	})
+	if err == nil {
+		t.Error("an empty directory server address was accepted")
+	}
+}
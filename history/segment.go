@@ -0,0 +1,246 @@
+package history
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	maxSegmentSize = 1 << 20 // size of a segment after which a new one is started
+
+	// entries are appended when they arrive, so they are only roughly sorted by their (origin) timestamp
+	// searches by time start this much earlier and filter the entries
+	maxClockSkew = int64(5 * time.Minute)
+)
+
+// indexEntry is a record of the index of a segment : the timestamp of an entry and its offset in the log file
+// the index is stored next to the log, as a sequence of (timestamp, offset) pairs of 8 bytes each
+type indexEntry struct {
+	Time   int64
+	Offset int64
+}
+
+const indexEntrySize = 16
+
+// segment is one file of the log of a conversation, and its index
+// only the last segment of a conversation is opened for writing
+type segment struct {
+	number int
+	path   string
+	size   int64
+	index  []indexEntry
+	log    *os.File
+	idx    *os.File
+}
+
+func segmentPaths(dir string, number int) (string, string) {
+	name := fmt.Sprintf("%06d", number)
+	return filepath.Join(dir, name+".log"), filepath.Join(dir, name+".idx")
+}
+
+// openSegment loads the index of a segment, and rebuilds it from the log if it is missing or incomplete
+func openSegment(dir string, number int) (*segment, error) {
+	logPath, idxPath := segmentPaths(dir, number)
+
+	info, err := os.Stat(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	seg := &segment{number: number, path: logPath}
+	if info != nil {
+		seg.size = info.Size()
+	}
+
+	seg.index, err = readIndex(idxPath)
+	if err != nil || !seg.indexComplete() {
+		if seg.index, seg.size, err = rebuildIndex(logPath, idxPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return seg, nil
+}
+
+// indexComplete returns true if the last indexed entry is the last entry of the log
+func (seg *segment) indexComplete() bool {
+	if len(seg.index) == 0 {
+		return seg.size == 0
+	}
+
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(seg.index[len(seg.index)-1].Offset, io.SeekStart); err != nil {
+		return false
+	}
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	return err == nil && seg.index[len(seg.index)-1].Offset+int64(len(line)) == seg.size
+}
+
+// append writes an entry at the end of the segment and indexes it
+func (seg *segment) append(entry Entry) error {
+	if seg.log == nil {
+		logPath, idxPath := segmentPaths(filepath.Dir(seg.path), seg.number)
+
+		var err error
+		if seg.log, err = os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+			return err
+		}
+		if seg.idx, err = os.OpenFile(idxPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+			return err
+		}
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if _, err := seg.log.Write(line); err != nil {
+		return err
+	}
+
+	record := indexEntry{Time: entry.Time.UnixNano(), Offset: seg.size}
+	raw := make([]byte, indexEntrySize)
+	binary.BigEndian.PutUint64(raw, uint64(record.Time))
+	binary.BigEndian.PutUint64(raw[8:], uint64(record.Offset))
+	if _, err := seg.idx.Write(raw); err != nil {
+		return err
+	}
+
+	seg.index = append(seg.index, record)
+	seg.size += int64(len(line))
+	return nil
+}
+
+// read returns the entries of the segment starting at the position-th one
+func (seg *segment) read(position int) ([]Entry, error) {
+	entries := make([]Entry, 0)
+	if position >= len(seg.index) {
+		return entries, nil
+	}
+
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(seg.index[position].Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	for i := position; i < len(seg.index); i++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// search returns the position from which the entries may be at or after t
+func (seg *segment) search(t int64) int {
+	return sort.Search(len(seg.index), func(i int) bool {
+		return seg.index[i].Time >= t-maxClockSkew
+	})
+}
+
+// lastTime returns the greatest timestamp of the segment
+func (seg *segment) lastTime() int64 {
+	last := int64(0)
+	for _, record := range seg.index {
+		if record.Time > last {
+			last = record.Time
+		}
+	}
+	return last
+}
+
+func (seg *segment) close() {
+	if seg.log != nil {
+		seg.log.Close()
+		seg.idx.Close()
+		seg.log, seg.idx = nil, nil
+	}
+}
+
+func readIndex(path string) ([]indexEntry, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make([]indexEntry, 0, len(raw)/indexEntrySize)
+	for len(raw) >= indexEntrySize {
+		index = append(index, indexEntry{
+			Time:   int64(binary.BigEndian.Uint64(raw)),
+			Offset: int64(binary.BigEndian.Uint64(raw[8:])),
+		})
+		raw = raw[indexEntrySize:]
+	}
+	return index, nil
+}
+
+// rebuildIndex scans the log of a segment and writes its index again, it returns the index and the size of the log
+// an incomplete entry at the end of the log (after a crash) is truncated
+func rebuildIndex(logPath string, idxPath string) ([]indexEntry, int64, error) {
+	index := make([]indexEntry, 0)
+
+	file, err := os.Open(logPath)
+	if os.IsNotExist(err) {
+		return index, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reader := bufio.NewReader(file)
+	offset := int64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+
+		var entry Entry
+		if json.Unmarshal(line, &entry) != nil {
+			break
+		}
+
+		index = append(index, indexEntry{Time: entry.Time.UnixNano(), Offset: offset})
+		offset += int64(len(line))
+	}
+	file.Close()
+
+	if err := os.Truncate(logPath, offset); err != nil {
+		return nil, 0, err
+	}
+
+	raw := make([]byte, 0, len(index)*indexEntrySize)
+	for _, record := range index {
+		raw = binary.BigEndian.AppendUint64(raw, uint64(record.Time))
+		raw = binary.BigEndian.AppendUint64(raw, uint64(record.Offset))
+	}
+	return index, offset, os.WriteFile(idxPath, raw, 0600)
+}
@@ -0,0 +1,254 @@
+package history
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a message stored in the history
+// Conversation is a room ("#room") or a private conversation ("@username")
+// Key and Signature are the key of the author of a room message and its signature, so the peers it is synchronized with can check it
+type Entry struct {
+	ID           string    `json:"id"`
+	Time         time.Time `json:"time"`
+	Conversation string    `json:"conversation"`
+	Origin       string    `json:"origin"`
+	Text         string    `json:"text"`
+	Key          string    `json:"key,omitempty"`
+	Signature    string    `json:"signature,omitempty"`
+}
+
+// Store is an append-only history of messages, with one log per conversation.
+// The log of a conversation is split in segments ("000001.log", "000002.log", ...)
+// and every segment has an index of the timestamps of its entries ("000001.idx").
+type Store struct {
+	mutex         sync.Mutex
+	dir           string
+	conversations map[string][]*segment
+	ids           map[string]bool
+}
+
+// Open loads the history stored in dir, which is created if it doesn't exist
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	store := &Store{
+		dir:           dir,
+		conversations: make(map[string][]*segment),
+		ids:           make(map[string]bool),
+	}
+
+	dirs, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		conversation, err := url.PathUnescape(d.Name())
+		if err != nil {
+			continue
+		}
+		if err := store.load(conversation); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+// load opens the segments of a conversation, and remembers the IDs of its entries
+func (store *Store) load(conversation string) error {
+	dir := store.conversationDir(conversation)
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	numbers := make([]int, 0)
+	for _, file := range files {
+		if number, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".log")); err == nil && strings.HasSuffix(file.Name(), ".log") {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Ints(numbers)
+
+	for _, number := range numbers {
+		seg, err := openSegment(dir, number)
+		if err != nil {
+			return err
+		}
+		store.conversations[conversation] = append(store.conversations[conversation], seg)
+
+		entries, err := seg.read(0)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			store.ids[entry.ID] = true
+		}
+	}
+
+	return nil
+}
+
+// Append adds an entry at the end of the log of its conversation
+// it returns false if an entry with the same ID is already stored
+func (store *Store) Append(entry Entry) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.ids[entry.ID] {
+		return false, nil
+	}
+
+	segments := store.conversations[entry.Conversation]
+	if len(segments) == 0 || segments[len(segments)-1].size >= maxSegmentSize {
+		dir := store.conversationDir(entry.Conversation)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return false, err
+		}
+
+		number := 1
+		if len(segments) > 0 {
+			segments[len(segments)-1].close()
+			number = segments[len(segments)-1].number + 1
+		}
+
+		seg, err := openSegment(dir, number)
+		if err != nil {
+			return false, err
+		}
+		segments = append(segments, seg)
+		store.conversations[entry.Conversation] = segments
+	}
+
+	if err := segments[len(segments)-1].append(entry); err != nil {
+		return false, err
+	}
+
+	store.ids[entry.ID] = true
+	return true, nil
+}
+
+// Has returns true if an entry with this ID is stored
+func (store *Store) Has(id string) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.ids[id]
+}
+
+// Last returns the last n entries of a conversation, or of every conversation if conversation is empty
+func (store *Store) Last(conversation string, n int) ([]Entry, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	entries := make([]Entry, 0)
+	for _, name := range store.names(conversation) {
+		segments := store.conversations[name]
+
+		// read segments from the end until we have n entries of this conversation
+		found := make([]Entry, 0)
+		for i := len(segments) - 1; i >= 0 && len(found) < n; i-- {
+			position := len(segments[i].index) - (n - len(found))
+			if position < 0 {
+				position = 0
+			}
+
+			read, err := segments[i].read(position)
+			if err != nil {
+				return nil, err
+			}
+			found = append(read, found...)
+		}
+		entries = append(entries, found...)
+	}
+
+	sortEntries(entries)
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries, nil
+}
+
+// Since returns the entries of a conversation (or of every conversation if conversation is empty) at or after t
+func (store *Store) Since(conversation string, t time.Time) ([]Entry, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	entries := make([]Entry, 0)
+	for _, name := range store.names(conversation) {
+		for _, seg := range store.conversations[name] {
+			if seg.lastTime() < t.UnixNano() {
+				continue
+			}
+
+			read, err := seg.read(seg.search(t.UnixNano()))
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range read {
+				if !entry.Time.Before(t) {
+					entries = append(entries, entry)
+				}
+			}
+		}
+	}
+
+	sortEntries(entries)
+	return entries, nil
+}
+
+// Conversations returns the names of the stored conversations
+func (store *Store) Conversations() []string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.names("")
+}
+
+// Close closes the files opened for writing
+func (store *Store) Close() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, segments := range store.conversations {
+		for _, seg := range segments {
+			seg.close()
+		}
+	}
+}
+
+// names returns conversation, or every stored conversation if it is empty
+func (store *Store) names(conversation string) []string {
+	if conversation != "" {
+		return []string{conversation}
+	}
+
+	names := make([]string, 0, len(store.conversations))
+	for name := range store.conversations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (store *Store) conversationDir(conversation string) string {
+	return filepath.Join(store.dir, url.PathEscape(conversation))
+}
+
+func sortEntries(entries []Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+}
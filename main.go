@@ -2,71 +2,171 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"flag"
 	"fmt"
 	"math/rand"
+	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/teanan/GOssip-TP/browser"
 	"github.com/teanan/GOssip-TP/chat"
+	"github.com/teanan/GOssip-TP/config"
+	"github.com/teanan/GOssip-TP/gossip"
 	"github.com/teanan/GOssip-TP/network"
 )
 
 var (
-	chatPort        int           // local port for incoming chat messages
-	directoryPort   = 8080        // port of the directory server to connect to
-	directoryServer = "127.0.0.1" // ip of the directory server to connect to
+	directories = []string{"127.0.0.1:8080"} // addresses of the directory servers to connect to, tried in turn
 
-	messageOutputChannel = make(chan string, 5) // queue of messages to print on the local screen
+	port          = flag.Int("port", 0, "chat port (TCP, and UDP for the DHT), 0 for a random port between 9000 and 9999")
+	browserPort   = flag.Int("browser-port", 0, "port of the webpage with -browser, 0 for a random port between 13000 and 13999")
+	directoryList = flag.String("directories", "", "directory servers (\"host[:port],host[:port]\"), the arguments are used instead if there are any")
+	username      = flag.String("username", "", "username asked to the directory server when we connect")
+	logLevel      = flag.String("log-level", "info", "messages traced : quiet, info (all but the periodic ones) or debug (all)")
+
+	tlsDir       = flag.String("tls", "", "directory of the keys generated by keygen, enables TLS")
+	directoryPin = flag.String("directory-pin", "", "SHA-256 fingerprint of the directory server certificate")
+	identityFile = flag.String("identity", "identity.key", "file of the Ed25519 identity key, created if it doesn't exist")
+	useBrowser   = flag.Bool("browser", false, "open the chat in a web browser")
+	dhtBootstrap = flag.String("dht-bootstrap", "", "address of any DHT node (\"a.b.c.d:0000\", a peer chat address) to find users without the directory")
+	useLAN       = flag.Bool("lan", false, "discover peers and directory servers on the local network (the directory argument is optional)")
+	historyDir   = flag.String("history", "chat-history", "directory where the chat history is saved")
+	replayLength = flag.Int("replay", 20, "number of messages of the history shown at startup")
+
+	heartbeatInterval = flag.Duration("heartbeat", network.DefaultHeartbeat.Interval, "interval between two PING to each peer")
+	suspectTimeout    = flag.Duration("suspect-timeout", network.DefaultHeartbeat.SuspectTimeout, "time without PONG after which a peer is suspected")
+	deadTimeout       = flag.Duration("dead-timeout", network.DefaultHeartbeat.DeadTimeout, "time without PONG after which a peer is dead, and its connection opened again")
 )
 
 func main() {
-	fmt.Println("== GOssip ==")
+	// "gossip keygen [dir]" generates the TLS keys
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		keygen(os.Args[2:])
+		return
+	}
 
-	// Selecting a random local port
-	rand.Seed(time.Now().UnixNano())
-	chatPort = 9000 + rand.Intn(1000)
+	// The settings come from the command line, the environment ($GOSSIP_<FLAG>) and the config file (-config)
+	if err := config.Load(flag.CommandLine, os.Args[1:], "GOSSIP"); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
 
-	// If the program as arguments, read a new directoryServer IP
-	if len(os.Args) > 1 {
-		directoryServer = os.Args[1]
+	// If the program as arguments, read the directory servers ("a.b.c.d" or "a.b.c.d:0000", separated by spaces or commas)
+	directoriesGiven := flag.NArg() > 0 || *directoryList != ""
+	if flag.NArg() > 0 {
+		directories = directoryAddresses(flag.Args())
+	} else if *directoryList != "" {
+		directories = directoryAddresses([]string{*directoryList})
 	}
 
-	fmt.Println("Listening on port", chatPort)
+	if err := validateSettings(); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	level, _ := network.ParseLogLevel(*logLevel)
+
+	fmt.Println("== GOssip ==")
+
+	// Ctrl+C and SIGTERM stop the client cleanly : the peers and the directory are told that we leave
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Selecting a random local port, unless it is given
+	rand.Seed(time.Now().UnixNano())
+	chatPort := *port
+	if chatPort == 0 {
+		chatPort = 9000 + rand.Intn(1000)
+	}
 
-	/* Question 4
-	browserPort := 13000 + rand.Intn(1000)
-	webpage, err := browser.Connect("localhost", browserPort)
+	identity, err := network.LoadIdentity(*identityFile)
 	if err != nil {
-		log.Fatal(err)
-		return
+		fmt.Println("Failed to load identity key", err)
+		os.Exit(1)
 	}
-	fmt.Println("Successfuly connected to browser webpage")
-	*/
 
-	// Create channels to receive a new list of peers addresses, and a new username
-	peersListChannel := make(chan map[string]string, 5)
-	usernameChannel := make(chan string, 5)
+	var tlsConfig *network.TLSConfig
+	if *tlsDir != "" {
+		tlsConfig, err = network.LoadTLS(*tlsDir, *directoryPin)
+		if err != nil {
+			fmt.Println("Failed to load TLS keys", err)
+			os.Exit(1)
+		}
+		fmt.Println("TLS enabled")
+	}
 
-	// Create a new PeersMap to store known peers
-	peersMap := chat.NewPeersMap()
+	// with -lan and no directory server given, the node connects to the first directory server found on the local network
+	nodeDirectories := directories
+	if *useLAN && !directoriesGiven {
+		nodeDirectories = nil
+	}
 
-	// Create CommandProcessor and MessageReceiver to handle outgoing and incoming messages
-	commandProcessor := chat.NewCommandProcessor(peersMap, messageOutputChannel)
-	messageReceiver := chat.NewMessageReceiver(peersMap, messageOutputChannel)
+	node, err := gossip.NewNode(gossip.Config{
+		Identity:     identity,
+		Port:         chatPort,
+		Directories:  nodeDirectories,
+		Username:     *username,
+		HistoryDir:   *historyDir,
+		Replay:       *replayLength,
+		TLS:          tlsConfig,
+		LAN:          *useLAN,
+		DHTBootstrap: *dhtBootstrap,
+		LogLevel:     level,
+		Heartbeat: network.HeartbeatConfig{
+			Interval:       *heartbeatInterval,
+			SuspectTimeout: *suspectTimeout,
+			DeadTimeout:    *deadTimeout,
+		},
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("Identity", node.PublicKey())
+	fmt.Println("Listening on port", chatPort)
 
-	// Start listening for incoming peers connections
-	go network.Listen(chatPort, peersMap, messageReceiver)
+	// The webpage channels stay nil (and are never selected) without the browser
+	var (
+		browserInput        <-chan string
+		browserDisconnected chan bool
+		webpage             *browser.Webpage
+		peersRefresh        <-chan time.Time
+	)
+	if *useBrowser {
+		webPort := *browserPort
+		if webPort == 0 {
+			webPort = 13000 + rand.Intn(1000)
+		}
+		webpage, err = browser.Connect(ctx, "localhost", webPort)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("Successfuly connected to browser webpage")
+		browserInput = webpage.ReceiveChannel()
+		browserDisconnected = webpage.Disconnected
 
-	// Start connection to the peers directory (which will send us the list of other peers)
-	go network.ConnectToDirectory(directoryServer, directoryPort, chatPort, peersListChannel, usernameChannel)
+		// The peers list of the webpage is refreshed regularly, as names and rooms change without notice
+		peersRefresh = time.NewTicker(*heartbeatInterval).C
+	}
+
+	// Everything the node prints comes as Output events, subscribed before the start to get the replayed history
+	events := node.Subscribe()
+	if err := node.Start(ctx); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer node.Stop()
 
 	// Start reading text from the command line
 	stdin := make(chan string)
-	go readStdin(stdin)
+	go readStdin(ctx, stdin)
 
-	/* Question 4
-	loop:
-	*/
 	for {
 
 		select {
@@ -77,36 +177,105 @@ func main() {
 				return
 			}
 
-			commandProcessor.Process(text)
+			node.Command(text)
+
+		case text := <-browserInput: // New command from the webpage, handled like stdin
+			node.Command(text)
+
+		case <-peersRefresh: // Time to update the peers list of the webpage
+			webpage.SendPeers(node.StatusList())
+
+		case event, ok := <-events: // New message to print on the screen
 
-		case newList := <-peersListChannel: // New peers list from discovery server
-			peersMap.SetNewPeersList(newList, onPeerConnected, onPeerDisconnected)
+			if !ok {
+				return // the node stopped (/quit)
+			}
+			if event.Kind == gossip.DHTBootstrapFailed {
+				event.Text = "Failed to bootstrap DHT " + event.Text
+			} else if event.Kind != gossip.Output {
+				continue
+			}
 
-		case name := <-usernameChannel: // Assigned username from discovery server
-			peersMap.SetLocalUsername(name)
+			if event.Text == chat.ClearScreen {
+				fmt.Print(event.Text)
+			} else {
+				fmt.Println(event.Text)
+			}
+			if webpage != nil {
+				webpage.SendMessage(event.Text)
+			}
 
-		case message := <-messageOutputChannel: // New message to print on the screen
-			fmt.Println(message)
+		case <-browserDisconnected:
+			fmt.Println("Browser webpage has disconnected")
+			return
 
-			/* Question 4
-			case <-webpage.Disconnected:
-				fmt.Println("Browser webpage has disconnected")
-				break loop
-			*/
+		case <-ctx.Done(): // Ctrl+C or SIGTERM, the deferred Stop says goodbye
+			fmt.Println("Leaving the chat")
+			return
 		}
 	}
 }
 
-func onPeerConnected(peer network.Peer) {
-	// Question 2
+// validateSettings checks the flags, and returns an error listing every invalid one
+func validateSettings() error {
+	var v config.Validator
+	v.Port("port", *port, true)
+	v.Port("browser-port", *browserPort, true)
+	for _, address := range directories {
+		v.Address("directories", address)
+	}
+	v.Check(len(directories) > 0 || *useLAN, "-directories : no directory server given, use -lan to find one on the local network")
+	v.Check(!strings.ContainsAny(*username, " \t") && !strings.HasPrefix(*username, "Guest#"),
+		"-username : "+strconv.Quote(*username)+" can't contain spaces or start with Guest#")
+	_, err := network.ParseLogLevel(*logLevel)
+	v.Check(err == nil, "-log-level : "+fmt.Sprint(err))
+	if *tlsDir != "" {
+		v.Dir("tls", *tlsDir)
+	}
+	v.NotDir("identity", *identityFile)
+	v.Check(*historyDir != "", "-history : the history directory is required")
+	v.Check(*replayLength >= 0, "-replay : must be 0 or more")
+	if *dhtBootstrap != "" {
+		v.Address("dht-bootstrap", *dhtBootstrap)
+	}
+	return v.Err()
 }
 
-func onPeerDisconnected(peer network.Peer) {
-	// Question 2
+// directoryAddresses reads the directory servers given as arguments, the port is 8080 if it is missing
+func directoryAddresses(args []string) []string {
+	addresses := make([]string, 0, len(args))
+	for _, arg := range args {
+		for _, address := range strings.Split(arg, ",") {
+			address = strings.TrimSpace(address)
+			if address == "" {
+				continue
+			}
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				address = net.JoinHostPort(address, "8080")
+			}
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
 }
 
-// Routine reading text from the command line
-func readStdin(ch chan string) {
+// keygen generates a CA (if needed) and the certificate of this node in the keys directory
+func keygen(args []string) {
+	dir := "keys"
+	if len(args) > 0 {
+		dir = args[0]
+	}
+
+	if err := network.GenerateKeys(dir); err != nil {
+		fmt.Println("Failed to generate keys", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Keys written in", dir)
+}
+
+// Routine reading text from the command line, until the end of stdin or ctx is done
+func readStdin(ctx context.Context, ch chan string) {
 	reader := bufio.NewReader(os.Stdin)
 
 	for {
@@ -115,6 +284,10 @@ func readStdin(ch chan string) {
 			close(ch)
 			return
 		}
-		ch <- s
+		select {
+		case ch <- strings.TrimRight(s, "\r\n"):
+		case <-ctx.Done():
+			return
+		}
 	}
 }
@@ -0,0 +1,131 @@
+package network
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and runs functions after a delay : a MemoryNetwork times the delays of its links with it.
+// RealClock is the clock of the system, a VirtualClock only moves when it is told to,
+// so a scenario run again with the same seed and the same steps gets the same network.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+// RealClock is the clock of the system
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// AfterFunc runs f in its own goroutine after d, unless stop is called first
+func (RealClock) AfterFunc(d time.Duration, f func()) (stop func() bool) {
+	return time.AfterFunc(d, f).Stop
+}
+
+// VirtualClock is a clock which only moves with Advance : the functions which are due run then, one by one,
+// by due time, and in the order they were scheduled for the same due time
+type VirtualClock struct {
+	advancing sync.Mutex // Advance runs the functions one call at a time
+
+	mutex   sync.Mutex
+	now     time.Time
+	timers  []*virtualTimer
+	nextSeq uint64
+}
+
+// virtualTimer is a function scheduled on a VirtualClock
+type virtualTimer struct {
+	due     time.Time
+	seq     uint64
+	f       func()
+	stopped bool
+}
+
+// NewVirtualClock builds a virtual clock which starts at start
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+// Now returns the time of the clock, which only changes with Advance
+func (c *VirtualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// AfterFunc schedules f at Now() + d, it runs during the call to Advance which reaches this time
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) (stop func() bool) {
+	if d < 0 {
+		d = 0
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	timer := &virtualTimer{due: c.now.Add(d), seq: c.nextSeq, f: f}
+	c.nextSeq++
+	c.timers = append(c.timers, timer)
+
+	return func() bool {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if timer.stopped {
+			return false
+		}
+		timer.stopped = true
+		return true
+	}
+}
+
+// Advance moves the clock forward by d, and runs the functions due in the meantime, in the goroutine of the caller
+// the functions they schedule before the end of the step run too
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.advancing.Lock()
+	defer c.advancing.Unlock()
+
+	c.mutex.Lock()
+	end := c.now.Add(d)
+	c.mutex.Unlock()
+
+	for {
+		c.mutex.Lock()
+		timer := c.nextDue(end)
+		if timer == nil {
+			c.now = end
+			c.mutex.Unlock()
+			return
+		}
+		timer.stopped = true
+		if timer.due.After(c.now) {
+			c.now = timer.due
+		}
+		c.mutex.Unlock()
+
+		timer.f()
+	}
+}
+
+// nextDue removes the stopped timers, and returns the first one due at end at the latest, the lock must be held
+func (c *VirtualClock) nextDue(end time.Time) *virtualTimer {
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if !timer.stopped {
+			pending = append(pending, timer)
+		}
+	}
+	c.timers = pending
+
+	sort.Slice(c.timers, func(i, j int) bool {
+		if !c.timers[i].due.Equal(c.timers[j].due) {
+			return c.timers[i].due.Before(c.timers[j].due)
+		}
+		return c.timers[i].seq < c.timers[j].seq
+	})
+	if len(c.timers) == 0 || c.timers[0].due.After(end) {
+		return nil
+	}
+	return c.timers[0]
+}
@@ -0,0 +1,238 @@
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Wire formats
+//
+// The legacy line protocol sends "KIND data\n" and cannot carry newlines or binary data.
+// The framed protocol prefixes every message with a header :
+//
+//	magic (1 byte) | version (1 byte) | kind length (1 byte) | data length (4 bytes, big endian)
+//
+// followed by the kind and the data.
+// The magic byte is not valid ASCII, so a reader can tell both formats apart from the first byte.
+const (
+	frameMagic      byte = 0xC7 // 'G' with the high bit set
+	FrameVersion    byte = 1    // current version of the framed protocol
+	frameHeaderSize      = 7
+	MaxDataSize          = 1 << 20                   // maximum size of the data of a framed message
+	maxLineSize          = 255 + 1 + MaxDataSize + 1 // maximum size of a legacy line : the kind, a space, the data and the newline
+)
+
+// Codec remembers which wire format is used to write on a connection.
+// Every connection starts with the legacy line protocol, and switches to the framed protocol
+// once both ends agreed on it with a VERSION message :
+// the side that opens the connection sends "VERSION 1" as a legacy line (old peers simply ignore it),
+// the other side answers with a framed VERSION message and both ends upgrade.
+// logLevel tells which of the messages sent are traced
+type Codec struct {
+	mutex    sync.Mutex
+	framed   bool
+	logLevel LogLevel
+}
+
+type frameError struct {
+	reason string
+}
+
+// Framed returns true if the framed protocol has been negotiated
+func (c *Codec) Framed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.framed
+}
+
+func (c *Codec) upgrade() {
+	c.mutex.Lock()
+	c.framed = true
+	c.mutex.Unlock()
+}
+
+// Send writes a message on w, using the negotiated wire format
+func (c *Codec) Send(w io.Writer, m Message) error {
+	var (
+		raw []byte
+		err error
+	)
+
+	if c.Framed() {
+		raw, err = encodeFrame(m)
+		if err != nil {
+			return err
+		}
+	} else {
+		raw = encodeLine(m)
+	}
+
+	if c.logLevel.Logged(m) {
+		fmt.Println("Sent :", m)
+	}
+	_, err = w.Write(raw)
+	return err
+}
+
+// LogLevel tells which messages sent and received are traced on the standard output
+// it is set for each stack (Stack.UseLogLevel) or connection (NewConn), so the nodes of a process can trace differently
+type LogLevel int
+
+const (
+	LogQuiet LogLevel = iota // no message
+	LogInfo                  // every message except the periodic ones (heartbeat and membership probes), which would flood the logs
+	LogDebug                 // every message
+)
+
+// ParseLogLevel reads "quiet", "info" or "debug"
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch s {
+	case "quiet":
+		return LogQuiet, nil
+	case "info":
+		return LogInfo, nil
+	case "debug":
+		return LogDebug, nil
+	}
+	return LogInfo, errors.New("unknown log level " + strconv.Quote(s) + ", expected quiet, info or debug")
+}
+
+// Logged returns true if the message must be traced at this level
+func (level LogLevel) Logged(m Message) bool {
+	switch level {
+	case LogQuiet:
+		return false
+	case LogDebug:
+		return true
+	}
+	return !isHeartbeat(m) && !isMembershipMessage(m)
+}
+
+// Propose starts the version negotiation on a newly opened connection
+// The answer of the remote end must be given to HandleVersion
+func (c *Codec) Propose(w io.Writer) error {
+	_, err := w.Write(encodeLine(Message{Kind: "VERSION", Data: strconv.Itoa(int(FrameVersion))}))
+	return err
+}
+
+// HandleVersion handles a received VERSION message and returns true,
+// or returns false if message is of another kind and must be handled by the caller
+func (c *Codec) HandleVersion(message Message, w io.Writer) bool {
+	if message.Kind != "VERSION" {
+		return false
+	}
+
+	if message.version != 0 {
+		// The remote end answered our proposal with a framed message
+		c.upgrade()
+		return true
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(message.Data))
+	if err != nil || version < int(FrameVersion) {
+		fmt.Println("Unsupported VERSION message", message.Data)
+		return true
+	}
+
+	// The remote end proposed the framed protocol, we answer with a framed message
+	c.upgrade()
+	if err := c.Send(w, Message{Kind: "VERSION", Data: strconv.Itoa(int(FrameVersion))}); err != nil {
+		fmt.Println("Failed to answer VERSION message", err)
+	}
+	return true
+}
+
+// ReadMessage reads the next message from r, whatever its wire format
+func ReadMessage(r *bufio.Reader) (Message, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return Message{}, err
+	}
+
+	if first[0] != frameMagic {
+		data, err := readLine(r)
+		if err != nil {
+			return Message{}, err
+		}
+		return createMessage(strings.TrimSpace(data))
+	}
+
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Message{}, err
+	}
+
+	if header[1] != FrameVersion {
+		return Message{}, &frameError{"unsupported version " + strconv.Itoa(int(header[1]))}
+	}
+
+	kindLength := int(header[2])
+	dataLength := binary.BigEndian.Uint32(header[3:])
+	if kindLength == 0 {
+		return Message{}, &frameError{"empty kind"}
+	}
+	if dataLength > MaxDataSize {
+		return Message{}, &frameError{"data too large (" + strconv.Itoa(int(dataLength)) + " bytes)"}
+	}
+
+	body := make([]byte, kindLength+int(dataLength))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Message{}, err
+	}
+
+	return Message{
+		Kind:    string(body[:kindLength]),
+		Data:    string(body[kindLength:]),
+		version: header[1],
+	}, nil
+}
+
+// readLine reads a message of the legacy line protocol, which can't be larger than a framed message
+// (a peer which never sends a newline would make the line grow forever)
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxLineSize {
+			return "", &frameError{"line too long (more than " + strconv.Itoa(maxLineSize) + " bytes)"}
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+func encodeLine(m Message) []byte {
+	data := strings.Replace(strings.TrimSpace(m.Data), "\n", " ", -1)
+	return []byte(m.Kind + " " + data + "\n")
+}
+
+func encodeFrame(m Message) ([]byte, error) {
+	if len(m.Kind) == 0 || len(m.Kind) > 255 {
+		return nil, &frameError{"invalid kind length " + strconv.Itoa(len(m.Kind))}
+	}
+	if len(m.Data) > MaxDataSize {
+		return nil, &frameError{"data too large (" + strconv.Itoa(len(m.Data)) + " bytes)"}
+	}
+
+	raw := make([]byte, frameHeaderSize, frameHeaderSize+len(m.Kind)+len(m.Data))
+	raw[0] = frameMagic
+	raw[1] = FrameVersion
+	raw[2] = byte(len(m.Kind))
+	binary.BigEndian.PutUint32(raw[3:], uint32(len(m.Data)))
+	raw = append(raw, m.Kind...)
+	raw = append(raw, m.Data...)
+
+	return raw, nil
+}
+
+func (e *frameError) Error() string {
+	return fmt.Sprintf("Malformated frame : %s", e.reason)
+}
@@ -0,0 +1,99 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// time to wait for the answer to a VERSION proposal
+const negotiationTimeout = 1 * time.Second
+
+// Conn is a connection to a peer or to the directory server.
+// It owns a single buffered reader and writer for the whole life of the connection,
+// so bytes received in the same segment as a previous message are never dropped,
+// and the Codec used to write on it.
+type Conn struct {
+	net.Conn
+	reader     *bufio.Reader
+	writer     *bufio.Writer
+	writeMutex sync.Mutex
+	codec      Codec
+}
+
+// NewConn wraps a net.Conn, the messages sent are traced according to logLevel
+func NewConn(conn net.Conn, logLevel LogLevel) *Conn {
+	return &Conn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+		codec:  Codec{logLevel: logLevel},
+	}
+}
+
+// Next returns the next received message
+// VERSION messages are handled here and never returned
+func (c *Conn) Next() (Message, error) {
+	for {
+		message, err := ReadMessage(c.reader)
+		if err != nil {
+			return Message{}, err
+		}
+
+		if !c.codec.HandleVersion(message, c) {
+			return message, nil
+		}
+	}
+}
+
+// Send writes a message on the connection, using the negotiated wire format
+// It can be called from several goroutines
+func (c *Conn) Send(m Message) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if err := c.codec.Send(c.writer, m); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// Write implements io.Writer, so the Codec can answer VERSION proposals
+func (c *Conn) Write(raw []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	n, err := c.writer.Write(raw)
+	if err != nil {
+		return n, err
+	}
+	return n, c.writer.Flush()
+}
+
+// Propose starts the version negotiation, the answer is handled by Next
+func (c *Conn) Propose() error {
+	return c.codec.Propose(c)
+}
+
+// Negotiate proposes the framed protocol and waits for the answer of the remote end
+// Old peers never answer, in this case we keep the legacy line protocol
+func (c *Conn) Negotiate() {
+	if err := c.Propose(); err != nil {
+		return
+	}
+
+	c.SetReadDeadline(time.Now().Add(negotiationTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	message, err := ReadMessage(c.reader)
+	if err != nil || !c.codec.HandleVersion(message, c) {
+		fmt.Println("Using legacy protocol with", c.RemoteAddr())
+	}
+}
+
+// Framed returns true if the framed protocol has been negotiated
+func (c *Conn) Framed() bool {
+	return c.codec.Framed()
+}
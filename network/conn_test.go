@@ -0,0 +1,208 @@
+package network
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const backToBack = 200
+
+// readAll reads n messages from conn in a goroutine, the channel is closed after them or on the first error
+func readAll(t *testing.T, conn *Conn, n int) <-chan Message {
+	t.Helper()
+	received := make(chan Message, n)
+	go func() {
+		defer close(received)
+		for i := 0; i < n; i++ {
+			message, err := conn.Next()
+			if err != nil {
+				t.Errorf("message %d : %v", i, err)
+				return
+			}
+			received <- message
+		}
+	}()
+	return received
+}
+
+// expectMessages checks that received gives exactly the messages of expected, in order
+func expectMessages(t *testing.T, received <-chan Message, expected []Message) {
+	t.Helper()
+	for i, want := range expected {
+		select {
+		case got, ok := <-received:
+			if !ok {
+				t.Fatalf("only %d messages received out of %d", i, len(expected))
+			}
+			if got.Kind != want.Kind || got.Data != want.Data {
+				t.Fatalf("message %d : got %v, want %v", i, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d not received", i)
+		}
+	}
+}
+
+func TestFramedBackToBack(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	client, server := NewConn(a, LogQuiet), NewConn(b, LogQuiet)
+
+	expected := make([]Message, 0, backToBack)
+	for i := 0; i < backToBack; i++ {
+		// the framed protocol carries newlines and binary data
+		expected = append(expected, Message{Kind: "SAY", Data: "message " + strconv.Itoa(i) + "\nsecond line \x00\xff"})
+	}
+	received := readAll(t, server, len(expected))
+
+	client.Negotiate()
+	if !client.Framed() || !server.Framed() {
+		t.Fatalf("framed protocol not negotiated : client %v, server %v", client.Framed(), server.Framed())
+	}
+	for _, message := range expected {
+		if err := client.Send(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectMessages(t, received, expected)
+}
+
+func TestLegacyBackToBack(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	server := NewConn(b, LogQuiet)
+
+	// an old peer may send several lines in the same segment, none of them must be lost
+	expected := make([]Message, 0, backToBack)
+	raw := make([]byte, 0)
+	for i := 0; i < backToBack; i++ {
+		message := Message{Kind: "SAY", Data: "message " + strconv.Itoa(i)}
+		expected = append(expected, message)
+		raw = append(raw, encodeLine(message)...)
+	}
+	received := readAll(t, server, len(expected))
+
+	if _, err := a.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	expectMessages(t, received, expected)
+	if server.Framed() {
+		t.Error("framed protocol used with an old peer")
+	}
+}
+
+func TestMixedBackToBack(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	server := NewConn(b, LogQuiet)
+
+	// lines and frames in the same segment are told apart by their first byte
+	expected := make([]Message, 0, backToBack)
+	raw := make([]byte, 0)
+	for i := 0; i < backToBack; i++ {
+		message := Message{Kind: "SAY", Data: "message " + strconv.Itoa(i)}
+		expected = append(expected, message)
+		if i%2 == 0 {
+			raw = append(raw, encodeLine(message)...)
+			continue
+		}
+		frame, err := encodeFrame(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw = append(raw, frame...)
+	}
+	received := readAll(t, server, len(expected))
+
+	if _, err := a.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	expectMessages(t, received, expected)
+}
+
+func TestVersionFallback(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	client := NewConn(a, LogQuiet)
+
+	// an old peer reads the VERSION proposal as an unknown line, and never answers it
+	oldPeer := bufio.NewReader(b)
+	lines := make(chan string, 2)
+	go func() {
+		for {
+			line, err := oldPeer.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	start := time.Now()
+	client.Negotiate()
+	if client.Framed() {
+		t.Fatal("framed protocol used with an old peer")
+	}
+	if elapsed := time.Since(start); elapsed < negotiationTimeout {
+		t.Errorf("gave up the negotiation after %v, before the timeout", elapsed)
+	}
+	if line := <-lines; line != "VERSION "+strconv.Itoa(int(FrameVersion))+"\n" {
+		t.Fatalf("unexpected proposal %q", line)
+	}
+
+	// the messages are then sent as lines, which the old peer understands
+	go client.Send(Message{Kind: "SAY", Data: "hello\nold peer"})
+	if line := <-lines; line != "SAY hello old peer\n" {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+func TestVersionFromOldClient(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	server := NewConn(b, LogQuiet)
+
+	// an old client never proposes VERSION, the server keeps the line protocol
+	received := readAll(t, server, 2)
+	if _, err := a.Write([]byte("HELLO 9000\nSAY hi\n")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessages(t, received, []Message{{Kind: "HELLO", Data: "9000"}, {Kind: "SAY", Data: "hi"}})
+	if server.Framed() {
+		t.Error("framed protocol used with an old client")
+	}
+}
+
+// endless is a reader which never sends a newline
+type endless struct{}
+
+func (endless) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 'a'
+	}
+	return len(b), nil
+}
+
+func TestLegacyLineIsBounded(t *testing.T) {
+	// a line longer than the buffer of the reader is read whole
+	long := "SAY " + strings.Repeat("a", 100000)
+	message, err := ReadMessage(bufio.NewReader(strings.NewReader(long + "\n")))
+	if err != nil || message.Kind != "SAY" || len(message.Data) != 100000 {
+		t.Fatalf("long line read as %d bytes of %q : %v", len(message.Data), message.Kind, err)
+	}
+
+	// a line without end is refused once it is larger than a framed message
+	if _, err := ReadMessage(bufio.NewReader(endless{})); err == nil {
+		t.Fatal("a line without newline is accepted")
+	}
+}
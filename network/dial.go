@@ -1,36 +1,87 @@
 package network
 
 import (
-	"fmt"
-	"net"
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// Dial connects to a Peer and is in charge of sending outgoing messages to this peer.
+const (
+	// time allowed to the remote peer to answer our HELLO
+	// (it may wait for the directory to tell it about us before answering)
+	handshakeTimeout = 10 * time.Second
+
+	dialTimeout = 5 * time.Second // time allowed to open the connection to a peer
+)
+
+// dial opens a connection to a Peer and identifies with it, it gives up when ctx is done.
 // localChatPort is our own listening port and is used so the other peer can recognise us.
-func Dial(peer Peer, localChatPort int) {
-	conn, err := net.Dial("tcp", peer.address+":"+strconv.Itoa(peer.port))
+func (stack *Stack) dial(ctx context.Context, peer Peer, localChatPort int) (*Conn, error) {
+	tcpConn, err := stack.dialPeer(ctx, peer.FullAddress())
+	if err != nil {
+		return nil, err
+	}
+
+	conn := NewConn(tcpConn, stack.logLevel)
+	release := CloseOnDone(ctx, conn)
+	defer release()
+	conn.Negotiate()
+
+	// Identifying with the other peer, with our local port and identity key
+	if err := stack.authenticate(conn, peer, localChatPort); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+
+	return conn, nil
+}
+
+// authenticate runs the identification handshake with the remote peer :
+//
+//	-> HELLO <port> <publicKey> <nonce>
+//	<- CHALLENGE <nonce2> <signature of the transcript, as listener>
+//	-> PROOF <signature of the transcript, as dialer>
+//
+// the transcript binds both nonces and both identity keys (see signHandshake)
+// we check that the remote peer owns the key registered in the directory, and prove that we own ours
+func (stack *Stack) authenticate(conn *Conn, peer Peer, localChatPort int) error {
+	nonce := NewChallenge()
+
+	err := conn.Send(Message{
+		Kind: "HELLO",
+		Data: strconv.Itoa(localChatPort) + " " + stack.LocalPublicKey() + " " + nonce,
+	})
+	if err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	message, err := conn.Next()
 	if err != nil {
-		fmt.Println("Failed to connect to peer", err)
-		return
+		return err
 	}
 
-	fmt.Println("Connected to", peer.address+":"+strconv.Itoa(peer.port))
-
-	// Sending a HELLO message with our local port
-	// this acts as authentication between peers
-	Message{
-		"HELLO",
-		strconv.Itoa(localChatPort),
-	}.Send(conn)
-
-	for {
-		select {
-		case msg := <-peer.Send:
-			msg.Send(conn)
-		default:
-			time.Sleep(10 * time.Millisecond)
-		}
+	fields := strings.Fields(message.Data)
+	if message.Kind != "CHALLENGE" || len(fields) != 2 {
+		return errors.New("unexpected answer " + message.String())
 	}
+
+	localKey := stack.identity.Public().(ed25519.PublicKey)
+	if !verifyHandshake(fields[1], rolePeerListener, nonce, fields[0], localKey, peer.publicKey) {
+		return errors.New("invalid signature, the peer does not own its registered identity key")
+	}
+
+	return conn.Send(Message{
+		Kind: "PROOF",
+		Data: stack.signHandshake(rolePeerDialer, nonce, fields[0], localKey, peer.publicKey),
+	})
 }
@@ -1,63 +1,109 @@
 package network
 
 import (
+	"context"
+	"crypto/ed25519"
 	"fmt"
-	"net"
 	"strconv"
 	"strings"
 	"time"
 )
 
-var (
-	connectedToDirectory = false
-	peers                map[string]string
-	peersMapChannel      chan map[string]string
-	chatPort             int
-	usernameChannel      chan string
-)
-
-// ConnectToDirectory ...
-func ConnectToDirectory(directoryServer string, directoryPort int, localChatPort int, peersMap chan map[string]string, usernameChan chan string) {
-	peersMapChannel = peersMap
-	peers = make(map[string]string)
-	chatPort = localChatPort
-	usernameChannel = usernameChan
-
-	conn, err := net.Dial("tcp", directoryServer+":"+strconv.Itoa(directoryPort))
-	if err != nil {
-		fmt.Println("Cannot connect to directory", err)
+// ConnectToDirectory keeps a connection to a directory server, which tells us the peers to bootstrap the membership with,
+// and our username (sent to usernameChan)
+// addresses are the directory servers of a cluster ("a.b.c.d:0000"), when one is unreachable we fail over to the next one,
+// the other directories of the cluster are also told by the directory we are connected to
+// the chat keeps working with the known members while no directory is reachable
+// when ctx is done, we say BYE to the directory and close the connection
+// it returns at once if there is no directory server to connect to
+func (stack *Stack) ConnectToDirectory(ctx context.Context, addresses []string, localChatPort int, usernameChan chan string) {
+	stack.chatPort = localChatPort
+	stack.usernameChannel = usernameChan
+	stack.addDirectories(addresses)
+	if _, ok := stack.currentDirectory(); !ok {
+		fmt.Println("No directory server given, not connecting to any")
 		return
 	}
 
-	fmt.Println("Connected to directory.")
-
-	go listenFromDirectory(conn)
-	connectedToDirectory = true
-	send(conn, "HELLO", strconv.Itoa(chatPort))
-
-	for {
-		if !connectedToDirectory {
-			conn, err := net.Dial("tcp", directoryServer+":"+strconv.Itoa(directoryPort))
+	for !stack.bannedFromDirectory.Load() {
+		if !stack.connectedToDirectory.Load() {
+			address, _ := stack.currentDirectory()
+			tcpConn, err := stack.dialDirectory(ctx, address)
 			if err != nil {
-				fmt.Println("Cannot connect to directory", err)
+				fmt.Println("Cannot connect to directory", address, err)
+				stack.nextDirectory()
 			} else {
-				connectedToDirectory = true
-				send(conn, "HELLO", strconv.Itoa(chatPort))
-				go listenFromDirectory(conn)
+				fmt.Println("Connected to directory", address)
+				conn := NewConn(tcpConn, stack.logLevel)
+				stack.connectedToDirectory.Store(true)
+				conn.Propose()
+				send(conn, "HELLO", strconv.Itoa(stack.chatPort)+" "+stack.LocalPublicKey())
+				stack.setDirectoryConn(conn)
+				go stack.listenFromDirectory(ctx, conn)
 			}
 
 		}
 
-		time.Sleep(2 * time.Second)
+		select {
+		case <-ctx.Done():
+			if conn := stack.currentDirectoryConn(); conn != nil {
+				conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+				send(conn, "BYE", "")
+				conn.Close()
+			}
+			return
+		case <-time.After(2 * time.Second):
+		}
+	}
+	fmt.Println("Banned from the directory, not connecting to it anymore")
+}
+
+// addDirectories adds the directory servers we don't know yet to the end of the list
+func (stack *Stack) addDirectories(addresses []string) {
+	stack.directoriesMutex.Lock()
+	defer stack.directoriesMutex.Unlock()
+
+	for _, address := range addresses {
+		known := false
+		for _, d := range stack.directories {
+			known = known || d == address
+		}
+		if !known && address != "" {
+			stack.directories = append(stack.directories, address)
+		}
+	}
+}
+
+// currentDirectory returns the address of the directory server we use, false if we know none
+func (stack *Stack) currentDirectory() (string, bool) {
+	stack.directoriesMutex.Lock()
+	defer stack.directoriesMutex.Unlock()
+	if len(stack.directories) == 0 {
+		return "", false
+	}
+	return stack.directories[stack.directoryIndex], true
+}
+
+// nextDirectory fails over to the next directory server of the list
+func (stack *Stack) nextDirectory() {
+	stack.directoriesMutex.Lock()
+	defer stack.directoriesMutex.Unlock()
+	if len(stack.directories) > 0 {
+		stack.directoryIndex = (stack.directoryIndex + 1) % len(stack.directories)
 	}
 }
 
-func listenFromDirectory(conn net.Conn) {
+func (stack *Stack) listenFromDirectory(ctx context.Context, conn *Conn) {
 	for {
-		message, err := GetNextMessage(conn)
+		message, err := conn.Next()
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			fmt.Println("Lost connection to directory ", err)
-			connectedToDirectory = false
+			stack.nextDirectory()
+			stack.connectedToDirectory.Store(false)
+			stack.setDirectoryConn(nil)
 			return
 		}
 
@@ -65,13 +111,33 @@ func listenFromDirectory(conn net.Conn) {
 
 		switch message.Kind {
 		case "PEERS":
-			handlePeers(message.Data)
+			stack.handlePeers(message.Data)
 
 		case "NAME":
-			handleName(message.Data)
+			stack.handleName(message.Data)
+
+		case "ROOMS":
+			stack.handleRooms(message.Data)
 
 		case "WELCOME":
-			handleWelcome(message.Data)
+			stack.handleWelcome(ctx, message.Data)
+
+		case "ERROR":
+			stack.handleError(message.Data)
+
+		case "REGISTERED":
+			stack.handleRegistered(message.Data)
+
+		case "DIRECTORIES":
+			// the directories of the cluster, to fail over to when this one is down
+			stack.addDirectories(strings.Fields(message.Data))
+
+		case "NOTICE":
+			fmt.Println("*** Notice from the directory :", message.Data)
+
+		case "CHALLENGE":
+			// the directory checks that we own the public key sent in HELLO
+			send(conn, "PROOF", stack.SignDirectoryChallenge(strings.TrimSpace(message.Data)))
 
 		default:
 			fmt.Println("Unknown message kind :", message)
@@ -79,30 +145,34 @@ func listenFromDirectory(conn net.Conn) {
 	}
 }
 
-func handlePeers(sList string) {
+// handlePeers reads a list of "a.b.c.d:0000,publicKey" entries, which are added to the members
+func (stack *Stack) handlePeers(sList string) {
 	list := strings.Split(sList, " ")
 
-	newPeersList := make(map[string]string)
+	newPeersList := make(map[string]ed25519.PublicKey)
 
 	// convert peers list to a map to simplify search by address
-	// (and we only keep valid addresses)
-	for _, addr := range list {
-		if len(strings.SplitN(addr, ":", 2)) != 2 {
+	// (and we only keep valid addresses with a valid identity key)
+	for _, entry := range list {
+		fields := strings.SplitN(entry, ",", 2)
+		if len(fields) != 2 || len(strings.SplitN(fields[0], ":", 2)) != 2 {
 			continue
 		}
-		if _, found := peers[addr]; found {
-			newPeersList[addr] = peers[addr]
-		} else {
-			newPeersList[addr] = addr
-			peers[addr] = newPeersList[addr]
+
+		addr := fields[0]
+		publicKey, err := DecodePublicKey(fields[1])
+		if err != nil {
+			fmt.Println("Invalid public key for", addr, err)
+			continue
 		}
+
+		newPeersList[addr] = publicKey
 	}
 
-	peersMapChannel <- newPeersList
-	peers = newPeersList
+	stack.mergeKnownPeers(newPeersList)
 }
 
-func handleName(data string) {
+func (stack *Stack) handleName(data string) {
 	list := strings.SplitN(data, " ", 2)
 	if len(list) < 2 {
 		fmt.Println("Invalid NAME message", data)
@@ -111,22 +181,44 @@ func handleName(data string) {
 
 	addr, newName := strings.TrimSpace(list[0]), strings.TrimSpace(list[1])
 
-	peers[addr] = newName
-
-	fmt.Println(addr, "is now", peers[addr])
+	// the directory always sends PEERS before NAME, so the address must be known
+	if !stack.setMemberName(addr, newName) {
+		fmt.Println("NAME message for unknown peer", addr)
+		return
+	}
 
-	peersMapChannel <- peers
+	fmt.Println(addr, "is now", newName)
 }
 
-func handleWelcome(data string) {
+func (stack *Stack) handleWelcome(ctx context.Context, data string) {
 	if len(strings.Split(data, " ")) != 1 {
 		fmt.Println("Invalid WELCOME message", data)
 		return
 	}
 
-	usernameChannel <- data
+	stack.SetLocalName(data)
+	select {
+	case stack.usernameChannel <- data:
+	case <-ctx.Done():
+	}
+}
+
+// handleError reads "ERROR <code> <reason>", sent by the directory when it refused a request or our connection
+// code is "name" for a refused username, "banned", "kicked", "full", "rate" or "unavailable" when the directory closes the connection
+// we stop connecting to a directory which banned us, and retry later otherwise
+func (stack *Stack) handleError(data string) {
+	fields := strings.SplitN(data, " ", 2)
+	if len(fields) != 2 {
+		fmt.Println("Invalid ERROR message", data)
+		return
+	}
+
+	fmt.Println("Refused by the directory :", fields[1])
+	if fields[0] == "banned" {
+		stack.bannedFromDirectory.Store(true)
+	}
 }
 
-func send(conn net.Conn, msgType string, data string) (int, error) {
-	return conn.Write([]byte(msgType + " " + data + "\n"))
+func send(conn *Conn, msgType string, data string) error {
+	return conn.Send(Message{Kind: msgType, Data: data})
 }
@@ -0,0 +1,30 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+func TestConnectWithoutDirectory(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	stack := NewStack(key)
+	stack.UseLogLevel(LogQuiet)
+
+	returned := make(chan bool)
+	go func() {
+		stack.ConnectToDirectory(context.Background(), nil, 9000, make(chan string, 1))
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ConnectToDirectory keeps running without directory server")
+	}
+
+	stack.nextDirectory()
+	if _, ok := stack.currentDirectory(); ok {
+		t.Error("a directory server is current while none was given")
+	}
+}
@@ -0,0 +1,72 @@
+package network
+
+import (
+	"errors"
+	"time"
+)
+
+// Liveness is what the heartbeat tells us about a peer
+type Liveness int
+
+const (
+	// Unknown is the liveness of a peer we were never connected to
+	Unknown Liveness = iota
+	// Alive is the liveness of a peer which answered our last PING in time
+	Alive
+	// Suspect is the liveness of a peer which didn't answer for HeartbeatConfig.SuspectTimeout
+	Suspect
+	// Dead is the liveness of a peer which didn't answer for HeartbeatConfig.DeadTimeout, its connection is opened again
+	Dead
+)
+
+// String returns the name of the liveness, as shown by /who
+func (liveness Liveness) String() string {
+	switch liveness {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// HeartbeatConfig sets how often peers are pinged, and after how long without PONG they are suspected, then declared dead
+type HeartbeatConfig struct {
+	Interval       time.Duration
+	SuspectTimeout time.Duration
+	DeadTimeout    time.Duration
+}
+
+// DefaultHeartbeat is the heartbeat used unless UseHeartbeat is called
+var DefaultHeartbeat = HeartbeatConfig{
+	Interval:       2 * time.Second,
+	SuspectTimeout: 6 * time.Second,
+	DeadTimeout:    15 * time.Second,
+}
+
+// UseHeartbeat sets the heartbeat of the connections opened afterwards
+func (stack *Stack) UseHeartbeat(config HeartbeatConfig) error {
+	if config.Interval <= 0 || config.SuspectTimeout < config.Interval || config.DeadTimeout < config.SuspectTimeout {
+		return errors.New("heartbeat timeouts must be positive, with interval <= suspect timeout <= dead timeout")
+	}
+	stack.heartbeat = config
+	return nil
+}
+
+// livenessAfter returns the liveness of a peer which didn't answer for silence
+func (stack *Stack) livenessAfter(silence time.Duration) Liveness {
+	switch {
+	case silence >= stack.heartbeat.DeadTimeout:
+		return Dead
+	case silence >= stack.heartbeat.SuspectTimeout:
+		return Suspect
+	}
+	return Alive
+}
+
+// isHeartbeat returns true for PING and PONG messages
+func isHeartbeat(m Message) bool {
+	return m.Kind == "PING" || m.Kind == "PONG"
+}
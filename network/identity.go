@@ -0,0 +1,157 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"strings"
+)
+
+const challengeBytes = 32
+
+// The challenges are never signed alone : each signature covers a transcript which names the role of the signer
+// and binds the nonces and identity keys of the handshake, so a peer can't be used to sign the challenge
+// of another handshake (a directory's one relayed by an impostor), nor a signature be replayed in another role
+const (
+	roleDirectoryClient = "directory-client" // a client proves its key to the directory
+	rolePeerListener    = "peer-listener"    // the listening peer answers HELLO with CHALLENGE
+	rolePeerDialer      = "peer-dialer"      // the dialing peer answers CHALLENGE with PROOF
+	roleGossipOrigin    = "gossip-origin"    // the author of a message relayed by gossip signs it
+)
+
+// LoadIdentity reads the identity key stored in path, or creates a new one if the file doesn't exist
+func LoadIdentity(path string) (ed25519.PrivateKey, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return createIdentity(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("invalid identity key in " + path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("identity key in " + path + " is not an Ed25519 key")
+	}
+	return edKey, nil
+}
+
+func createIdentity(path string) (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writePEM(path, "PRIVATE KEY", der); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// LocalPublicKey returns the encoded public key of the local identity
+func (stack *Stack) LocalPublicKey() string {
+	return EncodePublicKey(stack.LocalKey())
+}
+
+// LocalKey returns the public key of the local identity
+func (stack *Stack) LocalKey() ed25519.PublicKey {
+	return stack.identity.Public().(ed25519.PublicKey)
+}
+
+// EncodePublicKey returns the text version of a public key, as sent in HELLO and PEERS messages
+func EncodePublicKey(key ed25519.PublicKey) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// DecodePublicKey reads a public key encoded by EncodePublicKey
+func DecodePublicKey(text string) (ed25519.PublicKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key size")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// NewChallenge returns a random nonce that the remote end must sign to prove its identity
+func NewChallenge() string {
+	raw := make([]byte, challengeBytes)
+	rand.Read(raw)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// transcript is what is signed by role, fields are nonces and encoded keys, which never contain spaces
+// (only the last field may contain spaces, like the text of a message)
+func transcript(role string, fields ...string) []byte {
+	return []byte("GOssip " + role + " " + strings.Join(fields, " "))
+}
+
+// signTranscript signs the transcript of role with our identity key
+func (stack *Stack) signTranscript(role string, fields ...string) string {
+	return base64.RawURLEncoding.EncodeToString(ed25519.Sign(stack.identity, transcript(role, fields...)))
+}
+
+// verifyTranscript returns true if signature is the signature by key of the transcript of role
+func verifyTranscript(key ed25519.PublicKey, signature string, role string, fields ...string) bool {
+	raw, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(key, transcript(role, fields...), raw)
+}
+
+// SignDirectoryChallenge signs the challenge of the directory, with the identity key we sent in HELLO
+func (stack *Stack) SignDirectoryChallenge(challenge string) string {
+	return stack.signTranscript(roleDirectoryClient, challenge, stack.LocalPublicKey())
+}
+
+// VerifyDirectoryProof returns true if signature is the answer of the owner of key to the challenge of the directory
+func VerifyDirectoryProof(key ed25519.PublicKey, challenge string, signature string) bool {
+	return verifyTranscript(key, signature, roleDirectoryClient, challenge, EncodePublicKey(key))
+}
+
+// signHandshake signs the transcript of a handshake between peers, role telling which end we are
+func (stack *Stack) signHandshake(role string, dialerNonce string, listenerNonce string, dialerKey ed25519.PublicKey, listenerKey ed25519.PublicKey) string {
+	return stack.signTranscript(role, dialerNonce, listenerNonce, EncodePublicKey(dialerKey), EncodePublicKey(listenerKey))
+}
+
+// verifyHandshake returns true if signature is the signature by the end role of the transcript of a handshake between peers
+func verifyHandshake(signature string, role string, dialerNonce string, listenerNonce string, dialerKey ed25519.PublicKey, listenerKey ed25519.PublicKey) bool {
+	key := dialerKey
+	if role == rolePeerListener {
+		key = listenerKey
+	}
+	return verifyTranscript(key, signature, role, dialerNonce, listenerNonce, EncodePublicKey(dialerKey), EncodePublicKey(listenerKey))
+}
+
+// SignGossip signs a message we relay by gossip, so the peers it reaches through others know we wrote it
+// fields must not contain spaces, except the last one (the text)
+func (stack *Stack) SignGossip(fields ...string) string {
+	return stack.signTranscript(roleGossipOrigin, append([]string{stack.LocalPublicKey()}, fields...)...)
+}
+
+// VerifyGossip returns true if signature is the signature by key of a message relayed by gossip
+func VerifyGossip(key ed25519.PublicKey, signature string, fields ...string) bool {
+	return verifyTranscript(key, signature, roleGossipOrigin, append([]string{EncodePublicKey(key)}, fields...)...)
+}
@@ -0,0 +1,120 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Peers and directory servers announce themselves on a UDP multicast group of the local network :
+//
+//	GOSSIP PEER <chat port> <public key>
+//	GOSSIP DIRECTORY <port>
+//
+// the address of the announcer is the source address of the datagram
+const (
+	lanGroup            = "239.255.71.71:7171"
+	lanAnnounceInterval = 5 * time.Second
+	lanMagic            = "GOSSIP"
+	lanMaxDatagram      = 512
+)
+
+// AnnounceDirectory announces a directory server listening on port to the local network, until ctx is done
+func AnnounceDirectory(ctx context.Context, port int) {
+	announce(ctx, "DIRECTORY "+strconv.Itoa(port))
+}
+
+// DiscoverLAN announces the local peer on the local network, and listens for the announces of the others until ctx is done
+// the discovered peers are added to the members, and the address ("a.b.c.d:0000") of each new directory server is sent to directories
+func (stack *Stack) DiscoverLAN(ctx context.Context, localChatPort int, directories chan<- string) {
+	group, err := net.ResolveUDPAddr("udp4", lanGroup)
+	if err != nil {
+		fmt.Println("Invalid multicast group", err)
+		return
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		fmt.Println("Failed to join multicast group", err)
+		return
+	}
+	defer conn.Close()
+	defer CloseOnDone(ctx, conn)()
+
+	go announce(ctx, "PEER "+strconv.Itoa(localChatPort)+" "+stack.LocalPublicKey())
+
+	knownDirectories := make(map[string]bool)
+	buffer := make([]byte, lanMaxDatagram)
+	for {
+		n, source, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Println("Failed to read multicast announce", err)
+			}
+			return
+		}
+
+		fields := strings.Fields(string(buffer[:n]))
+		if len(fields) < 3 || fields[0] != lanMagic {
+			continue
+		}
+
+		port, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		address := source.IP.String() + ":" + strconv.Itoa(port)
+
+		switch {
+		case fields[1] == "PEER" && len(fields) == 4:
+			publicKey, err := DecodePublicKey(fields[3])
+			if err != nil || publicKey.Equal(stack.identity.Public()) {
+				continue
+			}
+			stack.mergeKnownPeers(map[string]ed25519.PublicKey{address: publicKey})
+
+		case fields[1] == "DIRECTORY":
+			if knownDirectories[address] {
+				continue
+			}
+			knownDirectories[address] = true
+			fmt.Println("Found directory server", address)
+
+			select {
+			case directories <- address:
+			default:
+			}
+		}
+	}
+}
+
+// announce sends message to the multicast group every lanAnnounceInterval, until ctx is done
+func announce(ctx context.Context, message string) {
+	group, err := net.ResolveUDPAddr("udp4", lanGroup)
+	if err != nil {
+		fmt.Println("Invalid multicast group", err)
+		return
+	}
+
+	conn, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		fmt.Println("Failed to announce on the local network", err)
+		return
+	}
+	defer conn.Close()
+
+	for {
+		if _, err := conn.Write([]byte(lanMagic + " " + message)); err != nil {
+			fmt.Println("Failed to announce on the local network", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(lanAnnounceInterval):
+		}
+	}
+}
@@ -1,95 +1,210 @@
 package network
 
 import (
+	"context"
+	"crypto/ed25519"
 	"fmt"
-	"net"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// seconds waited for the directory to tell us about a peer which dialed us
+const helloRetries = 5
+
 type MessageReceiver interface {
 	Receive(Message, Peer)
 	HandleHello(data string, from Peer)
 }
 
-// Listen ...
-func Listen(port int, peers PeersMap, messageReceiver MessageReceiver) {
-	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+// Listen accepts the connections of the other peers on port, until ctx is done
+// the accepted connections are closed when ctx is done
+func (stack *Stack) Listen(ctx context.Context, port int, peers PeersMap, messageReceiver MessageReceiver) {
+	ln, err := stack.listenPeers(port)
 	if err != nil {
 		fmt.Println("Failed to open listen socket", err)
 		return
 	}
+	defer CloseOnDone(ctx, ln)()
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			fmt.Println("Failed to accept connection peer", err)
+			if ctx.Err() == nil {
+				fmt.Println("Failed to accept connection peer", err)
+			}
 			return
 		}
-		go handleConnection(conn, peers, messageReceiver)
+		go stack.handleConnection(ctx, NewConn(conn, stack.logLevel), peers, messageReceiver)
 	}
 }
 
-func handleConnection(conn net.Conn, peers PeersMap, messageReceiver MessageReceiver) {
+// handshake is the identification state of the remote end of an incoming connection
+// address, publicKey and nonce are sent by HELLO, challenge is our nonce, the remote end signs both in PROOF
+// unknown is true if the remote end is a member which is not in the peers map yet
+type handshake struct {
+	hello     string
+	address   string
+	publicKey ed25519.PublicKey
+	nonce     string
+	challenge string
+	unknown   bool
+}
+
+func (stack *Stack) handleConnection(ctx context.Context, conn *Conn, peers PeersMap, messageReceiver MessageReceiver) {
+	defer CloseOnDone(ctx, conn)()
+
 	var remotePeerAddress = ""
+	var state handshake
 	for {
-		message, err := GetNextMessage(conn)
+		message, err := conn.Next()
 		if err != nil {
-			fmt.Println("Failed to read message from peer", err)
+			if ctx.Err() == nil {
+				fmt.Println("Failed to read message from peer", err)
+			}
 			return
 		}
-		fmt.Println("Got :", message)
 
-		if message.Kind == "HELLO" {
-			handleHello(message.Data, conn, peers, &remotePeerAddress, messageReceiver, 5)
-		} else {
-			handleMessage(&remotePeerAddress, message, peers, messageReceiver, 5)
+		// PING is answered on the same connection, so the remote peer knows we are alive
+		if message.Kind == "PING" {
+			if err := conn.Send(Message{Kind: "PONG", Data: message.Data}); err != nil {
+				fmt.Println("Failed to answer PING", err)
+				conn.Close()
+				return
+			}
+			continue
+		}
+		if stack.logLevel.Logged(message) {
+			fmt.Println("Got :", message)
+		}
+
+		switch message.Kind {
+		case "HELLO":
+			stack.handleHello(ctx, message.Data, conn, peers, &state)
+		case "PROOF":
+			if !stack.handleProof(message.Data, conn, peers, &state, &remotePeerAddress, messageReceiver) {
+				conn.Close()
+				return
+			}
+		case "BYE":
+			// the remote peer is shutting down, it is forgotten without waiting for the probes to fail
+			if remotePeerAddress != "" {
+				stack.memberLeft(remotePeerAddress)
+			}
+			conn.Close()
+			return
+		default:
+			stack.handleMessage(&remotePeerAddress, message, peers, messageReceiver, 5)
 		}
 	}
 }
 
-func handleMessage(remotePeerAddress *string, message Message, peers PeersMap, messageReceiver MessageReceiver, retries int) {
+func (stack *Stack) handleMessage(remotePeerAddress *string, message Message, peers PeersMap, messageReceiver MessageReceiver, retries int) {
 	if ok, _ := peers.Find(*remotePeerAddress); !ok {
 		if retries == 0 {
 			fmt.Println("Got message", message, "from unknown peer", *remotePeerAddress)
 		} else {
+			address := *remotePeerAddress
 			go func() {
 				time.Sleep(1 * time.Second)
-				handleMessage(remotePeerAddress, message, peers, messageReceiver, retries-1)
+				stack.handleMessage(&address, message, peers, messageReceiver, retries-1)
 			}()
 		}
+	} else if isMembershipMessage(message) {
+		stack.handleMembership(message, peers.Get(*remotePeerAddress), peers)
 	} else {
 		messageReceiver.Receive(message, peers.Get(*remotePeerAddress))
 	}
 }
 
-func handleHello(data string, conn net.Conn, peers PeersMap, remotePeerAddress *string, messageReceiver MessageReceiver, retries int) {
-	port, err := strconv.Atoi(strings.TrimSpace(data))
+// handleHello reads "HELLO <port> <publicKey> <nonce>" and answers with "CHALLENGE <nonce2> <signature>" :
+// we sign the transcript of the handshake (both nonces and both keys) to prove our own identity,
+// and the remote end must sign it too
+// the retries are done here, so the state of the handshake is only used by the goroutine of the connection
+func (stack *Stack) handleHello(ctx context.Context, data string, conn *Conn, peers PeersMap, state *handshake) {
+	fields := strings.Fields(data)
+	if len(fields) != 3 {
+		fmt.Println("Invalid HELLO message", data)
+		return
+	}
 
+	port, err := strconv.Atoi(fields[0])
 	if err != nil {
 		fmt.Println("Invalid HELLO message ", err)
 		return
 	}
 
-	addr := strings.Split(conn.RemoteAddr().String(), ":")[0] + ":" + strconv.Itoa(port)
+	publicKey, err := DecodePublicKey(fields[1])
+	if err != nil {
+		fmt.Println("Invalid public key in HELLO message ", err)
+		return
+	}
 
-	found, p := peers.Find(addr)
+	addr := strings.Split(conn.RemoteAddr().String(), ":")[0] + ":" + strconv.Itoa(port)
 
-	if !found {
-		if retries == 0 {
-			fmt.Println("Unknown peer", addr)
-		} else {
-			go func() {
-				time.Sleep(1 * time.Second)
-				handleHello(data, conn, peers, remotePeerAddress, messageReceiver, retries-1)
-			}()
+	// the remote end must be a member with the key the directory gave us for this address
+	// (or the local network, or our own lookup in the DHT), we sign nothing for the others
+	// the directory may tell us about a new peer after it dialed us, so we wait for it a little
+	for retries := 0; !stack.vouchedMember(addr, publicKey); retries++ {
+		if retries == helloRetries {
+			fmt.Println("Refused", conn.RemoteAddr(), ": its identity key is not the one the directory gave for", addr)
+			return
 		}
-		return
+		select {
+		case <-time.After(1 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	found, _ := peers.Find(addr)
+	state.unknown = !found
+	state.hello = data
+	state.address = addr
+	state.publicKey = publicKey
+	state.nonce = fields[2]
+	state.challenge = NewChallenge()
+
+	localKey := stack.identity.Public().(ed25519.PublicKey)
+	conn.Send(Message{
+		Kind: "CHALLENGE",
+		Data: state.challenge + " " + stack.signHandshake(rolePeerListener, state.nonce, state.challenge, publicKey, localKey),
+	})
+}
+
+// handleProof checks the signature of our challenge, and identifies the remote end if it is valid
+// it returns false if the remote end failed to prove its identity
+func (stack *Stack) handleProof(data string, conn *Conn, peers PeersMap, state *handshake, remotePeerAddress *string, messageReceiver MessageReceiver) bool {
+	if state.challenge == "" {
+		fmt.Println("Unexpected PROOF message from", conn.RemoteAddr())
+		return false
 	}
 
-	*remotePeerAddress = p.FullAddress()
+	localKey := stack.identity.Public().(ed25519.PublicKey)
+	if !verifyHandshake(strings.TrimSpace(data), rolePeerDialer, state.nonce, state.challenge, state.publicKey, localKey) {
+		fmt.Println("Invalid PROOF message from", conn.RemoteAddr())
+		return false
+	}
 
-	fmt.Println("Identified", conn.RemoteAddr(), "as", p)
+	*remotePeerAddress = state.address
 
-	messageReceiver.HandleHello(data, peers.Get(*remotePeerAddress))
+	fmt.Println("Identified", conn.RemoteAddr(), "as", state.address)
+
+	if !state.unknown {
+		messageReceiver.HandleHello(state.hello, peers.Get(*remotePeerAddress))
+		return true
+	}
+
+	// the member is added to the peers map by the main loop
+	hello, address := state.hello, state.address
+	go func() {
+		for retries := 0; retries < helloRetries; retries++ {
+			time.Sleep(1 * time.Second)
+			if found, peer := peers.Find(address); found {
+				messageReceiver.HandleHello(hello, peer)
+				return
+			}
+		}
+	}()
+	return true
 }
@@ -0,0 +1,646 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The membership is maintained by the peers themselves, with a SWIM-like protocol :
+// every protocolPeriod, a member is probed with SWIMPING and must answer SWIMACK.
+// Without an answer in ackTimeout, a few other members are asked to probe it (SWIMPINGREQ) ;
+// without an answer at the end of the period it is suspected, then declared dead after suspectTimeout.
+// A suspected member refutes the suspicion by increasing its incarnation number.
+//
+// Changes are piggybacked on the probes as "status,address,incarnation,publicKey,name[,#room...]" updates,
+// the sender of a message describes itself with the address "-". The directory is only needed to bootstrap :
+// the peers it lists (or the ones discovered on the local network) are added as alive members.
+// The names are only vouched for by the directory (NAME) : a name claimed by a member itself is shown
+// qualified by its key ("name@keyprefix"), so it can't pass for the name the directory gave another member,
+// and the names in the updates about other members are ignored.
+// Likewise, the updates about other members can't change the key of a vouched member, and can't carry an incarnation
+// above maxIncarnation : a member counts from 0, and it couldn't refute a suspicion at the largest incarnation.
+const (
+	protocolPeriod   = 1 * time.Second
+	ackTimeout       = 400 * time.Millisecond
+	indirectProbes   = 3               // number of members asked to probe a member which didn't answer
+	suspectTimeout   = 5 * time.Second // time before a suspected member is declared dead
+	tombstoneTimeout = 30 * time.Second
+	maxPiggyback     = 8 // maximum number of updates piggybacked on a message
+	retransmitMult   = 3 // an update is piggybacked retransmitMult * log2(members) times
+	claimedKeyPrefix = 8 // characters of the key added to the names claimed by the members
+	maxIncarnation   = math.MaxUint64 / 2
+)
+
+type memberStatus int
+
+const (
+	memberAlive memberStatus = iota
+	memberSuspect
+	memberDead
+)
+
+var memberStatusNames = []string{"alive", "suspect", "dead"}
+
+// member is a peer known by the membership protocol
+// changedAt is when it was suspected or declared dead, dead members are kept until tombstoneTimeout so older updates can't revive them
+// vouched is true if its address and key come from the directory (or the local network, or a lookup of ours in the DHT),
+// and not only from the updates of the other members
+type member struct {
+	info        PeerInfo
+	incarnation uint64
+	status      memberStatus
+	changedAt   time.Time
+	vouched     bool
+	nameVouched bool // the name was given by the directory, the names claimed in the updates are ignored
+}
+
+// membershipUpdate is the state of a member, as piggybacked on the membership messages
+type membershipUpdate struct {
+	status      memberStatus
+	address     string
+	incarnation uint64
+	publicKey   ed25519.PublicKey
+	name        string
+	rooms       []string
+}
+
+// RunMembership probes the members until ctx is done, and sends the list of alive (or suspected) members to peersList when it changes
+// peers is used to send the membership messages through the outgoing connections
+func (stack *Stack) RunMembership(ctx context.Context, peers PeersMap, peersList chan<- map[string]PeerInfo) {
+	go stack.publishMembers(ctx, peersList)
+
+	order := make([]string, 0)
+	ticker := time.NewTicker(protocolPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stack.expireMembers()
+
+		// members are probed in a random order, each one once per round
+		if len(order) == 0 {
+			order = stack.memberAddresses("")
+			rand.Shuffle(len(order), func(i, j int) {
+				order[i], order[j] = order[j], order[i]
+			})
+		}
+		if len(order) == 0 {
+			continue
+		}
+
+		target := order[0]
+		order = order[1:]
+		stack.probe(ctx, peers, target)
+	}
+}
+
+// SetLocalName sets the username announced to the other members
+func (stack *Stack) SetLocalName(name string) {
+	stack.membershipMutex.Lock()
+	defer stack.membershipMutex.Unlock()
+
+	stack.selfName = name
+	stack.selfIncarnation++
+}
+
+// isMembershipMessage returns true for the messages handled by the membership protocol
+func isMembershipMessage(m Message) bool {
+	return m.Kind == "SWIMPING" || m.Kind == "SWIMACK" || m.Kind == "SWIMPINGREQ"
+}
+
+// handleMembership handles a membership message received from a peer
+func (stack *Stack) handleMembership(message Message, from Peer, peers PeersMap) {
+	fields := strings.Fields(message.Data)
+	if len(fields) < 1 {
+		fmt.Println("Invalid", message.Kind, "message", message.Data)
+		return
+	}
+
+	switch message.Kind {
+	case "SWIMPING":
+		stack.applyUpdates(fields[1:], from)
+		stack.sendMembership(peers, from.FullAddress(), "SWIMACK", fields[0])
+
+	case "SWIMACK":
+		stack.applyUpdates(fields[1:], from)
+		if seq, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+			stack.acknowledge(seq)
+		}
+
+	case "SWIMPINGREQ":
+		if len(fields) < 2 {
+			fmt.Println("Invalid SWIMPINGREQ message", message.Data)
+			return
+		}
+		stack.applyUpdates(fields[2:], from)
+
+		// we probe the target for the requester, and forward the SWIMACK with its sequence number
+		requester, requesterSeq := from.FullAddress(), fields[0]
+		seq := stack.expectAck(func() {
+			stack.sendMembership(peers, requester, "SWIMACK", requesterSeq)
+		})
+		stack.sendMembership(peers, fields[1], "SWIMPING", strconv.FormatUint(seq, 10))
+		time.AfterFunc(protocolPeriod, func() {
+			stack.forgetAck(seq)
+		})
+	}
+}
+
+// probe checks that the member at address is alive, directly then through other members, and suspects it otherwise
+// it gives up when ctx is done
+func (stack *Stack) probe(ctx context.Context, peers PeersMap, address string) {
+	acked := make(chan bool, 1)
+	seq := stack.expectAck(func() {
+		select {
+		case acked <- true:
+		default:
+		}
+	})
+	defer stack.forgetAck(seq)
+
+	stack.sendMembership(peers, address, "SWIMPING", strconv.FormatUint(seq, 10))
+	select {
+	case <-acked:
+		return
+	case <-ctx.Done():
+		return
+	case <-time.After(ackTimeout):
+	}
+
+	for _, helper := range stack.randomMembers(indirectProbes, address) {
+		stack.sendMembership(peers, helper, "SWIMPINGREQ", strconv.FormatUint(seq, 10)+" "+address)
+	}
+	select {
+	case <-acked:
+		return
+	case <-ctx.Done():
+		return
+	case <-time.After(protocolPeriod - ackTimeout):
+	}
+
+	stack.suspect(address)
+}
+
+// sendMembership sends a membership message to the member at address, with the updates to piggyback
+func (stack *Stack) sendMembership(peers PeersMap, address string, kind string, header string) {
+	found, peer := peers.Find(address)
+	if !found {
+		return
+	}
+
+	peer.Enqueue(Message{
+		Kind: kind,
+		Data: header + " " + strings.Join(stack.piggyback(), " "),
+	})
+}
+
+func (stack *Stack) expectAck(callback func()) uint64 {
+	stack.membershipMutex.Lock()
+	defer stack.membershipMutex.Unlock()
+
+	stack.probeSeq++
+	stack.pendingAcks[stack.probeSeq] = callback
+	return stack.probeSeq
+}
+
+func (stack *Stack) forgetAck(seq uint64) {
+	stack.membershipMutex.Lock()
+	defer stack.membershipMutex.Unlock()
+	delete(stack.pendingAcks, seq)
+}
+
+func (stack *Stack) acknowledge(seq uint64) {
+	stack.membershipMutex.Lock()
+	callback, found := stack.pendingAcks[seq]
+	delete(stack.pendingAcks, seq)
+	stack.membershipMutex.Unlock()
+
+	if found {
+		callback()
+	}
+}
+
+// suspect marks a member as suspected, unless it refuted the suspicion in the meantime
+func (stack *Stack) suspect(address string) {
+	stack.membershipMutex.Lock()
+	defer stack.membershipMutex.Unlock()
+
+	m, found := stack.members[address]
+	if !found || m.status != memberAlive {
+		return
+	}
+
+	fmt.Println("Member", address, "did not answer, suspecting it")
+	m.status = memberSuspect
+	m.changedAt = time.Now()
+	stack.disseminate(address)
+	stack.signalMembersChanged()
+}
+
+// memberLeft declares dead a member which said BYE, so it is forgotten without being suspected first
+func (stack *Stack) memberLeft(address string) {
+	stack.membershipMutex.Lock()
+	defer stack.membershipMutex.Unlock()
+
+	m, found := stack.members[address]
+	if !found || m.status == memberDead {
+		return
+	}
+
+	fmt.Println("Member", address, "left")
+	m.status = memberDead
+	m.changedAt = time.Now()
+	stack.disseminate(address)
+	stack.signalMembersChanged()
+}
+
+// expireMembers declares dead the members suspected for too long, and forgets the old dead members
+func (stack *Stack) expireMembers() {
+	stack.membershipMutex.Lock()
+	defer stack.membershipMutex.Unlock()
+
+	for address, m := range stack.members {
+		switch {
+		case m.status == memberSuspect && time.Since(m.changedAt) >= suspectTimeout:
+			fmt.Println("Member", address, "is dead")
+			m.status = memberDead
+			m.changedAt = time.Now()
+			stack.disseminate(address)
+			stack.signalMembersChanged()
+		case m.status == memberDead && time.Since(m.changedAt) >= tombstoneTimeout:
+			delete(stack.members, address)
+		}
+	}
+}
+
+// applyUpdates merges the updates piggybacked on a message received from a peer
+func (stack *Stack) applyUpdates(tokens []string, from Peer) {
+	stack.membershipMutex.Lock()
+	defer stack.membershipMutex.Unlock()
+
+	for _, token := range tokens {
+		update, ok := decodeUpdate(token)
+		if !ok {
+			fmt.Println("Invalid membership update", token)
+			continue
+		}
+		firstHand := update.address == "-"
+		if firstHand {
+			update.address = from.FullAddress()
+		} else {
+			// only the member itself may claim its name
+			update.name = ""
+			if update.incarnation > maxIncarnation {
+				fmt.Println("Refused membership update with incarnation", update.incarnation, "from", from)
+				continue
+			}
+		}
+		stack.applyUpdate(update, firstHand)
+	}
+}
+
+// applyUpdate merges an update in the members, the newest incarnation wins, and for the same incarnation dead > suspect > alive
+// firstHand is true if the update was sent by the member itself
+func (stack *Stack) applyUpdate(update membershipUpdate, firstHand bool) {
+	// an update about us : a suspicion is refuted by a new incarnation, piggybacked on our next messages
+	if update.publicKey.Equal(stack.identity.Public()) {
+		if update.status != memberAlive && update.incarnation >= stack.selfIncarnation {
+			stack.selfIncarnation = nextIncarnation(update.incarnation)
+			fmt.Println("Refuting suspicion, new incarnation", stack.selfIncarnation)
+		}
+		return
+	}
+
+	m, found := stack.members[update.address]
+
+	// another identity at the same address is a new process, which replaces the previous one once alive
+	// (the key of a vouched member is only replaced by the new process itself, or by the directory)
+	if found && !m.info.PublicKey.Equal(update.publicKey) {
+		if update.status != memberAlive || m.vouched && !firstHand {
+			return
+		}
+		found = false
+	}
+
+	if !found {
+		stack.members[update.address] = &member{
+			info:        PeerInfo{Name: ClaimedName(update.name, update.publicKey), PublicKey: update.publicKey, Rooms: update.rooms},
+			incarnation: update.incarnation,
+			status:      update.status,
+			changedAt:   time.Now(),
+		}
+		stack.disseminate(update.address)
+		if update.status != memberDead {
+			stack.signalMembersChanged()
+		}
+		return
+	}
+
+	newer := update.incarnation > m.incarnation
+	same := update.incarnation == m.incarnation
+	switch {
+	case update.status == memberAlive && newer:
+	case update.status == memberSuspect && (newer || same && m.status == memberAlive):
+	case update.status == memberDead && (newer || same && m.status != memberDead):
+	default:
+		return
+	}
+
+	if m.status != update.status {
+		m.changedAt = time.Now()
+	}
+	m.status = update.status
+	m.incarnation = update.incarnation
+	if update.status == memberAlive {
+		if !m.nameVouched && update.name != "" {
+			m.info.Name = ClaimedName(update.name, update.publicKey)
+		}
+		m.info.Rooms = update.rooms
+	}
+	stack.disseminate(update.address)
+	stack.signalMembersChanged()
+}
+
+// mergeKnownPeers adds the peers listed by the directory (or discovered on the local network) as alive members
+// a member missing from the list is not removed, the probes tell if it is still alive
+func (stack *Stack) mergeKnownPeers(list map[string]ed25519.PublicKey) {
+	stack.membershipMutex.Lock()
+	defer stack.membershipMutex.Unlock()
+
+	for address, publicKey := range list {
+		m, found := stack.members[address]
+		if found && m.info.PublicKey.Equal(publicKey) && m.status != memberDead {
+			m.vouched = true
+			continue
+		}
+
+		// the peer is connected to the directory (or announcing itself), so a dead member at this address came back
+		incarnation := uint64(0)
+		if found && m.info.PublicKey.Equal(publicKey) {
+			incarnation = nextIncarnation(m.incarnation)
+		}
+		stack.members[address] = &member{
+			info:        PeerInfo{Name: address, PublicKey: publicKey},
+			incarnation: incarnation,
+			status:      memberAlive,
+			changedAt:   time.Now(),
+			vouched:     true,
+		}
+		stack.signalMembersChanged()
+	}
+}
+
+// nextIncarnation returns the incarnation after i, it stays at the largest one rather than starting again from 0
+func nextIncarnation(i uint64) uint64 {
+	if i == math.MaxUint64 {
+		return i
+	}
+	return i + 1
+}
+
+// vouchedMember returns true if the member at address has publicKey, as told by the directory
+// (or the local network, or a lookup of ours in the DHT)
+func (stack *Stack) vouchedMember(address string, publicKey ed25519.PublicKey) bool {
+	stack.membershipMutex.Lock()
+	defer stack.membershipMutex.Unlock()
+
+	m, found := stack.members[address]
+	return found && m.vouched && m.status != memberDead && m.info.PublicKey.Equal(publicKey)
+}
+
+// AddPeer adds a peer found by other means (like a lookup in the DHT) to the members
+func (stack *Stack) AddPeer(address string, publicKey ed25519.PublicKey) {
+	stack.mergeKnownPeers(map[string]ed25519.PublicKey{address: publicKey})
+}
+
+// setMemberName sets the username of a member, as told by the directory
+func (stack *Stack) setMemberName(address string, name string) bool {
+	stack.membershipMutex.Lock()
+	defer stack.membershipMutex.Unlock()
+
+	m, found := stack.members[address]
+	if !found {
+		return false
+	}
+	m.info.Name = name
+	m.nameVouched = true
+	stack.signalMembersChanged()
+	return true
+}
+
+// ClaimedName returns the name a peer claims for itself, qualified by the beginning of its key
+func ClaimedName(name string, publicKey ed25519.PublicKey) string {
+	if name == "" {
+		return ""
+	}
+	return name + "@" + EncodePublicKey(publicKey)[:claimedKeyPrefix]
+}
+
+// setMemberRooms sets the rooms of a member, as told by the directory
+func (stack *Stack) setMemberRooms(address string, rooms []string) bool {
+	stack.membershipMutex.Lock()
+	defer stack.membershipMutex.Unlock()
+
+	m, found := stack.members[address]
+	if !found {
+		return false
+	}
+	m.info.Rooms = rooms
+	stack.signalMembersChanged()
+	return true
+}
+
+// increaseIncarnation is called when our rooms change, so the other members take the new ones
+func (stack *Stack) increaseIncarnation() {
+	stack.membershipMutex.Lock()
+	defer stack.membershipMutex.Unlock()
+	stack.selfIncarnation++
+}
+
+// disseminate queues the state of the member at address, to be piggybacked on the next messages
+func (stack *Stack) disseminate(address string) {
+	stack.dissemination[address] = retransmitMult * bits.Len(uint(len(stack.members)+1))
+}
+
+// piggyback returns the updates to add to a message : our own state, then the most recent changes
+func (stack *Stack) piggyback() []string {
+	joined := stack.localRooms()
+
+	stack.membershipMutex.Lock()
+	defer stack.membershipMutex.Unlock()
+
+	updates := []string{encodeUpdate(membershipUpdate{
+		status:      memberAlive,
+		address:     "-",
+		incarnation: stack.selfIncarnation,
+		publicKey:   stack.identity.Public().(ed25519.PublicKey),
+		name:        stack.selfName,
+		rooms:       joined,
+	})}
+
+	addresses := make([]string, 0, len(stack.dissemination))
+	for address := range stack.dissemination {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return stack.dissemination[addresses[i]] > stack.dissemination[addresses[j]]
+	})
+
+	for _, address := range addresses {
+		if len(updates) > maxPiggyback {
+			break
+		}
+
+		stack.dissemination[address]--
+		if stack.dissemination[address] <= 0 {
+			delete(stack.dissemination, address)
+		}
+
+		m, found := stack.members[address]
+		if !found {
+			continue
+		}
+		// without its name, which only the member itself may claim
+		updates = append(updates, encodeUpdate(membershipUpdate{
+			status:      m.status,
+			address:     address,
+			incarnation: m.incarnation,
+			publicKey:   m.info.PublicKey,
+			rooms:       m.info.Rooms,
+		}))
+	}
+
+	return updates
+}
+
+// memberAddresses returns the addresses of the alive and suspected members, except one
+func (stack *Stack) memberAddresses(except string) []string {
+	stack.membershipMutex.Lock()
+	defer stack.membershipMutex.Unlock()
+
+	addresses := make([]string, 0, len(stack.members))
+	for address, m := range stack.members {
+		if address != except && m.status != memberDead {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// randomMembers returns at most n alive or suspected members picked at random, except one
+func (stack *Stack) randomMembers(n int, except string) []string {
+	addresses := stack.memberAddresses(except)
+	rand.Shuffle(len(addresses), func(i, j int) {
+		addresses[i], addresses[j] = addresses[j], addresses[i]
+	})
+	if len(addresses) > n {
+		addresses = addresses[:n]
+	}
+	return addresses
+}
+
+// signalMembersChanged wakes up publishMembers, the caller holds membershipMutex
+func (stack *Stack) signalMembersChanged() {
+	select {
+	case stack.membersChanged <- true:
+	default:
+	}
+}
+
+// publishMembers sends the alive and suspected members to the chat, after each change
+func (stack *Stack) publishMembers(ctx context.Context, peersList chan<- map[string]PeerInfo) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stack.membersChanged:
+		}
+
+		stack.membershipMutex.Lock()
+		list := make(map[string]PeerInfo, len(stack.members))
+		for address, m := range stack.members {
+			if m.status == memberDead {
+				continue
+			}
+			info := m.info
+			if info.Name == "" {
+				info.Name = address
+			}
+			list[address] = info
+		}
+		stack.membershipMutex.Unlock()
+
+		select {
+		case peersList <- list:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func encodeUpdate(update membershipUpdate) string {
+	fields := []string{
+		memberStatusNames[update.status],
+		update.address,
+		strconv.FormatUint(update.incarnation, 10),
+		EncodePublicKey(update.publicKey),
+		url.QueryEscape(update.name),
+	}
+	return strings.Join(append(fields, update.rooms...), ",")
+}
+
+func decodeUpdate(token string) (membershipUpdate, bool) {
+	fields := strings.Split(token, ",")
+	if len(fields) < 5 {
+		return membershipUpdate{}, false
+	}
+
+	update := membershipUpdate{address: fields[1]}
+
+	status := -1
+	for i, name := range memberStatusNames {
+		if name == fields[0] {
+			status = i
+		}
+	}
+	if status < 0 {
+		return membershipUpdate{}, false
+	}
+	update.status = memberStatus(status)
+
+	var err error
+	if update.incarnation, err = strconv.ParseUint(fields[2], 10, 64); err != nil {
+		return membershipUpdate{}, false
+	}
+	if update.publicKey, err = DecodePublicKey(fields[3]); err != nil {
+		return membershipUpdate{}, false
+	}
+	if update.name, err = url.QueryUnescape(fields[4]); err != nil {
+		return membershipUpdate{}, false
+	}
+
+	for _, room := range fields[5:] {
+		if ValidRoomName(room) {
+			update.rooms = append(update.rooms, room)
+		}
+	}
+
+	if update.address != "-" && len(strings.SplitN(update.address, ":", 2)) != 2 {
+		return membershipUpdate{}, false
+	}
+	return update, true
+}
@@ -0,0 +1,64 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"math"
+	"testing"
+)
+
+func newTestKey() ed25519.PublicKey {
+	public, _, _ := ed25519.GenerateKey(nil)
+	return public
+}
+
+// newTestMembership returns a stack which knows the vouched member 10.0.0.2:9000, and a peer sending it updates
+func newTestMembership(t *testing.T) (stack *Stack, member ed25519.PublicKey, from Peer) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	stack = NewStack(key)
+	member = newTestKey()
+	stack.mergeKnownPeers(map[string]ed25519.PublicKey{"10.0.0.2:9000": member})
+	return stack, member, Peer{address: "10.0.0.3", port: 9000, publicKey: newTestKey()}
+}
+
+func TestThirdPartyUpdateKeepsVouchedKey(t *testing.T) {
+	stack, member, from := newTestMembership(t)
+
+	// another member can't give the address of a vouched member to a key of its own
+	forged := encodeUpdate(membershipUpdate{status: memberAlive, address: "10.0.0.2:9000", incarnation: 7, publicKey: newTestKey()})
+	stack.applyUpdates([]string{forged}, from)
+	if !stack.vouchedMember("10.0.0.2:9000", member) {
+		t.Fatal("the vouched member was replaced by an update of another member")
+	}
+
+	// the new process at this address can tell it itself
+	restarted := newTestKey()
+	stack.applyUpdates([]string{encodeUpdate(membershipUpdate{status: memberAlive, address: "-", publicKey: restarted})},
+		Peer{address: "10.0.0.2", port: 9000, publicKey: restarted})
+	if m := stack.members["10.0.0.2:9000"]; !m.info.PublicKey.Equal(restarted) {
+		t.Error("the member which restarted with a new key is not known")
+	}
+}
+
+func TestHugeIncarnationIsRefused(t *testing.T) {
+	stack, member, from := newTestMembership(t)
+
+	for _, incarnation := range []uint64{math.MaxUint64, maxIncarnation + 1} {
+		dead := encodeUpdate(membershipUpdate{status: memberDead, address: "10.0.0.2:9000", incarnation: incarnation, publicKey: member})
+		stack.applyUpdates([]string{dead}, from)
+		if !stack.vouchedMember("10.0.0.2:9000", member) {
+			t.Fatalf("the member was declared dead at incarnation %d", incarnation)
+		}
+	}
+
+	// a suspicion about us at the largest incarnation accepted is still refuted
+	self := stack.identity.Public().(ed25519.PublicKey)
+	suspect := encodeUpdate(membershipUpdate{status: memberSuspect, address: "10.0.0.1:9000", incarnation: maxIncarnation, publicKey: self})
+	stack.applyUpdates([]string{suspect}, from)
+	if stack.selfIncarnation != maxIncarnation+1 {
+		t.Errorf("refuted with incarnation %d, want %d", stack.selfIncarnation, uint64(maxIncarnation)+1)
+	}
+
+	if next := nextIncarnation(math.MaxUint64); next != math.MaxUint64 {
+		t.Errorf("the incarnation after the largest one is %d", next)
+	}
+}
@@ -0,0 +1,818 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A MemoryNetwork connects the stacks of the same process without any socket, so a scenario can run
+// a directory and many peers at once : each of them gets the Transport of its own host (an IP, "10.0.0.1"),
+// and the network delays, loses and reorders what the hosts send, or cuts them in partitions.
+//
+// The connections behave like TCP : the bytes written on a side arrive in order on the other one,
+// a lost segment is sent again after retransmitDelay and holds back the segments behind it,
+// and a partition holds every segment until it heals (the connection stays open, the heartbeat must notice).
+// The packets behave like UDP : they are lost, or overtaken by the next ones, and never cross a partition.
+//
+// The random choices (jitter, losses, reordering) are drawn from the seed of the network, with a source
+// for each direction of each link, and the delays are timed by the Clock of the network : with a VirtualClock,
+// a scenario run again with the same seed and the same steps gets the same network.
+// (the deadlines of the sockets are still wall clock times, like the ones the stacks set)
+
+const (
+	retransmitDelay    = 200 * time.Millisecond // delay added to a segment each time it is lost
+	maxRetransmits     = 8                      // a segment is delivered after this number of losses, like TCP would give up
+	firstEphemeralPort = 40000                  // first local port of the dialed connections, on each host
+	acceptBacklog      = 128                    // connections waiting for Accept, the next ones are refused
+	packetQueue        = 256                    // packets waiting for ReadFrom, the next ones are lost
+)
+
+// LinkConditions are the conditions of a link between two hosts, in each direction
+type LinkConditions struct {
+	Latency     time.Duration // one way delay of every segment and packet
+	Jitter      time.Duration // random extra delay, between 0 and Jitter
+	DropRate    float64       // probability that a segment or packet is lost, from 0 to 1
+	ReorderRate float64       // probability that a packet is held back by another Latency+Jitter, so the next ones overtake it
+}
+
+// MemoryNetwork is a simulated network between the hosts of the process
+type MemoryNetwork struct {
+	seed  int64
+	clock Clock
+
+	mutex       sync.Mutex
+	conditions  LinkConditions               // of the links which have none of their own
+	links       map[string]LinkConditions    // by link (linkName of the hosts, in any order)
+	randoms     map[string]*rand.Rand        // by direction of a link
+	groups      map[string]int               // partition of each host, the hosts which are not listed reach everybody
+	changed     chan bool                    // closed, and replaced, each time the partitions change
+	held        []*memoryPipe                // pipes whose segments are held by the partition, in the order they were held
+	listeners   map[string]*memoryListener   // by address ("10.0.0.1:9000")
+	packetConns map[string]*memoryPacketConn // by address
+	nextPort    map[string]int               // next ephemeral port of each host
+}
+
+// NewMemoryNetwork builds a network with no latency, no loss and no partition, its random choices are drawn from seed
+// it runs on the wall clock, until UseClock gives it another one
+func NewMemoryNetwork(seed int64) *MemoryNetwork {
+	return &MemoryNetwork{
+		seed:        seed,
+		clock:       RealClock{},
+		links:       make(map[string]LinkConditions),
+		randoms:     make(map[string]*rand.Rand),
+		groups:      make(map[string]int),
+		changed:     make(chan bool),
+		listeners:   make(map[string]*memoryListener),
+		packetConns: make(map[string]*memoryPacketConn),
+		nextPort:    make(map[string]int),
+	}
+}
+
+// UseClock makes the network time its delays with clock, it must be called before the network is used
+func (n *MemoryNetwork) UseClock(clock Clock) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.clock = clock
+}
+
+// Host returns the transport of the host ip, its listening sockets are bound to ip whatever the address they are given
+func (n *MemoryNetwork) Host(ip string) Transport {
+	return &memoryTransport{network: n, host: ip}
+}
+
+// SetConditions sets the conditions of every link which has none of its own
+func (n *MemoryNetwork) SetConditions(conditions LinkConditions) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.conditions = conditions
+}
+
+// SetLinkConditions sets the conditions of the link between the hosts a and b, in both directions
+func (n *MemoryNetwork) SetLinkConditions(a string, b string, conditions LinkConditions) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.links[linkName(a, b)] = conditions
+}
+
+// Partition cuts the network between groups of hosts : two hosts of different groups can't reach each other,
+// a host which is in no group still reaches everybody
+// it replaces the previous partition
+func (n *MemoryNetwork) Partition(groups ...[]string) {
+	n.mutex.Lock()
+	n.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, host := range group {
+			n.groups[host] = i
+		}
+	}
+	n.signalChange()
+
+	// the segments which are now let through are delivered, in the order they were held
+	var released []*memoryPipe
+	held := n.held[:0]
+	for _, pipe := range n.held {
+		if n.reachable(pipe.from, pipe.to) {
+			pipe.held = false
+			released = append(released, pipe)
+		} else {
+			held = append(held, pipe)
+		}
+	}
+	n.held = held
+	n.mutex.Unlock()
+
+	for _, pipe := range released {
+		pipe.deliver()
+	}
+}
+
+// Heal removes the partition, the segments held by it are delivered
+func (n *MemoryNetwork) Heal() {
+	n.Partition()
+}
+
+// signalChange wakes the segments and connections waiting for a partition to heal, the lock must be held
+func (n *MemoryNetwork) signalChange() {
+	close(n.changed)
+	n.changed = make(chan bool)
+}
+
+// linkName is the name of the link between a and b, the same in both directions
+func linkName(a string, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + " " + b
+}
+
+// reachable returns true if from and to are not cut by the partition, the lock must be held
+func (n *MemoryNetwork) reachable(from string, to string) bool {
+	groupFrom, cutFrom := n.groups[from]
+	groupTo, cutTo := n.groups[to]
+	return !cutFrom || !cutTo || groupFrom == groupTo
+}
+
+// clockNow returns the time of the clock of the network
+func (n *MemoryNetwork) clockNow() time.Time {
+	n.mutex.Lock()
+	clock := n.clock
+	n.mutex.Unlock()
+	return clock.Now()
+}
+
+// afterFunc runs f after d on the clock of the network
+func (n *MemoryNetwork) afterFunc(d time.Duration, f func()) (stop func() bool) {
+	n.mutex.Lock()
+	clock := n.clock
+	n.mutex.Unlock()
+	return clock.AfterFunc(d, f)
+}
+
+// sleep waits d on the clock of the network, it returns false if cancel is closed first
+func (n *MemoryNetwork) sleep(d time.Duration, cancel <-chan struct{}) bool {
+	elapsed := make(chan struct{})
+	stop := n.afterFunc(d, func() { close(elapsed) })
+	select {
+	case <-elapsed:
+		return true
+	case <-cancel:
+		stop()
+		return false
+	}
+}
+
+// waitReachable waits until from can reach to, it returns false if cancel is closed first
+func (n *MemoryNetwork) waitReachable(from string, to string, cancel <-chan struct{}) bool {
+	for {
+		n.mutex.Lock()
+		ok, changed := n.reachable(from, to), n.changed
+		n.mutex.Unlock()
+		if ok {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-cancel:
+			return false
+		}
+	}
+}
+
+// transmission draws the delay of a segment or packet sent from a host to another, and whether it is lost
+// with reorder, it may also be held back so the next ones overtake it
+func (n *MemoryNetwork) transmission(from string, to string, reorder bool) (time.Duration, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	conditions, found := n.links[linkName(from, to)]
+	if !found {
+		conditions = n.conditions
+	}
+
+	direction := from + ">" + to
+	random, found := n.randoms[direction]
+	if !found {
+		hash := fnv.New64a()
+		hash.Write([]byte(direction))
+		random = rand.New(rand.NewSource(n.seed ^ int64(hash.Sum64())))
+		n.randoms[direction] = random
+	}
+
+	delay := conditions.Latency
+	if conditions.Jitter > 0 {
+		delay += time.Duration(random.Int63n(int64(conditions.Jitter) + 1))
+	}
+	if reorder && random.Float64() < conditions.ReorderRate {
+		delay += conditions.Latency + conditions.Jitter + time.Millisecond
+	}
+	lost := random.Float64() < conditions.DropRate
+	return delay, lost
+}
+
+// ephemeralPort returns a free local port of host for a dialed connection, the lock must be held
+func (n *MemoryNetwork) ephemeralPort(host string) int {
+	if n.nextPort[host] == 0 {
+		n.nextPort[host] = firstEphemeralPort
+	}
+	for {
+		port := n.nextPort[host]
+		n.nextPort[host]++
+		if n.nextPort[host] > 65535 {
+			n.nextPort[host] = firstEphemeralPort
+		}
+		address := net.JoinHostPort(host, strconv.Itoa(port))
+		if n.listeners[address] == nil && n.packetConns[address] == nil {
+			return port
+		}
+	}
+}
+
+// memoryTransport is the transport of a host of a MemoryNetwork
+type memoryTransport struct {
+	network *MemoryNetwork
+	host    string
+}
+
+// bind returns the local address of a listening socket, on the host of the transport whatever the host given,
+// the port 0 is any free port
+func (t *memoryTransport) bind(address string) (string, int, error) {
+	_, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port < 0 || port > 65535 {
+		return "", 0, errors.New("invalid port " + portText)
+	}
+	if port == 0 {
+		port = t.network.ephemeralPort(t.host)
+	}
+	return net.JoinHostPort(t.host, strconv.Itoa(port)), port, nil
+}
+
+// Dial opens a connection to address, once the SYN and its answer went through the link
+// the connection is refused if nobody listens on address, and waits for a partition between the hosts to heal
+func (t *memoryTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	n := t.network
+	remote, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	remoteHost := remote.IP.String()
+
+	n.mutex.Lock()
+	local := &net.TCPAddr{IP: net.ParseIP(t.host), Port: n.ephemeralPort(t.host)}
+	n.mutex.Unlock()
+	dialError := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Source: local, Addr: remote, Err: err}
+	}
+
+	// the handshake is a round trip, a lost SYN is sent again
+	for i := 0; ; i++ {
+		if !n.waitReachable(t.host, remoteHost, ctx.Done()) {
+			return nil, dialError(ctx.Err())
+		}
+		there, lostThere := n.transmission(t.host, remoteHost, false)
+		back, lostBack := n.transmission(remoteHost, t.host, false)
+		delay := there + back
+		if lostThere || lostBack {
+			delay += retransmitDelay
+		}
+
+		if !n.sleep(delay, ctx.Done()) {
+			return nil, dialError(ctx.Err())
+		}
+		if !lostThere && !lostBack || i == maxRetransmits {
+			break
+		}
+	}
+
+	n.mutex.Lock()
+	listener := n.listeners[remote.String()]
+	n.mutex.Unlock()
+	if listener == nil {
+		return nil, dialError(syscall.ECONNREFUSED)
+	}
+
+	toRemote := newMemoryPipe(n, t.host, remoteHost)
+	toLocal := newMemoryPipe(n, remoteHost, t.host)
+	client := &memoryConn{local: local, remote: remote, in: toLocal, out: toRemote}
+	server := &memoryConn{local: remote, remote: local, in: toRemote, out: toLocal}
+	if !listener.enqueue(server) {
+		return nil, dialError(syscall.ECONNREFUSED)
+	}
+	return client, nil
+}
+
+// Listen opens a listening socket on the port of address
+func (t *memoryTransport) Listen(address string) (net.Listener, error) {
+	n := t.network
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	local, port, err := t.bind(address)
+	if err != nil {
+		return nil, err
+	}
+	if n.listeners[local] != nil {
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Err: syscall.EADDRINUSE}
+	}
+
+	listener := &memoryListener{
+		network: n,
+		address: &net.TCPAddr{IP: net.ParseIP(t.host), Port: port},
+		backlog: make(chan *memoryConn, acceptBacklog),
+		closed:  make(chan struct{}),
+	}
+	n.listeners[local] = listener
+	return listener, nil
+}
+
+// ListenPacket opens a packet socket on the port of address
+func (t *memoryTransport) ListenPacket(address string) (net.PacketConn, error) {
+	n := t.network
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	local, port, err := t.bind(address)
+	if err != nil {
+		return nil, err
+	}
+	if n.packetConns[local] != nil {
+		return nil, &net.OpError{Op: "listen", Net: "udp", Err: syscall.EADDRINUSE}
+	}
+
+	conn := &memoryPacketConn{
+		network: n,
+		address: &net.UDPAddr{IP: net.ParseIP(t.host), Port: port},
+		inbox:   make(chan memoryPacket, packetQueue),
+		closed:  make(chan struct{}),
+		wake:    make(chan bool, 1),
+	}
+	n.packetConns[local] = conn
+	return conn, nil
+}
+
+// memoryListener accepts the connections dialed to its address
+type memoryListener struct {
+	network   *MemoryNetwork
+	address   *net.TCPAddr
+	backlog   chan *memoryConn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// enqueue gives a new connection to Accept, it returns false if the listener is closed or its backlog is full
+func (l *memoryListener) enqueue(conn *memoryConn) bool {
+	select {
+	case <-l.closed:
+		return false
+	default:
+	}
+
+	select {
+	case l.backlog <- conn:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.backlog:
+		return conn, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.address, Err: net.ErrClosed}
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+
+		l.network.mutex.Lock()
+		delete(l.network.listeners, l.address.String())
+		l.network.mutex.Unlock()
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.address
+}
+
+// memorySegment is a piece of a stream on its way, fin closes the stream once everything before it is delivered
+type memorySegment struct {
+	data []byte
+	fin  bool
+	due  time.Time
+}
+
+// memoryPipe is a direction of a connection : the segments written by a side, until they are read by the other one
+// a timer of the clock delivers the segments which are due, in the order they were written
+type memoryPipe struct {
+	network  *MemoryNetwork
+	from, to string // hosts
+	held     bool   // the pipe is in the held list of the network, guarded by the lock of the network
+
+	mutex        sync.Mutex
+	inFlight     []memorySegment // written, not delivered yet
+	lastDue      time.Time       // due time of the last segment written, the next ones can't arrive before
+	received     []byte          // delivered, not read yet
+	eof          bool            // the writer closed the stream, and everything it wrote was delivered
+	writerClosed bool
+	readerClosed bool // the segments delivered afterwards are dropped, and the writer gets a reset
+	reset        bool
+	wake         chan bool // wakes the reader when something changed
+}
+
+func newMemoryPipe(n *MemoryNetwork, from string, to string) *memoryPipe {
+	return &memoryPipe{
+		network: n,
+		from:    from,
+		to:      to,
+		wake:    make(chan bool, 1),
+	}
+}
+
+// signal wakes the reader, the lock must be held
+func (p *memoryPipe) signal() {
+	select {
+	case p.wake <- true:
+	default:
+	}
+}
+
+// send writes a segment, it arrives after the delay of the link and after the segments written before it
+func (p *memoryPipe) send(data []byte, fin bool) error {
+	delay, lost := p.network.transmission(p.from, p.to, false)
+	for i := 0; lost && i < maxRetransmits; i++ {
+		var again time.Duration
+		again, lost = p.network.transmission(p.from, p.to, false)
+		delay += retransmitDelay + again
+	}
+
+	now := p.network.clockNow()
+
+	p.mutex.Lock()
+	if p.reset {
+		p.mutex.Unlock()
+		return syscall.ECONNRESET
+	}
+	if p.writerClosed {
+		p.mutex.Unlock()
+		return net.ErrClosed
+	}
+	p.writerClosed = fin
+
+	due := now.Add(delay)
+	if due.Before(p.lastDue) {
+		due = p.lastDue
+	}
+	p.lastDue = due
+	p.inFlight = append(p.inFlight, memorySegment{data: data, fin: fin, due: due})
+	p.mutex.Unlock()
+
+	p.network.afterFunc(due.Sub(now), p.deliver)
+	return nil
+}
+
+// deliver hands the segments which are due to the reader, in order, unless the partition holds them :
+// the pipe is then delivered by the Partition which lets them through
+func (p *memoryPipe) deliver() {
+	n := p.network
+	n.mutex.Lock()
+	reachable := n.reachable(p.from, p.to)
+	if !reachable && !p.held {
+		p.held = true
+		n.held = append(n.held, p)
+	}
+	n.mutex.Unlock()
+	if !reachable {
+		return
+	}
+
+	now := n.clockNow()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.readerClosed {
+		p.inFlight = nil
+		return
+	}
+	delivered := false
+	for len(p.inFlight) > 0 && !p.inFlight[0].due.After(now) {
+		segment := p.inFlight[0]
+		p.inFlight = p.inFlight[1:]
+		p.received = append(p.received, segment.data...)
+		p.eof = p.eof || segment.fin
+		delivered = true
+	}
+	if delivered {
+		p.signal()
+	}
+}
+
+// closeReader drops what is not read yet, the writer gets a reset on its next write
+func (p *memoryPipe) closeReader() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.readerClosed {
+		return
+	}
+	p.readerClosed = true
+	p.reset = true
+	p.received = nil
+	p.inFlight = nil
+	p.signal()
+}
+
+// memoryConn is a side of a connection of a MemoryNetwork
+type memoryConn struct {
+	local, remote *net.TCPAddr
+	in, out       *memoryPipe
+
+	deadlineMutex sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (c *memoryConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "tcp", Source: c.local, Addr: c.remote, Err: err}
+}
+
+func (c *memoryConn) Read(b []byte) (int, error) {
+	for {
+		c.in.mutex.Lock()
+		switch {
+		case c.in.readerClosed:
+			c.in.mutex.Unlock()
+			return 0, c.opError("read", net.ErrClosed)
+		case len(c.in.received) > 0:
+			n := copy(b, c.in.received)
+			c.in.received = c.in.received[n:]
+			c.in.mutex.Unlock()
+			return n, nil
+		case c.in.eof:
+			c.in.mutex.Unlock()
+			return 0, io.EOF
+		}
+		c.in.mutex.Unlock()
+
+		c.deadlineMutex.Lock()
+		deadline := c.readDeadline
+		c.deadlineMutex.Unlock()
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		}
+		waitUntil(deadline, c.in.wake)
+	}
+}
+
+func (c *memoryConn) Write(b []byte) (int, error) {
+	c.deadlineMutex.Lock()
+	deadline := c.writeDeadline
+	c.deadlineMutex.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, c.opError("write", os.ErrDeadlineExceeded)
+	}
+
+	c.in.mutex.Lock()
+	closed := c.in.readerClosed
+	c.in.mutex.Unlock()
+	if closed {
+		return 0, c.opError("write", net.ErrClosed)
+	}
+
+	if err := c.out.send(append([]byte(nil), b...), false); err != nil {
+		return 0, c.opError("write", err)
+	}
+	return len(b), nil
+}
+
+// Close sends a FIN after what was written, and drops what is received afterwards
+func (c *memoryConn) Close() error {
+	c.in.mutex.Lock()
+	closed := c.in.readerClosed
+	c.in.mutex.Unlock()
+	if closed {
+		return c.opError("close", net.ErrClosed)
+	}
+
+	c.in.closeReader()
+	c.out.send(nil, true)
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	c.readDeadline = t
+	c.deadlineMutex.Unlock()
+
+	c.in.mutex.Lock()
+	c.in.signal()
+	c.in.mutex.Unlock()
+	return nil
+}
+
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+// waitUntil waits until wake is signaled, or until the deadline (if it is not zero)
+func waitUntil(deadline time.Time, wake chan bool) {
+	if deadline.IsZero() {
+		<-wake
+		return
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-wake:
+	case <-timer.C:
+	}
+}
+
+// memoryPacket is a packet received by a memoryPacketConn
+type memoryPacket struct {
+	data   []byte
+	source *net.UDPAddr
+}
+
+// memoryPacketConn is a packet socket of a MemoryNetwork
+type memoryPacketConn struct {
+	network   *MemoryNetwork
+	address   *net.UDPAddr
+	inbox     chan memoryPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+	wake      chan bool // wakes ReadFrom when the deadline changes
+
+	deadlineMutex sync.Mutex
+	readDeadline  time.Time
+}
+
+// stopTimer stops timer, if there is one
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+func (c *memoryPacketConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Addr: c.address, Err: err}
+}
+
+func (c *memoryPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.deadlineMutex.Lock()
+		deadline := c.readDeadline
+		c.deadlineMutex.Unlock()
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+		}
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+
+		select {
+		case packet := <-c.inbox:
+			stopTimer(timer)
+			return copy(b, packet.data), packet.source, nil
+		case <-c.closed:
+			stopTimer(timer)
+			return 0, nil, c.opError("read", net.ErrClosed)
+		case <-c.wake:
+		case <-timeout:
+		}
+		stopTimer(timer)
+	}
+}
+
+// WriteTo sends a packet to addr, it is lost silently like a UDP datagram
+func (c *memoryPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+
+	destination, err := net.ResolveUDPAddr("udp", addr.String())
+	if err != nil {
+		return 0, c.opError("write", err)
+	}
+
+	n := c.network
+	from, to := c.address.IP.String(), destination.IP.String()
+	delay, lost := n.transmission(from, to, true)
+	if lost {
+		return len(b), nil
+	}
+
+	packet := memoryPacket{data: append([]byte(nil), b...), source: c.address}
+	n.afterFunc(delay, func() {
+		n.mutex.Lock()
+		receiver := n.packetConns[destination.String()]
+		reachable := n.reachable(from, to)
+		n.mutex.Unlock()
+		if receiver == nil || !reachable {
+			return
+		}
+
+		select {
+		case receiver.inbox <- packet:
+		default:
+		}
+	})
+	return len(b), nil
+}
+
+func (c *memoryPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+
+		c.network.mutex.Lock()
+		delete(c.network.packetConns, c.address.String())
+		c.network.mutex.Unlock()
+	})
+	return nil
+}
+
+func (c *memoryPacketConn) LocalAddr() net.Addr {
+	return c.address
+}
+
+func (c *memoryPacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memoryPacketConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	c.readDeadline = t
+	c.deadlineMutex.Unlock()
+
+	select {
+	case c.wake <- true:
+	default:
+	}
+	return nil
+}
+
+// SetWriteDeadline does nothing, writing never blocks
+func (c *memoryPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,143 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// packetsReceived sends numbered packets from a host to another on a lossy network timed by a virtual clock,
+// and returns the numbers received, in the order they were received
+func packetsReceived(t *testing.T, seed int64) []int {
+	t.Helper()
+	n := NewMemoryNetwork(seed)
+	clock := NewVirtualClock(time.Unix(0, 0))
+	n.UseClock(clock)
+	n.SetConditions(LinkConditions{Latency: 20 * time.Millisecond, Jitter: 10 * time.Millisecond, DropRate: 0.2, ReorderRate: 0.2})
+
+	sender, err := n.Host("10.0.0.1").ListenPacket(":7000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, err := n.Host("10.0.0.2").ListenPacket(":7000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	destination := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 7000}
+	for i := 0; i < 100; i++ {
+		sender.WriteTo([]byte(strconv.Itoa(i)), destination)
+		clock.Advance(time.Millisecond)
+	}
+	clock.Advance(time.Second)
+
+	var received []int
+	buffer := make([]byte, 16)
+	receiver.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	for {
+		size, _, err := receiver.ReadFrom(buffer)
+		if err != nil {
+			return received
+		}
+		i, _ := strconv.Atoi(string(buffer[:size]))
+		received = append(received, i)
+	}
+}
+
+func TestVirtualClockReplaysPackets(t *testing.T) {
+	first := packetsReceived(t, 42)
+	if len(first) == 0 || len(first) == 100 {
+		t.Fatalf("%d packets out of 100 received, some should be lost", len(first))
+	}
+	if again := packetsReceived(t, 42); !reflect.DeepEqual(first, again) {
+		t.Fatalf("the same seed gave another run :\n%v\n%v", first, again)
+	}
+	if other := packetsReceived(t, 43); reflect.DeepEqual(first, other) {
+		t.Fatal("another seed gave the same run")
+	}
+}
+
+// expectNothing checks that nothing can be read from conn yet
+func expectNothing(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+	if size, err := conn.Read(make([]byte, 16)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read %d bytes (%v), nothing should have arrived", size, err)
+	}
+}
+
+// expectRead checks that want can be read from conn right away
+func expectRead(t *testing.T, conn net.Conn, want string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	buffer := make([]byte, 16)
+	size, err := conn.Read(buffer)
+	if err != nil || string(buffer[:size]) != want {
+		t.Fatalf("read %q (%v), want %q", buffer[:size], err, want)
+	}
+}
+
+func TestVirtualClockTimesStreams(t *testing.T) {
+	n := NewMemoryNetwork(1)
+	clock := NewVirtualClock(time.Unix(0, 0))
+	n.UseClock(clock)
+	n.SetConditions(LinkConditions{Latency: 50 * time.Millisecond})
+
+	ln, err := n.Host("10.0.0.2").Listen(":9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// the handshake is a round trip on the virtual clock
+	dialed := make(chan net.Conn)
+	go func() {
+		conn, err := n.Host("10.0.0.1").Dial(context.Background(), "10.0.0.2:9000")
+		if err != nil {
+			t.Error(err)
+		}
+		dialed <- conn
+	}()
+	var client net.Conn
+	for done := false; !done; {
+		select {
+		case client = <-dialed:
+			done = true
+		case <-time.After(time.Millisecond):
+			clock.Advance(10 * time.Millisecond)
+		}
+	}
+	if client == nil {
+		t.FailNow()
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// a segment arrives after the latency of the link, not before
+	client.Write([]byte("hello"))
+	clock.Advance(49 * time.Millisecond)
+	expectNothing(t, server)
+	clock.Advance(time.Millisecond)
+	expectRead(t, server, "hello")
+
+	// a partition holds the segments until it heals
+	n.Partition([]string{"10.0.0.1"}, []string{"10.0.0.2"})
+	client.Write([]byte("held"))
+	clock.Advance(time.Second)
+	expectNothing(t, server)
+	n.Heal()
+	expectRead(t, server, "held")
+}
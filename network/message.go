@@ -1,31 +1,23 @@
 package network
 
 import (
-	"bufio"
 	"fmt"
-	"net"
 	"strings"
+	"unicode"
 )
 
+// Message is the unit exchanged between peers and with the directory server
+// version is the framed protocol version it was received with (0 for the legacy line protocol)
 type Message struct {
-	Kind string
-	Data string
+	Kind    string
+	Data    string
+	version byte
 }
 
 type formatError struct {
 	raw string
 }
 
-func GetNextMessage(conn net.Conn) (Message, error) {
-	data, err := bufio.NewReader(conn).ReadString('\n')
-
-	if err != nil {
-		return Message{}, err
-	}
-
-	return createMessage(strings.TrimSpace(data))
-}
-
 func createMessage(raw string) (Message, error) {
 	rawSplit := strings.SplitN(raw, " ", 2)
 
@@ -34,26 +26,35 @@ func createMessage(raw string) (Message, error) {
 	}
 
 	if len(rawSplit) == 2 {
-		return Message{rawSplit[0], rawSplit[1]}, nil
+		return Message{Kind: rawSplit[0], Data: rawSplit[1]}, nil
 	} else {
-		return Message{rawSplit[0], ""}, nil
+		return Message{Kind: rawSplit[0], Data: ""}, nil
 	}
 }
 
-func (m Message) Send(conn net.Conn) error {
-	fmt.Println("Sent :", m)
-	_, err := conn.Write([]byte(m.Kind + " " + strings.TrimSpace(m.Data) + "\n"))
-	return err
-}
-
 func (m Message) String() string {
 	if m.Data != "" {
-		return fmt.Sprintf("[%s] %s", m.Kind, m.Data)
+		return fmt.Sprintf("[%s] %s", Printable(m.Kind), Printable(m.Data))
 	} else {
-		return fmt.Sprintf("[%s] %s", m.Kind, "<nil>")
+		return fmt.Sprintf("[%s] %s", Printable(m.Kind), "<nil>")
 	}
 }
 
+// Printable returns text on a single line and without control characters, so the text sent by a peer
+// can't start lines of its own or send escape sequences to the terminal and the webpage
+// the line breaks and tabs become spaces, the other control characters (and the bidirectional overrides) are removed
+func Printable(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\r' || r == '\t' || unicode.In(r, unicode.Zl, unicode.Zp):
+			return ' '
+		case unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r):
+			return -1
+		}
+		return r
+	}, text)
+}
+
 func (e *formatError) Error() string {
 	return fmt.Sprintf("Malformated message : %s", e.raw)
 }
@@ -0,0 +1,23 @@
+package network
+
+import "testing"
+
+func TestPrintable(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"hello world", "hello world"},
+		{"héllo ☺", "héllo ☺"},
+		// a peer can't start a line of its own, or fake the lines of the chat and of the webpage
+		{"hi\n(private) [bob] secret", "hi (private) [bob] secret"},
+		{"hi\r\n\x1b]peers [\"evil\"]", "hi  ]peers [\"evil\"]"},
+		{"\x1b[H\x1b[2Jcleared", "[H[2Jcleared"},
+		{"a\tb c", "a b c"},
+		{"\x00\x07\x7f\u0085\u202eevil", "evil"},
+	}
+	for _, test := range tests {
+		if got := Printable(test.text); got != test.want {
+			t.Errorf("Printable(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package network
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RequestName asks the directory server for the username name, password is needed if the name is protected by one
+// the directory answers with WELCOME if it gives us the name, and every peer is told
+// it returns false if we are not connected to a directory
+func (stack *Stack) RequestName(name string, password string) bool {
+	stack.namesMutex.Lock()
+	stack.chosenName, stack.chosenPassword = name, password
+	stack.namesMutex.Unlock()
+
+	conn := stack.currentDirectoryConn()
+	if conn == nil {
+		return false
+	}
+	return send(conn, "NICK", strings.TrimSpace(name+" "+password)) == nil
+}
+
+// ProtectName asks the directory server to reserve our username in the next sessions :
+// to our identity key if password is empty, to whoever knows password otherwise
+// it returns false if we are not connected to a directory
+func (stack *Stack) ProtectName(password string) bool {
+	conn := stack.currentDirectoryConn()
+	if conn == nil {
+		return false
+	}
+	return send(conn, "REGISTER", password) == nil
+}
+
+// requestChosenName asks again the username chosen with RequestName to a new directory connection
+func (stack *Stack) requestChosenName(conn *Conn) {
+	stack.namesMutex.Lock()
+	name, password := stack.chosenName, stack.chosenPassword
+	stack.namesMutex.Unlock()
+
+	if name != "" {
+		send(conn, "NICK", strings.TrimSpace(name+" "+password))
+	}
+}
+
+// handleRegistered reads "REGISTERED <username> key|password", sent by the directory when it protected our username
+func (stack *Stack) handleRegistered(data string) {
+	fields := strings.Fields(data)
+	if len(fields) != 2 {
+		fmt.Println("Invalid REGISTERED message", data)
+		return
+	}
+
+	fmt.Println("Username", fields[0], "is now protected by your", fields[1])
+}
@@ -1,15 +1,35 @@
 package network
 
 import (
+	"crypto/ed25519"
+	"fmt"
 	"strconv"
 )
 
+// maximum number of outgoing messages waiting to be sent to a peer
+const sendQueueSize = 32
+
 // Peer represent a known peer with its address ("a.b.c.d") and port (0000).
+// name is its username, empty until we know it, and rooms the chat rooms it joined
+// publicKey is its identity key, as registered in the directory server
+// state is the state of our outgoing connection to this peer, and liveness what its heartbeat tells us
 // Send is the queue of outgoing messages to this peer
 type Peer struct {
-	address string
-	port    int
-	Send    chan Message
+	address   string
+	port      int
+	name      string
+	publicKey ed25519.PublicKey
+	rooms     []string
+	state     ConnectionState
+	liveness  Liveness
+	Send      chan Message
+}
+
+// PeerInfo is what the directory server tells us about a peer
+type PeerInfo struct {
+	Name      string
+	PublicKey ed25519.PublicKey
+	Rooms     []string
 }
 
 // PeersMap is an interface to a collection of Peers with Get and Find methods.
@@ -20,8 +40,11 @@ type PeersMap interface {
 	Find(address string) (bool, Peer)
 }
 
-// String return a string version of current peer
+// String return a string version of current peer (its username if we know it)
 func (p Peer) String() string {
+	if p.name != "" {
+		return p.name
+	}
 	return p.address + ":" + strconv.Itoa(p.port)
 }
 
@@ -30,16 +53,77 @@ func (p Peer) FullAddress() string {
 	return p.address + ":" + strconv.Itoa(p.port)
 }
 
+// SetRooms sets the chat rooms joined by current peer
+func (p *Peer) SetRooms(rooms []string) {
+	p.rooms = rooms
+}
+
+// Rooms returns the chat rooms joined by current peer
+func (p Peer) Rooms() []string {
+	return p.rooms
+}
+
+// InRoom returns true if current peer joined room
+func (p Peer) InRoom(room string) bool {
+	for _, r := range p.rooms {
+		if r == room {
+			return true
+		}
+	}
+	return false
+}
+
+// PublicKey returns the identity key of current peer
+func (p Peer) PublicKey() ed25519.PublicKey {
+	return p.publicKey
+}
+
+// Enqueue adds a message to the sending queue of current peer
+// the message is dropped if the queue is full, so a slow or dead peer never blocks the caller
+func (p Peer) Enqueue(msg Message) {
+	select {
+	case p.Send <- msg:
+	default:
+		fmt.Println("Sending queue of", p, "is full, dropped", msg)
+	}
+}
+
+// SetConnectionState sets the state of the outgoing connection to current peer
+func (p *Peer) SetConnectionState(state ConnectionState) {
+	p.state = state
+}
+
+// ConnectionState returns the state of the outgoing connection to current peer
+func (p Peer) ConnectionState() ConnectionState {
+	return p.state
+}
+
+// SetLiveness sets the liveness of current peer
+func (p *Peer) SetLiveness(liveness Liveness) {
+	p.liveness = liveness
+}
+
+// Liveness returns the liveness of current peer
+func (p Peer) Liveness() Liveness {
+	return p.liveness
+}
+
 // SetName sets the username of current peer
 func (p *Peer) SetName(name string) {
+	p.name = name
+}
 
+// Name returns the username of current peer, or an empty string if we don't know it
+func (p Peer) Name() string {
+	return p.name
 }
 
-// CreatePeer return a new Peer with said addresse and port, and a new messages queue
-func CreatePeer(addr string, port int) Peer {
+// CreatePeer return a new Peer with said addresse, port and identity key, and a new messages queue
+func CreatePeer(addr string, port int, publicKey ed25519.PublicKey) Peer {
 	return Peer{
-		address: addr,
-		port:    port,
-		Send:    make(chan Message),
+		address:   addr,
+		port:      port,
+		publicKey: publicKey,
+		Send:      make(chan Message, sendQueueSize),
 	}
 }
@@ -0,0 +1,283 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	minReconnectDelay = 500 * time.Millisecond // delay before the first reconnection, doubled after each failure
+	maxReconnectDelay = 30 * time.Second
+	writeTimeout      = 5 * time.Second // time allowed to send a message before the connection is considered lost
+)
+
+// ConnectionState is the state of the outgoing connection to a peer
+type ConnectionState int
+
+const (
+	// Connecting is the state of a connection being opened for the first time
+	Connecting ConnectionState = iota
+	// Connected is the state of an open and authenticated connection
+	Connected
+	// Reconnecting is the state of a lost (or failed) connection, waiting to be opened again
+	Reconnecting
+	// Stopped is the state of a connection closed because the peer left
+	Stopped
+)
+
+// String returns the name of the state, as shown by /who
+func (state ConnectionState) String() string {
+	switch state {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	case Stopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// ConnectionEvent tells the chat that the state of the connection to Peer, or its liveness, changed
+// Err is the reason of the change to Reconnecting
+type ConnectionEvent struct {
+	Peer     Peer
+	State    ConnectionState
+	Liveness Liveness
+	Err      error
+}
+
+// PeerConnection is the outgoing connection to a peer, in charge of sending the messages of its queue (Peer.Send).
+// The connection is opened again, with an exponential backoff, until Stop or Shutdown is called (or its context is done).
+// A message which could not be sent is sent again after the reconnection, the queue is bounded and drops new messages when full.
+// The peer is pinged every heartbeat interval, and the connection is opened again when it stops answering.
+type PeerConnection struct {
+	stack         *Stack
+	peer          Peer
+	localChatPort int
+	events        chan<- ConnectionEvent
+	stop          chan bool
+	stopOnce      sync.Once
+	shutdown      chan bool // closed by Shutdown, the queue is sent before shutdownDeadline
+	shutdownOnce  sync.Once
+	finished      chan bool // closed when the connection is stopped
+	state         ConnectionState
+	liveness      Liveness
+	lastSeen      time.Time // last time we got a PONG (or opened the connection)
+
+	shutdownDeadline time.Time
+}
+
+// NewPeerConnection builds the connection of the stack to peer, the state changes are sent to events
+// localChatPort is our own listening port and is used so the other peer can recognise us.
+func (stack *Stack) NewPeerConnection(peer Peer, localChatPort int, events chan<- ConnectionEvent) *PeerConnection {
+	return &PeerConnection{
+		stack:         stack,
+		peer:          peer,
+		localChatPort: localChatPort,
+		events:        events,
+		stop:          make(chan bool),
+		shutdown:      make(chan bool),
+		finished:      make(chan bool),
+	}
+}
+
+// Start opens the connection and starts sending messages in the background, until ctx is done
+func (pc *PeerConnection) Start(ctx context.Context) {
+	go pc.run(ctx)
+}
+
+// Stop closes the connection and stops reconnecting, the messages still queued are dropped
+func (pc *PeerConnection) Stop() {
+	pc.stopOnce.Do(func() {
+		close(pc.stop)
+	})
+}
+
+// Shutdown sends the messages still queued and BYE, so the peer knows we are leaving, then closes the connection
+// it waits until the connection is closed, and gives up (dropping the messages) when ctx is done
+// a connection which is not open is closed at once
+func (pc *PeerConnection) Shutdown(ctx context.Context) {
+	pc.shutdownOnce.Do(func() {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadline = time.Now().Add(writeTimeout)
+		}
+		pc.shutdownDeadline = deadline
+		close(pc.shutdown)
+	})
+
+	select {
+	case <-pc.finished:
+	case <-ctx.Done():
+	}
+	pc.Stop()
+}
+
+func (pc *PeerConnection) run(ctx context.Context) {
+	defer close(pc.finished)
+
+	var pending *Message // message to send again after a reconnection
+	delay := minReconnectDelay
+
+	for {
+		conn, err := pc.stack.dial(ctx, pc.peer, pc.localChatPort)
+		if err == nil {
+			fmt.Println("Connected to", pc.peer.FullAddress())
+			delay = minReconnectDelay
+			pc.lastSeen = time.Now()
+			pc.report(ctx, Connected, Alive, nil)
+
+			pending, err = pc.send(ctx, conn, pending)
+			conn.Close()
+			if err == nil {
+				pc.report(ctx, Stopped, pc.liveness, nil)
+				return
+			}
+		}
+
+		fmt.Println("Connection to", pc.peer, "failed :", err, "- retrying in", delay)
+		liveness := Suspect
+		if pc.lastSeen.IsZero() || time.Since(pc.lastSeen) >= pc.stack.heartbeat.DeadTimeout {
+			liveness = Dead
+		}
+		pc.report(ctx, Reconnecting, liveness, err)
+
+		select {
+		case <-pc.stop:
+			pc.report(ctx, Stopped, pc.liveness, nil)
+			return
+		case <-pc.shutdown:
+			pc.report(ctx, Stopped, pc.liveness, nil)
+			return
+		case <-ctx.Done():
+			pc.report(ctx, Stopped, pc.liveness, nil)
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// send writes the queued messages to conn until it is stopped or shut down (it returns a nil error) or the connection fails
+// the message being sent when the connection failed is returned, so it is not lost
+func (pc *PeerConnection) send(ctx context.Context, conn *Conn, pending *Message) (*Message, error) {
+	// the remote peer only writes PONG messages on this connection, reading also detects when it is closed
+	closed := make(chan error, 1)
+	pongs := make(chan bool, 1)
+	go func() {
+		for {
+			message, err := conn.Next()
+			if err != nil {
+				closed <- err
+				return
+			}
+			if message.Kind == "PONG" {
+				select {
+				case pongs <- true:
+				default:
+				}
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(pc.stack.heartbeat.Interval)
+	defer ticker.Stop()
+
+	for {
+		if pending == nil {
+			select {
+			case <-pc.stop:
+				return nil, nil
+			case <-ctx.Done():
+				return nil, nil
+			case <-pc.shutdown:
+				if err := pc.drain(conn); err != nil {
+					fmt.Println("Failed to send the queue of", pc.peer, "before leaving :", err)
+				}
+				return nil, nil
+			case err := <-closed:
+				return nil, err
+			case <-pongs:
+				pc.lastSeen = time.Now()
+				pc.report(ctx, Connected, Alive, nil)
+				continue
+			case <-ticker.C:
+				liveness := pc.stack.livenessAfter(time.Since(pc.lastSeen))
+				if liveness == Dead {
+					return nil, errors.New("no answer to PING for " + time.Since(pc.lastSeen).Round(time.Second).String())
+				}
+				pc.report(ctx, Connected, liveness, nil)
+
+				if err := pc.write(conn, Message{Kind: "PING", Data: strconv.FormatInt(time.Now().UnixMilli(), 10)}); err != nil {
+					return nil, err
+				}
+				continue
+			case msg := <-pc.peer.Send:
+				pending = &msg
+			}
+		}
+
+		if err := pc.write(conn, *pending); err != nil {
+			return pending, err
+		}
+		pending = nil
+	}
+}
+
+// write sends a message, the connection is considered lost if it can't be sent within writeTimeout
+func (pc *PeerConnection) write(conn *Conn, msg Message) error {
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return conn.Send(msg)
+}
+
+// drain writes the messages left in the queue, then BYE, before the deadline given to Shutdown
+func (pc *PeerConnection) drain(conn *Conn) error {
+	conn.SetWriteDeadline(pc.shutdownDeadline)
+	for {
+		select {
+		case msg := <-pc.peer.Send:
+			if err := conn.Send(msg); err != nil {
+				return err
+			}
+		default:
+			return conn.Send(Message{Kind: "BYE"})
+		}
+	}
+}
+
+// report sends a change of the state or liveness of the connection to the chat, without blocking a stopped (or shut down)
+// connection, nor one whose ctx is done (the chat may not read the events anymore)
+// nothing is sent if neither changed
+func (pc *PeerConnection) report(ctx context.Context, state ConnectionState, liveness Liveness, err error) {
+	if state == pc.state && liveness == pc.liveness {
+		return
+	}
+	pc.state, pc.liveness = state, liveness
+	event := ConnectionEvent{Peer: pc.peer, State: state, Liveness: liveness, Err: err}
+
+	if state == Stopped {
+		select {
+		case pc.events <- event:
+		default:
+		}
+		return
+	}
+
+	select {
+	case pc.events <- event:
+	case <-pc.stop:
+	case <-pc.shutdown:
+	case <-ctx.Done():
+	}
+}
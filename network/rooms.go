@@ -0,0 +1,89 @@
+package network
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ValidRoomName returns true if room is a valid room name ("#name", without spaces)
+func ValidRoomName(room string) bool {
+	return len(room) > 1 && strings.HasPrefix(room, "#") && !strings.ContainsAny(room, " \t\r\n,")
+}
+
+// JoinRoom announces to the directory server (and to the other members) that we joined room
+func (stack *Stack) JoinRoom(room string) {
+	stack.roomsMutex.Lock()
+	stack.joinedRooms[room] = true
+	conn := stack.directoryConn
+	stack.roomsMutex.Unlock()
+
+	stack.increaseIncarnation()
+
+	if conn != nil {
+		send(conn, "JOIN", room)
+	}
+}
+
+// PartRoom announces to the directory server (and to the other members) that we left room
+func (stack *Stack) PartRoom(room string) {
+	stack.roomsMutex.Lock()
+	delete(stack.joinedRooms, room)
+	conn := stack.directoryConn
+	stack.roomsMutex.Unlock()
+
+	stack.increaseIncarnation()
+
+	if conn != nil {
+		send(conn, "PART", room)
+	}
+}
+
+// setDirectoryConn sets the connection used by JoinRoom, PartRoom and RequestName, and announces the rooms we already joined and our username
+// it is set to nil when the connection is lost
+func (stack *Stack) setDirectoryConn(conn *Conn) {
+	stack.roomsMutex.Lock()
+	stack.directoryConn = conn
+	stack.roomsMutex.Unlock()
+
+	if conn == nil {
+		return
+	}
+	for _, room := range stack.localRooms() {
+		send(conn, "JOIN", room)
+	}
+	stack.requestChosenName(conn)
+}
+
+// currentDirectoryConn returns the connection to the directory server, or nil if we are not connected
+func (stack *Stack) currentDirectoryConn() *Conn {
+	stack.roomsMutex.Lock()
+	defer stack.roomsMutex.Unlock()
+	return stack.directoryConn
+}
+
+// localRooms returns the sorted rooms joined by the local client
+func (stack *Stack) localRooms() []string {
+	stack.roomsMutex.Lock()
+	defer stack.roomsMutex.Unlock()
+
+	rooms := make([]string, 0, len(stack.joinedRooms))
+	for room := range stack.joinedRooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// handleRooms reads "ROOMS <a.b.c.d:0000> [#room ...]", the list of the rooms joined by a peer
+func (stack *Stack) handleRooms(data string) {
+	fields := strings.Fields(data)
+	if len(fields) < 1 {
+		fmt.Println("Invalid ROOMS message", data)
+		return
+	}
+
+	if !stack.setMemberRooms(fields[0], fields[1:]) {
+		fmt.Println("ROOMS message for unknown peer", fields[0])
+	}
+}
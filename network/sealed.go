@@ -0,0 +1,187 @@
+package network
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"math/big"
+)
+
+// Sealed messages are encrypted for a single recipient and signed by their sender,
+// so they can be relayed by any peer (or the directory) without being read or modified :
+//
+//	sender public key (32) | ephemeral X25519 public key (32) | nonce (12) | AES-256-GCM ciphertext | Ed25519 signature (64)
+//
+// The encryption key is derived from an X25519 exchange between the ephemeral key and the recipient identity key,
+// converted from Ed25519 to its X25519 (Montgomery) form.
+const (
+	sealContext   = "GOssip sealed message "
+	sealNonceSize = 12
+	sealKeySize   = 32
+)
+
+// curve25519P is the prime 2^255 - 19
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// Seal encrypts plaintext for recipient, and signs it with our identity key
+func (stack *Stack) Seal(recipient ed25519.PublicKey, plaintext string) (string, error) {
+	recipientX, err := x25519PublicKey(recipient)
+	if err != nil {
+		return "", err
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := ephemeral.ECDH(recipientX)
+	if err != nil {
+		return "", err
+	}
+
+	sender := stack.identity.Public().(ed25519.PublicKey)
+	aead, err := sealCipher(secret, ephemeral.PublicKey().Bytes(), recipient)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, sealNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := make([]byte, 0)
+	sealed = append(sealed, sender...)
+	sealed = append(sealed, ephemeral.PublicKey().Bytes()...)
+	sealed = append(sealed, nonce...)
+	sealed = aead.Seal(sealed, nonce, []byte(plaintext), sender)
+
+	signature := ed25519.Sign(stack.identity, signedSeal(recipient, sealed))
+	sealed = append(sealed, signature...)
+
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Open checks the signature of a sealed message and decrypts it with our identity key
+// it returns the public key of the sender and the plaintext
+func (stack *Stack) Open(text string) (ed25519.PublicKey, string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(text)
+	if err != nil {
+		return nil, "", err
+	}
+
+	headerSize := ed25519.PublicKeySize + sealKeySize + sealNonceSize
+	if len(sealed) < headerSize+ed25519.SignatureSize {
+		return nil, "", errors.New("sealed message too short")
+	}
+
+	signed, signature := sealed[:len(sealed)-ed25519.SignatureSize], sealed[len(sealed)-ed25519.SignatureSize:]
+	sender := ed25519.PublicKey(signed[:ed25519.PublicKeySize])
+	ephemeralKey := signed[ed25519.PublicKeySize : ed25519.PublicKeySize+sealKeySize]
+	nonce := signed[ed25519.PublicKeySize+sealKeySize : headerSize]
+
+	local := stack.identity.Public().(ed25519.PublicKey)
+	if !ed25519.Verify(sender, signedSeal(local, signed), signature) {
+		return nil, "", errors.New("invalid signature")
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	privateX, err := x25519PrivateKey(stack.identity)
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret, err := privateX.ECDH(ephemeral)
+	if err != nil {
+		return nil, "", err
+	}
+
+	aead, err := sealCipher(secret, ephemeralKey, local)
+	if err != nil {
+		return nil, "", err
+	}
+
+	plaintext, err := aead.Open(nil, nonce, signed[headerSize:], sender)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return sender, string(plaintext), nil
+}
+
+// signedSeal returns the bytes covered by the signature of a sealed message
+// the recipient is included so a sealed message can't be forwarded to someone else as if it was meant for them
+func signedSeal(recipient ed25519.PublicKey, sealed []byte) []byte {
+	signed := []byte(sealContext)
+	signed = append(signed, recipient...)
+	return append(signed, sealed...)
+}
+
+func sealCipher(secret []byte, ephemeralKey []byte, recipient ed25519.PublicKey) (cipher.AEAD, error) {
+	// HKDF-SHA256 (RFC 5869) with an empty salt, a single block of output is enough for the key
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(sealContext))
+	expand.Write(ephemeralKey)
+	expand.Write(recipient)
+	expand.Write([]byte{1})
+
+	block, err := aes.NewCipher(expand.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// x25519PrivateKey returns the X25519 form of an Ed25519 private key (the clamped hash of its seed)
+func x25519PrivateKey(key ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	hash := sha512.Sum512(key.Seed())
+	return ecdh.X25519().NewPrivateKey(hash[:32])
+}
+
+// x25519PublicKey returns the X25519 form of an Ed25519 public key : u = (1 + y) / (1 - y)
+func x25519PublicKey(key ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key size")
+	}
+
+	// y is encoded in little endian, the highest bit is the sign of x
+	raw := make([]byte, len(key))
+	for i := range key {
+		raw[len(key)-1-i] = key[i]
+	}
+	raw[0] &= 0x7f
+	y := new(big.Int).SetBytes(raw)
+
+	one := big.NewInt(1)
+	numerator := new(big.Int).Add(one, y)
+	denominator := new(big.Int).Sub(one, y)
+	denominator.Mod(denominator, curve25519P)
+	if denominator.Sign() == 0 {
+		return nil, errors.New("invalid public key")
+	}
+
+	u := numerator.Mul(numerator, denominator.ModInverse(denominator, curve25519P))
+	u.Mod(u, curve25519P)
+
+	encoded := make([]byte, 32)
+	u.FillBytes(encoded)
+	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+
+	return ecdh.X25519().NewPublicKey(encoded)
+}
@@ -0,0 +1,90 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stack is the network side of a peer : its identity, its connections to the directory servers and to the other peers,
+// and its view of the members of the chat.
+// Several stacks can run in the same process (as several peers in a test), they share nothing.
+// The loops of a stack (Listen, RunMembership, ConnectToDirectory, DiscoverLAN) run until their context is done.
+type Stack struct {
+	identity  ed25519.PrivateKey // proves who we are to the directory server and to the other peers
+	transport Transport
+	tlsConfig *TLSConfig // nil when the connections are plaintext TCP
+	heartbeat HeartbeatConfig
+	logLevel  LogLevel // messages traced on the standard output
+
+	// discovery
+	connectedToDirectory atomic.Bool
+	chatPort             int
+	usernameChannel      chan string
+	bannedFromDirectory  atomic.Bool
+	directories          []string // addresses ("a.b.c.d:0000") of the directory servers of the cluster, tried in turn
+	directoryIndex       int      // index in directories of the directory we use
+	directoriesMutex     sync.Mutex
+
+	// rooms, the connection to the directory is set with them
+	roomsMutex    sync.Mutex
+	directoryConn *Conn           // current connection to the directory server
+	joinedRooms   map[string]bool // rooms joined by the local client, announced again after a reconnection
+
+	// names
+	namesMutex     sync.Mutex
+	chosenName     string // username asked with RequestName, asked again after a reconnection to the directory
+	chosenPassword string
+
+	// membership
+	membershipMutex sync.Mutex
+	members         map[string]*member
+	dissemination   map[string]int    // updates left to piggyback, by address, with their number of remaining transmissions
+	pendingAcks     map[uint64]func() // callbacks of the probes waiting for a SWIMACK, by sequence number
+	probeSeq        uint64            // sequence number of the last probe
+	selfIncarnation uint64            // starts high enough to replace the state of a previous run
+	selfName        string            // local username, piggybacked with our rooms
+	membersChanged  chan bool         // signaled when the list of members must be sent to the chat again
+}
+
+// NewStack builds the stack of a peer identified by key, with plaintext TCP connections and the default heartbeat
+func NewStack(key ed25519.PrivateKey) *Stack {
+	return &Stack{
+		identity:        key,
+		transport:       TCPTransport{},
+		heartbeat:       DefaultHeartbeat,
+		logLevel:        LogInfo,
+		joinedRooms:     make(map[string]bool),
+		members:         make(map[string]*member),
+		dissemination:   make(map[string]int),
+		pendingAcks:     make(map[uint64]func()),
+		selfIncarnation: uint64(time.Now().Unix()),
+		membersChanged:  make(chan bool, 1),
+	}
+}
+
+// UseLogLevel sets which messages sent and received are traced, LogInfo by default
+// it must be called before the stack opens or accepts connections
+func (stack *Stack) UseLogLevel(level LogLevel) {
+	stack.logLevel = level
+}
+
+// CloseOnDone closes socket when ctx is done, so the goroutine blocked reading it stops
+// the returned function must be called (once) when the socket is no longer used, to stop waiting for ctx
+func CloseOnDone(ctx context.Context, socket io.Closer) (release func()) {
+	released := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			socket.Close()
+		case <-released:
+		}
+	}()
+
+	return func() {
+		close(released)
+	}
+}
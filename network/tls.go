@@ -0,0 +1,302 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files written by GenerateKeys in the keys directory
+const (
+	caCertFile   = "ca.pem"
+	caKeyFile    = "ca.key"
+	nodeCertFile = "node.pem"
+	nodeKeyFile  = "node.key"
+
+	certificateValidity = 5 * 365 * 24 * time.Hour
+)
+
+// TLSConfig holds the TLS configurations used by the network package
+// Peer is used for peer to peer links, both ends must present a certificate signed by our CA
+// Directory is used for the link to the directory server, which can be pinned by its fingerprint
+type TLSConfig struct {
+	Peer      *tls.Config
+	Directory *tls.Config
+}
+
+// UseTLS enables TLS for every connection opened or accepted by the stack
+func (stack *Stack) UseTLS(config *TLSConfig) {
+	stack.tlsConfig = config
+}
+
+// GenerateKeys creates a self-signed CA in dir (unless it already exists)
+// and a certificate for this node signed by this CA.
+// To add a machine to the chat, copy ca.pem and ca.key in its keys directory and run keygen there.
+func GenerateKeys(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	caCert, caKey, err := loadCA(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		caCert, caKey, err = createCA(dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	template, err := certificateTemplate("GOssip node " + hostname)
+	if err != nil {
+		return err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(filepath.Join(dir, nodeCertFile), "CERTIFICATE", der); err != nil {
+		return err
+	}
+	if err := writeKey(filepath.Join(dir, nodeKeyFile), key); err != nil {
+		return err
+	}
+
+	fmt.Println("Certificate fingerprint :", Fingerprint(der))
+	return nil
+}
+
+// LoadTLS reads the keys generated by GenerateKeys in dir
+// directoryPin is the fingerprint of the directory server certificate,
+// if it is empty the directory certificate must be signed by our CA
+func LoadTLS(dir string, directoryPin string) (*TLSConfig, error) {
+	pool, cert, err := loadNode(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	peer := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS12,
+		// peers are reached by IP address, so we verify the chain against our CA but not the host name
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return verifyChain(state, pool)
+		},
+	}
+
+	directory := peer.Clone()
+	if directoryPin != "" {
+		pin := strings.ToLower(strings.Replace(directoryPin, ":", "", -1))
+		directory.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 || Fingerprint(state.PeerCertificates[0].Raw) != pin {
+				return errors.New("directory certificate does not match the pinned fingerprint")
+			}
+			return nil
+		}
+	}
+
+	return &TLSConfig{
+		Peer:      peer,
+		Directory: directory,
+	}, nil
+}
+
+// ServerTLSConfig returns the configuration of the directory server, using the keys generated by GenerateKeys in dir
+// Clients must present a certificate signed by our CA
+func ServerTLSConfig(dir string) (*tls.Config, error) {
+	pool, cert, err := loadNode(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Certificate fingerprint :", Fingerprint(cert.Certificate[0]))
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS12,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return verifyChain(state, pool)
+		},
+	}, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a DER encoded certificate
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+func verifyChain(state tls.ConnectionState, pool *x509.CertPool) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no certificate presented")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+func loadNode(dir string) (*x509.CertPool, tls.Certificate, error) {
+	caPEM, err := os.ReadFile(filepath.Join(dir, caCertFile))
+	if err != nil {
+		return nil, tls.Certificate{}, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, tls.Certificate{}, errors.New("invalid CA certificate in " + dir)
+	}
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, nodeCertFile), filepath.Join(dir, nodeKeyFile))
+	if err != nil {
+		return nil, tls.Certificate{}, err
+	}
+
+	return pool, cert, nil
+}
+
+func loadCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	caCert, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	caKey, ok := cert.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("unsupported CA key type")
+	}
+
+	return caCert, caKey, nil
+}
+
+func createCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template, err := certificateTemplate("GOssip CA")
+	if err != nil {
+		return nil, nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage |= x509.KeyUsageCertSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := writePEM(filepath.Join(dir, caCertFile), "CERTIFICATE", der); err != nil {
+		return nil, nil, err
+	}
+	if err := writeKey(filepath.Join(dir, caKeyFile), key); err != nil {
+		return nil, nil, err
+	}
+
+	fmt.Println("Created a new CA in", dir)
+
+	caCert, err := x509.ParseCertificate(der)
+	return caCert, key, err
+}
+
+func certificateTemplate(commonName string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(certificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, nil
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "EC PRIVATE KEY", der)
+}
+
+func writePEM(path string, kind string, der []byte) error {
+	var buffer bytes.Buffer
+	if err := pem.Encode(&buffer, &pem.Block{Type: kind, Bytes: der}); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buffer.Bytes(), 0600)
+}
+
+// dialPeer opens a connection to a peer, using TLS if it is enabled
+// the connection is abandoned after dialTimeout, so a vanished peer doesn't block the reconnection loop, or when ctx is done
+func (stack *Stack) dialPeer(ctx context.Context, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	if stack.tlsConfig != nil {
+		return DialTLS(ctx, stack.transport, addr, stack.tlsConfig.Peer)
+	}
+	return stack.transport.Dial(ctx, addr)
+}
+
+// dialDirectory opens a connection to the directory server, using TLS if it is enabled
+// the connection is abandoned when ctx is done
+func (stack *Stack) dialDirectory(ctx context.Context, addr string) (net.Conn, error) {
+	if stack.tlsConfig != nil {
+		return DialTLS(ctx, stack.transport, addr, stack.tlsConfig.Directory)
+	}
+	return stack.transport.Dial(ctx, addr)
+}
+
+// listenPeers opens the socket accepting connections from other peers, using TLS if it is enabled
+func (stack *Stack) listenPeers(port int) (net.Listener, error) {
+	ln, err := stack.transport.Listen(":" + strconv.Itoa(port))
+	if err != nil || stack.tlsConfig == nil {
+		return ln, err
+	}
+	return tls.NewListener(ln, stack.tlsConfig.Peer), nil
+}
@@ -0,0 +1,66 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// Transport opens the sockets of a stack : the TCP connections to the peers and to the directory,
+// the listening socket, and the UDP socket of the DHT.
+// TCPTransport is the real network, a MemoryNetwork connects the stacks of the same process.
+// TLS is added on top of the transport, the multicast of the local network discovery always uses the real network.
+type Transport interface {
+	Dial(ctx context.Context, address string) (net.Conn, error)
+	Listen(address string) (net.Listener, error)
+	ListenPacket(address string) (net.PacketConn, error)
+}
+
+// TCPTransport is the real network, TCP for the connections and UDP for the packets
+type TCPTransport struct{}
+
+// Dial opens a TCP connection to address ("a.b.c.d:0000"), it gives up when ctx is done
+func (TCPTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	return (&net.Dialer{}).DialContext(ctx, "tcp", address)
+}
+
+// Listen opens a TCP listening socket on address (":0000" for every interface)
+func (TCPTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+// ListenPacket opens a UDP socket on address (":0000" for every interface)
+func (TCPTransport) ListenPacket(address string) (net.PacketConn, error) {
+	return net.ListenPacket("udp", address)
+}
+
+// UseTransport sets the transport of the connections opened or accepted afterwards, TCPTransport by default
+func (stack *Stack) UseTransport(transport Transport) {
+	stack.transport = transport
+}
+
+// DialTLS opens a connection to address with transport, then does the TLS handshake as a client with config
+// the connection is abandoned when ctx is done
+func DialTLS(ctx context.Context, transport Transport, address string, config *tls.Config) (net.Conn, error) {
+	conn, err := transport.Dial(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	// like tls.Dial, the host name is verified unless the configuration gives another one (or skips the verification)
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,207 @@
+package scenario
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/teanan/GOssip-TP/directory/server"
+	"github.com/teanan/GOssip-TP/gossip"
+	"github.com/teanan/GOssip-TP/network"
+)
+
+// A Scenario runs a directory and chat nodes in the same process, on a network.MemoryNetwork,
+// so a test can check what the peers see when the network is slow, lossy or partitioned :
+//
+//	s, err := scenario.New(scenario.Config{Seed: 42, Peers: 3})
+//	s.Network.SetConditions(network.LinkConditions{Latency: 20 * time.Millisecond, DropRate: 0.05})
+//	err = s.Start(ctx)
+//	defer s.Stop()
+//	s.Node(0).Send("#general", "hello")
+//	event, err := s.WaitFor(1, 5*time.Second, func(e gossip.Event) bool { return e.Kind == gossip.MessageReceived })
+//	s.Network.Partition([]string{s.Host(0)}, []string{s.Host(1), s.Host(2)})
+//
+// The directory is the host DirectoryHost, the peer i is the host PeerHost(i) and is named "peer<i>".
+// The identities of the peers are drawn from the seed too, so a scenario run again with the same seed
+// gets the same peers on the same network. With a network.VirtualClock in Config.Clock, the network only
+// delivers when the test advances the clock, so its delays don't depend on the load of the machine
+// (the timers of the nodes themselves, like the heartbeat, still run on the wall clock).
+
+const (
+	DirectoryHost = "10.0.0.1"
+	directoryPort = 8080
+	chatPort      = 9000
+)
+
+// Config is the configuration of a scenario
+type Config struct {
+	Seed      int64                   // seed of the network and of the identities of the peers
+	Peers     int                     // number of chat nodes
+	Heartbeat network.HeartbeatConfig // heartbeat of the peers, network.DefaultHeartbeat if it is zero
+	Clock     network.Clock           // clock of the network, the wall clock if it is nil
+}
+
+// Scenario is a directory and its peers on a simulated network
+type Scenario struct {
+	Network   *network.MemoryNetwork
+	Directory *server.Server
+
+	nodes       []*gossip.Node
+	events      []<-chan gossip.Event
+	historyDirs []string
+	cancel      context.CancelFunc // stops the directory
+	stopOnce    sync.Once
+}
+
+// PeerHost returns the host of the peer i
+func PeerHost(i int) string {
+	return "10.0.1." + strconv.Itoa(i+1)
+}
+
+// New builds the directory and the nodes of a scenario, nothing runs until Start
+func New(config Config) (*Scenario, error) {
+	if config.Peers < 1 || config.Peers > 254 {
+		return nil, errors.New("a scenario has 1 to 254 peers")
+	}
+
+	s := &Scenario{Network: network.NewMemoryNetwork(config.Seed)}
+	if config.Clock != nil {
+		s.Network.UseClock(config.Clock)
+	}
+	directoryAddress := net.JoinHostPort(DirectoryHost, strconv.Itoa(directoryPort))
+
+	var err error
+	s.Directory, err = server.NewServer(server.Config{
+		ListenAddress: directoryAddress,
+		Transport:     s.Network.Host(DirectoryHost),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	random := rand.New(rand.NewSource(config.Seed))
+	for i := 0; i < config.Peers; i++ {
+		seed := make([]byte, ed25519.SeedSize)
+		random.Read(seed)
+
+		dir, err := os.MkdirTemp("", "gossip-scenario-")
+		if err != nil {
+			s.removeHistory()
+			return nil, err
+		}
+		s.historyDirs = append(s.historyDirs, dir)
+
+		node, err := gossip.NewNode(gossip.Config{
+			Identity:    ed25519.NewKeyFromSeed(seed),
+			Port:        chatPort,
+			Directories: []string{directoryAddress},
+			Username:    "peer" + strconv.Itoa(i),
+			HistoryDir:  dir,
+			Heartbeat:   config.Heartbeat,
+			Transport:   s.Network.Host(PeerHost(i)),
+		})
+		if err != nil {
+			s.removeHistory()
+			return nil, err
+		}
+		s.nodes = append(s.nodes, node)
+		s.events = append(s.events, node.Subscribe())
+	}
+	return s, nil
+}
+
+// Start runs the directory, then the nodes
+func (s *Scenario) Start(ctx context.Context) error {
+	ln, err := s.Network.Host(DirectoryHost).Listen(":" + strconv.Itoa(directoryPort))
+	if err != nil {
+		return err
+	}
+	directoryCtx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go s.Directory.Serve(directoryCtx, ln)
+
+	for i, node := range s.nodes {
+		if err := node.Start(ctx); err != nil {
+			s.Stop()
+			return fmt.Errorf("peer %d : %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Stop stops the nodes (they say BYE to each other and to the directory), then the directory,
+// and removes the history of the nodes
+func (s *Scenario) Stop() {
+	s.stopOnce.Do(func() {
+		var stopped sync.WaitGroup
+		for _, node := range s.nodes {
+			stopped.Add(1)
+			go func(node *gossip.Node) {
+				defer stopped.Done()
+				node.Stop()
+			}(node)
+		}
+		stopped.Wait()
+
+		if s.cancel != nil {
+			s.cancel()
+		}
+		s.removeHistory()
+	})
+}
+
+// removeHistory removes the history directories of the nodes
+func (s *Scenario) removeHistory() {
+	for _, dir := range s.historyDirs {
+		os.RemoveAll(dir)
+	}
+}
+
+// Peers returns the number of nodes
+func (s *Scenario) Peers() int {
+	return len(s.nodes)
+}
+
+// Node returns the node of the peer i
+func (s *Scenario) Node(i int) *gossip.Node {
+	return s.nodes[i]
+}
+
+// Host returns the host of the peer i, to set the conditions of its links or to cut it from the others
+func (s *Scenario) Host(i int) string {
+	return PeerHost(i)
+}
+
+// Events returns the events of the peer i, subscribed before it started
+// they are also read by WaitFor
+func (s *Scenario) Events(i int) <-chan gossip.Event {
+	return s.events[i]
+}
+
+// WaitFor reads the events of the peer i until one matches, the events read before it are dropped
+// it gives up after timeout, or when the node stops
+func (s *Scenario) WaitFor(i int, timeout time.Duration, match func(gossip.Event) bool) (gossip.Event, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case event, ok := <-s.events[i]:
+			if !ok {
+				return gossip.Event{}, fmt.Errorf("peer %d stopped", i)
+			}
+			if match(event) {
+				return event, nil
+			}
+		case <-deadline.C:
+			return gossip.Event{}, fmt.Errorf("peer %d : no matching event after %v", i, timeout)
+		}
+	}
+}
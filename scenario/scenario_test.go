@@ -0,0 +1,146 @@
+package scenario
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/teanan/GOssip-TP/gossip"
+	"github.com/teanan/GOssip-TP/network"
+)
+
+// a fast heartbeat, so the connections notice a silent peer quickly
+var testHeartbeat = network.HeartbeatConfig{
+	Interval:       200 * time.Millisecond,
+	SuspectTimeout: 600 * time.Millisecond,
+	DeadTimeout:    1200 * time.Millisecond,
+}
+
+func isKind(kind gossip.EventKind) func(gossip.Event) bool {
+	return func(e gossip.Event) bool {
+		return e.Kind == kind
+	}
+}
+
+// startScenario runs a directory and peers on a network with conditions, until every peer is connected to the others
+// the scenario is stopped with the test
+func startScenario(t *testing.T, peers int, conditions network.LinkConditions) *Scenario {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("the scenarios run for seconds")
+	}
+
+	s, err := New(Config{Seed: 42, Peers: peers, Heartbeat: testHeartbeat})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Network.SetConditions(conditions)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+
+	for i := 0; i < peers; i++ {
+		for j := 1; j < peers; j++ {
+			if _, err := s.WaitFor(i, 10*time.Second, isKind(gossip.PeerJoined)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return s
+}
+
+// expectMessage waits until the peer i receives text
+func expectMessage(t *testing.T, s *Scenario, i int, text string, timeout time.Duration) {
+	t.Helper()
+	_, err := s.WaitFor(i, timeout, func(e gossip.Event) bool {
+		return e.Kind == gossip.MessageReceived && e.Text == text
+	})
+	if err != nil {
+		t.Fatalf("%q not received : %v", text, err)
+	}
+}
+
+func TestMessagesReachEveryPeer(t *testing.T) {
+	s := startScenario(t, 4, network.LinkConditions{
+		Latency:     10 * time.Millisecond,
+		Jitter:      10 * time.Millisecond,
+		DropRate:    0.05,
+		ReorderRate: 0.1,
+	})
+
+	// the segments lost on the way are sent again, every message arrives
+	const messages = 5
+	for m := 0; m < messages; m++ {
+		if err := s.Node(0).Send("#general", "message "+strconv.Itoa(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < s.Peers(); i++ {
+		received := make(map[string]bool)
+		for len(received) < messages {
+			event, err := s.WaitFor(i, 5*time.Second, isKind(gossip.MessageReceived))
+			if err != nil {
+				t.Fatalf("peer %d received %d messages out of %d : %v", i, len(received), messages, err)
+			}
+			if event.From != "peer0" {
+				t.Errorf("peer %d : message from %q, want peer0", i, event.From)
+			}
+			received[event.Text] = true
+		}
+	}
+}
+
+func TestShortPartitionHoldsMessages(t *testing.T) {
+	s := startScenario(t, 3, network.LinkConditions{Latency: 5 * time.Millisecond})
+
+	// the partition is shorter than the heartbeat timeouts, the connections survive it
+	s.Network.Partition([]string{s.Host(0)}, []string{s.Host(1), s.Host(2)})
+	if err := s.Node(0).Send("#general", "during the partition"); err != nil {
+		t.Fatal(err)
+	}
+	if event, err := s.WaitFor(1, 300*time.Millisecond, isKind(gossip.MessageReceived)); err == nil {
+		t.Fatalf("%q crossed the partition", event.Text)
+	}
+
+	s.Network.Heal()
+	expectMessage(t, s, 1, "during the partition", 5*time.Second)
+	expectMessage(t, s, 2, "during the partition", 5*time.Second)
+}
+
+func TestLongPartitionLosesPeer(t *testing.T) {
+	s := startScenario(t, 3, network.LinkConditions{Latency: 5 * time.Millisecond})
+
+	// the membership probes notice that peer0 is cut from the others (it is suspected for 5s before it is dead),
+	// the others still reach each other
+	s.Network.Partition([]string{s.Host(0)}, []string{s.Host(1), s.Host(2)})
+	event, err := s.WaitFor(1, 20*time.Second, isKind(gossip.PeerLeft))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Peer.Address != s.Host(0)+":"+strconv.Itoa(chatPort) {
+		t.Fatalf("peer 1 lost %s, want %s", event.Peer.Address, s.Host(0))
+	}
+
+	if err := s.Node(2).Send("#general", "inside the partition"); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, s, 1, "inside the partition", 5*time.Second)
+}
+
+func TestStopSaysBye(t *testing.T) {
+	s := startScenario(t, 3, network.LinkConditions{Latency: 5 * time.Millisecond})
+
+	// a node which stops is forgotten at once, without waiting for the heartbeat
+	start := time.Now()
+	s.Node(0).Stop()
+	for i := 1; i < s.Peers(); i++ {
+		if _, err := s.WaitFor(i, testHeartbeat.SuspectTimeout, isKind(gossip.PeerLeft)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= testHeartbeat.DeadTimeout {
+		t.Errorf("the peers noticed the stop after %v", elapsed)
+	}
+}